@@ -2,66 +2,286 @@ package blockchain
 
 import (
 	"bufio"
-	"encoding/base64"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
 
+	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/sirupsen/logrus"
 )
 
-type HubResponse struct {
-	Jsonrpc string `json:"jsonrpc"`
-	Result  string `json:"result"`
-	Id      int    `json:"id"`
+// Client sends JSON-RPC requests to a set of hubs over persistent connections. Requests are spread over the healthy hubs
+// in turn and, when a hub can't be reached or stops answering, they fail over to the next one
+type Client struct {
+	servers        []*server
+	next           uint32
+	dialTimeout    time.Duration
+	requestTimeout time.Duration
+	tlsConfig      *tls.Config
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
 }
 
-func ClaimExists(claimID string) (bool, error) {
-	request := fmt.Sprintf(`{ "id": 0, "method":"blockchain.claimtrie.getclaimbyid", "params": ["%s"]}`+"\n", claimID)
+// server is a hub along with its pool of connections
+type server struct {
+	address string
+	// slots limits the connections open at once, idle holds the ones that can be reused
+	slots chan struct{}
+	idle  chan *conn
 
-	// Connect to the server
-	conn, err := net.Dial("tcp", "s-hub1.odysee.com:50001")
-	if err != nil {
-		logrus.Println("Error connecting:", err.Error())
-		return false, errors.Err(err)
+	healthy atomic.Bool
+}
+
+type conn struct {
+	net.Conn
+	reader *bufio.Reader
+	nextID int
+}
+
+type hubRequest struct {
+	ID     int         `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params"`
+}
+
+type hubError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type hubResponse struct {
+	ID     *int            `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *hubError       `json:"error"`
+}
+
+// Init returns a client for the configured hubs and starts checking their health in the background
+func Init(config configs.HubConfig) (*Client, error) {
+	if len(config.Servers) == 0 {
+		return nil, errors.Err("no hub servers are configured, set hub.servers")
+	}
+	c := &Client{
+		dialTimeout:    config.DialTimeout(),
+		requestTimeout: config.RequestTimeout(),
+		stop:           make(chan struct{}),
+	}
+	if config.TLS {
+		c.tlsConfig = &tls.Config{InsecureSkipVerify: config.TLSSkipVerify}
+	}
+	for _, address := range config.Servers {
+		s := &server{
+			address: address,
+			slots:   make(chan struct{}, config.Connections()),
+			idle:    make(chan *conn, config.Connections()),
+		}
+		s.healthy.Store(true)
+		c.servers = append(c.servers, s)
 	}
-	defer conn.Close()
+	c.stopped.Add(1)
+	go c.checkHealth(config.HealthCheckInterval())
+	return c, nil
+}
 
-	// Write the request
-	conn.SetWriteDeadline(time.Now().Add(2 * time.Second)) // Set timeout
-	_, err = conn.Write([]byte(request))
-	if err != nil {
-		logrus.Println("Error writing:", err.Error())
-		return false, errors.Err(err)
+// Close stops the health checks and closes the idle connections
+func (c *Client) Close() {
+	close(c.stop)
+	c.stopped.Wait()
+	for _, s := range c.servers {
+		for len(s.idle) > 0 {
+			_ = (<-s.idle).Close()
+		}
 	}
+}
 
-	// Read the response
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second)) // Set timeout
-	reader := bufio.NewReader(conn)
-	response, err := reader.ReadString('\n')
-	if err != nil {
-		logrus.Println("Error reading:", err.Error())
-		return false, errors.Err(err)
+// Ping checks that at least one hub answers
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.call(ctx, []hubRequest{{Method: "server.ping", Params: []string{}}})
+	return err
+}
+
+// checkHealth pings every hub at the given interval so that the ones that recovered are used again
+func (c *Client) checkHealth(interval time.Duration) {
+	defer c.stopped.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, s := range c.servers {
+			ctx, cancel := context.WithTimeout(context.Background(), c.requestTimeout)
+			_, err := c.callServer(ctx, s, []hubRequest{{Method: "server.ping", Params: []string{}}})
+			cancel()
+			wasHealthy := s.healthy.Swap(err == nil)
+			if err != nil && wasHealthy {
+				logrus.Warnf("hub %s failed its health check: %s", s.address, err.Error())
+			} else if err == nil && !wasHealthy {
+				logrus.Infof("hub %s is healthy again", s.address)
+			}
+		}
+	}
+}
+
+// call sends the requests to the next healthy hub, failing over to the other hubs if it can't be reached or doesn't answer.
+// If every hub is unhealthy they are all tried anyway. The responses are in the order of the requests
+func (c *Client) call(ctx context.Context, requests []hubRequest) ([]hubResponse, error) {
+	start := int(atomic.AddUint32(&c.next, 1)) % len(c.servers)
+	var lastErr error
+	for _, healthyOnly := range []bool{true, false} {
+		for i := range c.servers {
+			s := c.servers[(start+i)%len(c.servers)]
+			if s.healthy.Load() != healthyOnly {
+				continue
+			}
+			responses, err := c.callServer(ctx, s, requests)
+			if err == nil {
+				s.healthy.Store(true)
+				return responses, nil
+			}
+			if ctx.Err() != nil {
+				return nil, errors.Err(ctx.Err())
+			}
+			lastErr = err
+			if s.healthy.Swap(false) {
+				logrus.Warnf("hub %s failed, failing over: %s", s.address, err.Error())
+			}
+		}
 	}
+	return nil, errors.Prefix("all hubs failed", lastErr)
+}
 
-	var hubResponse HubResponse
-	err = json.Unmarshal([]byte(response), &hubResponse)
+// callServer pipelines the requests over one of the connections to the hub: they're all written at once and the responses
+// are matched to them by their ID, in whatever order they come
+func (c *Client) callServer(ctx context.Context, s *server, requests []hubRequest) ([]hubResponse, error) {
+	for reuse := true; ; reuse = false {
+		cn, reused, err := c.acquire(ctx, s, reuse)
+		if err != nil {
+			return nil, err
+		}
+		responses, err := cn.roundTrip(ctx, requests, c.requestTimeout)
+		s.release(cn, err == nil)
+		// the hub may have closed an idle connection, which doesn't mean it's unhealthy: retry once on a new one
+		if err != nil && reused && ctx.Err() == nil {
+			continue
+		}
+		return responses, err
+	}
+}
+
+// acquire returns an idle connection to the hub, if reuse is set, or opens a new one, leaving the idle ones in the pool.
+// It waits for a connection to be released if the pool is full
+func (c *Client) acquire(ctx context.Context, s *server, reuse bool) (cn *conn, reused bool, err error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, errors.Err(ctx.Err())
+	}
+	if reuse {
+		select {
+		case cn := <-s.idle:
+			return cn, true, nil
+		default:
+		}
+	}
+	dialer := &net.Dialer{Timeout: c.dialTimeout}
+	var netConn net.Conn
+	if c.tlsConfig != nil {
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.tlsConfig}
+		netConn, err = tlsDialer.DialContext(ctx, "tcp", s.address)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", s.address)
+	}
 	if err != nil {
-		return false, errors.Err(err)
+		<-s.slots
+		return nil, false, errors.Err(err)
 	}
-	//base64 decode the result
-	decoded, err := base64.StdEncoding.DecodeString(hubResponse.Result)
+	return &conn{Conn: netConn, reader: bufio.NewReader(netConn)}, false, nil
+}
+
+// release returns the connection to the pool, or closes it if it failed as it may still have unread responses or if the pool is full
+func (s *server) release(cn *conn, ok bool) {
+	if !ok {
+		_ = cn.Close()
+	} else {
+		select {
+		case s.idle <- cn:
+		default:
+			_ = cn.Close()
+		}
+	}
+	<-s.slots
+}
+
+func (cn *conn) roundTrip(ctx context.Context, requests []hubRequest, timeout time.Duration) ([]hubResponse, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	err := cn.SetDeadline(deadline)
 	if err != nil {
-		return false, errors.Err(err)
+		return nil, errors.Err(err)
 	}
-	stringRepresentation := string(decoded)
-	if strings.Contains(stringRepresentation, "Could not find claim at") {
-		return false, nil
+	// cancelling the context interrupts the pending reads and writes
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = cn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	// the IDs keep increasing for the lifetime of the connection so that a late response can't be mistaken for another one
+	firstID := cn.nextID
+	writer := bufio.NewWriter(cn)
+	encoder := json.NewEncoder(writer)
+	for i := range requests {
+		requests[i].ID = firstID + i
+		// Encode terminates every request with the newline the hub expects
+		err = encoder.Encode(requests[i])
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+	}
+	cn.nextID += len(requests)
+	err = writer.Flush()
+	if err != nil {
+		return nil, errors.Err(err)
 	}
 
-	return true, nil
+	responses := make([]hubResponse, len(requests))
+	answered := make([]bool, len(requests))
+	for pending := len(requests); pending > 0; {
+		line, err := cn.reader.ReadBytes('\n')
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		var response hubResponse
+		err = json.Unmarshal(line, &response)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if response.ID == nil {
+			// notifications aren't answers to any request
+			continue
+		}
+		i := *response.ID - firstID
+		if i < 0 || i >= len(requests) || answered[i] {
+			return nil, errors.Err("unexpected response id %d from the hub", *response.ID)
+		}
+		answered[i] = true
+		responses[i] = response
+		pending--
+	}
+	return responses, nil
 }
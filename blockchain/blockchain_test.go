@@ -0,0 +1,109 @@
+package blockchain
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fakeHub answers every pair of pipelined requests in reverse order, preceded by a notification
+func fakeHub(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					var answers []string
+					for i := 0; i < 2; i++ {
+						line, err := reader.ReadBytes('\n')
+						if err != nil {
+							return
+						}
+						var request struct {
+							ID     int             `json:"id"`
+							Method string          `json:"method"`
+							Params json.RawMessage `json:"params"`
+						}
+						_ = json.Unmarshal(line, &request)
+						answers = append([]string{fakeAnswer(request.ID, request.Method, string(request.Params))}, answers...)
+					}
+					_, _ = fmt.Fprintf(conn, "{\"jsonrpc\": \"2.0\", \"method\": \"blockchain.headers.subscribe\", \"params\": []}\n")
+					for _, a := range answers {
+						_, _ = fmt.Fprintln(conn, a)
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func fakeAnswer(id int, method, params string) string {
+	var result []byte
+	switch {
+	case method == "blockchain.claimtrie.getclaimbyid" && params == `["missing"]`:
+		result = []byte("Could not find claim at missing")
+	case method == "blockchain.claimtrie.getclaimbyid":
+		result = []byte("claim")
+	case method == "blockchain.claimtrie.search" && params == `{"limit":1,"sd_hash":"found"}`:
+		result = protowire.AppendTag(nil, 1, protowire.BytesType)
+		result = protowire.AppendBytes(result, []byte{0x0a, 0x01, 0x00})
+	case method == "blockchain.claimtrie.search":
+		result = protowire.AppendTag(nil, 3, protowire.VarintType)
+		result = protowire.AppendVarint(result, 0)
+	default:
+		return fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "error": {"code": 1, "message": "unknown method"}}`, id)
+	}
+	return fmt.Sprintf(`{"jsonrpc": "2.0", "id": %d, "result": %q}`, id, base64.StdEncoding.EncodeToString(result))
+}
+
+func TestClaimsExist(t *testing.T) {
+	// nothing listens on the first server so the client must fail over to the second one
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	down := listener.Addr().String()
+	assert.NoError(t, listener.Close())
+
+	client, err := Init(configs.HubConfig{Servers: []string{down, fakeHub(t)}, ConnectionsPerServer: 1})
+	assert.NoError(t, err)
+	defer client.Close()
+	ctx := context.Background()
+
+	results, err := client.ClaimsExist(ctx, []Lookup{{ClaimID: "missing"}, {ClaimID: "exists"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []LookupResult{{Exists: false}, {Exists: true}}, results)
+
+	// the second batch goes over the same connection, with new IDs
+	results, err = client.ClaimsExist(ctx, []Lookup{{SdHash: "found"}, {SdHash: "unknown"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []LookupResult{{Exists: true}, {Exists: false}}, results)
+
+	responses, err := client.call(ctx, []hubRequest{{Method: "unknown"}, {Method: "blockchain.claimtrie.getclaimbyid", Params: []string{"exists"}}})
+	assert.NoError(t, err)
+	if assert.Len(t, responses, 2) {
+		assert.NotNil(t, responses[0].Error)
+		assert.Nil(t, responses[1].Error)
+	}
+}
+
+func TestInitWithoutServers(t *testing.T) {
+	_, err := Init(configs.HubConfig{})
+	assert.Error(t, err)
+}
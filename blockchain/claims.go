@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Lookup is a claim to look up on the hub, by claim ID or, when the claim ID isn't known, by the sd_hash of its stream
+type Lookup struct {
+	ClaimID string
+	SdHash  string
+}
+
+// LookupResult tells whether the hub knows the claim. Err is set if the hub failed to answer for this lookup only
+type LookupResult struct {
+	Exists bool
+	Err    error
+}
+
+func (l Lookup) request() hubRequest {
+	if l.ClaimID != "" {
+		return hubRequest{Method: "blockchain.claimtrie.getclaimbyid", Params: []string{l.ClaimID}}
+	}
+	return hubRequest{Method: "blockchain.claimtrie.search", Params: map[string]interface{}{"sd_hash": l.SdHash, "limit": 1}}
+}
+
+// ClaimsExist looks up a batch of claims in a single round trip to one of the hubs. The results are in the same order as the lookups
+func (c *Client) ClaimsExist(ctx context.Context, lookups []Lookup) ([]LookupResult, error) {
+	requests := make([]hubRequest, len(lookups))
+	for i, l := range lookups {
+		requests[i] = l.request()
+	}
+	responses, err := c.call(ctx, requests)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]LookupResult, len(lookups))
+	for i, response := range responses {
+		if response.Error != nil {
+			results[i].Err = errors.Err("hub error %d: %s", response.Error.Code, response.Error.Message)
+			continue
+		}
+		results[i].Exists, results[i].Err = parseResult(lookups[i], response.Result)
+	}
+	return results, nil
+}
+
+// ClaimExists tells whether the hub knows the claim with the given ID
+func (c *Client) ClaimExists(ctx context.Context, claimID string) (bool, error) {
+	results, err := c.ClaimsExist(ctx, []Lookup{{ClaimID: claimID}})
+	if err != nil {
+		return false, err
+	}
+	return results[0].Exists, results[0].Err
+}
+
+// parseResult decodes the base64 serialized protobuf the hub answers lookups with
+func parseResult(l Lookup, result json.RawMessage) (bool, error) {
+	var encoded string
+	err := json.Unmarshal(result, &encoded)
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	if l.ClaimID != "" {
+		return !strings.Contains(string(decoded), "Could not find claim at"), nil
+	}
+	return hasTxos(decoded)
+}
+
+// hasTxos tells whether the serialized search results contain at least one claim. It only walks the top level fields of the
+// message, where the claims are the repeated field 1
+func hasTxos(outputs []byte) (bool, error) {
+	for len(outputs) > 0 {
+		number, wireType, n := protowire.ConsumeTag(outputs)
+		if n < 0 {
+			return false, errors.Err(protowire.ParseError(n))
+		}
+		if number == 1 && wireType == protowire.BytesType {
+			return true, nil
+		}
+		outputs = outputs[n:]
+		n = protowire.ConsumeFieldValue(number, wireType, outputs)
+		if n < 0 {
+			return false, errors.Err(protowire.ParseError(n))
+		}
+		outputs = outputs[n:]
+	}
+	return false, nil
+}
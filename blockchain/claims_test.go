@@ -0,0 +1,33 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestHasTxos(t *testing.T) {
+	// total and offset only, as returned when nothing matches
+	empty := protowire.AppendTag(nil, 3, protowire.VarintType)
+	empty = protowire.AppendVarint(empty, 0)
+	empty = protowire.AppendTag(empty, 4, protowire.VarintType)
+	empty = protowire.AppendVarint(empty, 0)
+	found, err := hasTxos(empty)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	withTxo := protowire.AppendTag(nil, 1, protowire.BytesType)
+	withTxo = protowire.AppendBytes(withTxo, []byte{0x0a, 0x01, 0x00})
+	withTxo = append(withTxo, empty...)
+	found, err = hasTxos(withTxo)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = hasTxos(nil)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	_, err = hasTxos([]byte{0x1a})
+	assert.Error(t, err)
+}
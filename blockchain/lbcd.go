@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Node is an lbcd node queried over its JSON-RPC interface
+type Node struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+	nextID   int64
+}
+
+type nodeResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *hubError       `json:"error"`
+}
+
+// InitNode returns a client for the lbcd node
+func InitNode(config configs.LbcdConfig, timeout time.Duration) *Node {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// lbcd generates a self-signed certificate by default
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: config.TLSSkipVerify}
+	return &Node{
+		url:      config.URL,
+		user:     config.User,
+		password: config.Password,
+		client:   &http.Client{Transport: transport, Timeout: timeout},
+	}
+}
+
+// ClaimExists tells whether the claim with the given ID is in the claimtrie of the node
+func (n *Node) ClaimExists(ctx context.Context, claimID string) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "1.0",
+		"id":      atomic.AddInt64(&n.nextID, 1),
+		"method":  "getclaimbyid",
+		"params":  []string{claimID},
+	})
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(n.user, n.password)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return false, errors.Err("lbcd rejected the credentials")
+	}
+	var response nodeResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return false, errors.Prefix(resp.Status, err)
+	}
+	if response.Error != nil {
+		message := strings.ToLower(response.Error.Message)
+		if strings.Contains(message, "not found") || strings.Contains(message, "unable to find") {
+			return false, nil
+		}
+		return false, errors.Err("lbcd error %d: %s", response.Error.Code, response.Error.Message)
+	}
+	return len(response.Result) > 0 && string(response.Result) != "null", nil
+}
@@ -1,6 +1,7 @@
 package chainquery
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"runtime"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/metrics"
 	"github.com/nikooo777/reflector-s3-cleaner/shared"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -61,13 +63,18 @@ func Init() (*CQApi, error) {
 	return instance, nil
 }
 
+// Ping checks that the database is reachable with the configured credentials
+func (c *CQApi) Ping(ctx context.Context) error {
+	return errors.Err(c.dbConn.PingContext(ctx))
+}
+
 func connect() (*sql.DB, error) {
 	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s?parseTime=true", configs.Configuration.Chainquery.User, configs.Configuration.Chainquery.Password, configs.Configuration.Chainquery.Host, configs.Configuration.Chainquery.Database))
 	return db, errors.Err(err)
 }
 
-func (c *CQApi) GetClaimFromSDHash(sdHash string) (*Claim, error) {
-	rows, err := c.dbConn.Query(`SELECT name, claim_id, claim_type, publisher_id, sd_hash, transaction_time, value_as_json, valid_at_height, height, effective_amount, content_type, thumbnail_url, title, bid_state, created_at, modified_at, claim_address, is_cert_valid, type, release_time 
+func (c *CQApi) GetClaimFromSDHash(ctx context.Context, sdHash string) (*Claim, error) {
+	rows, err := c.dbConn.QueryContext(ctx, `SELECT name, claim_id, claim_type, publisher_id, sd_hash, transaction_time, value_as_json, valid_at_height, height, effective_amount, content_type, thumbnail_url, title, bid_state, created_at, modified_at, claim_address, is_cert_valid, type, release_time 
 FROM claim 
 where sd_hash = ?`, sdHash)
 	if err != nil {
@@ -114,8 +121,8 @@ where sd_hash = ?`, sdHash)
 	return &claims[0], nil
 }
 
-func (c *CQApi) ClaimExists(sdHash string) (bool, error) {
-	rows, err := c.dbConn.Query(`SELECT count(id) FROM claim where sd_hash = ?`, sdHash)
+func (c *CQApi) ClaimExists(ctx context.Context, sdHash string) (bool, error) {
+	rows, err := c.dbConn.QueryContext(ctx, `SELECT count(id) FROM claim where sd_hash = ?`, sdHash)
 	if err != nil {
 		return false, errors.Err(err)
 	}
@@ -138,7 +145,12 @@ const (
 	Spent
 )
 
-func produce(resources []shared.StreamData, jobs chan<- []shared.StreamData, wg *sync.WaitGroup) {
+// batch is a range of indexes of the stream data being resolved
+type batch struct {
+	start, end int
+}
+
+func produce(ctx context.Context, resources []shared.StreamData, jobs chan<- batch, wg *sync.WaitGroup) {
 	defer wg.Done()
 	for i := 0; i < len(resources); i += shared.MysqlMaxBatchSize {
 		logrus.Printf("checking for existing hashes. Batch %d of %d", i, len(resources))
@@ -146,110 +158,193 @@ func produce(resources []shared.StreamData, jobs chan<- []shared.StreamData, wg
 		if j > len(resources) {
 			j = len(resources)
 		}
-		jobs <- resources[i:j]
+		select {
+		case jobs <- batch{start: i, end: j}:
+		case <-ctx.Done():
+			return
+		}
 	}
 
 }
 
-func (c *CQApi) consume(worker int, jobs <-chan []shared.StreamData, wg *sync.WaitGroup, existingHashes, claimIDs *sync.Map, checkExpired bool, checkSpent bool) {
+func (c *CQApi) consume(ctx context.Context, worker int, resources []shared.StreamData, jobs <-chan batch, wg *sync.WaitGroup, existingHashes, claimIDs, publisherIDs, bidStates, invalidSince *sync.Map, checkExpired bool, checkSpent bool, done func(batch), fail func(error)) {
 	defer wg.Done()
-	for msg := range jobs {
-		logrus.Infof("product of %d items is consumed by worker %v", len(msg), worker)
-		err := c.claimsExist(msg, existingHashes, claimIDs, checkExpired, checkSpent)
+	for b := range jobs {
+		logrus.Infof("product of %d items is consumed by worker %v", b.end-b.start, worker)
+		err := c.claimsExist(ctx, resources[b.start:b.end], existingHashes, claimIDs, publisherIDs, bidStates, invalidSince, checkExpired, checkSpent)
 		if err != nil {
-			logrus.Fatalf("batch processing reported an error: %s", errors.FullTrace(err))
+			fail(err)
+			continue
 		}
+		metrics.ChainqueryBatchesResolved.Inc()
+		done(b)
 	}
 }
 
-func (c *CQApi) BatchedClaimsExist(streamData []shared.StreamData, checkExpired bool, checkSpent bool) error {
+// BatchedClaimsExist resolves the chain state of the streams against chainquery and returns the streams it resolved.
+// If the context is cancelled or a batch fails, only the streams of the batches that were fully resolved are updated, marked as resolved and returned
+func (c *CQApi) BatchedClaimsExist(ctx context.Context, streamData []shared.StreamData, checkExpired bool, checkSpent bool) ([]shared.StreamData, error) {
 	existingHashes := &sync.Map{}
 	claimIDs := &sync.Map{}
+	publisherIDs := &sync.Map{}
+	bidStates := &sync.Map{}
+	invalidSince := &sync.Map{}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	errOnce := sync.Once{}
+	fail := func(err error) {
+		errOnce.Do(func() {
+			logrus.Errorf("batch processing reported an error: %s", errors.FullTrace(err))
+			firstErr = err
+			cancel()
+		})
+	}
+	resolvedBatches := make([]batch, 0, len(streamData)/shared.MysqlMaxBatchSize+1)
+	resolvedBatchesLock := sync.Mutex{}
+	done := func(b batch) {
+		resolvedBatchesLock.Lock()
+		defer resolvedBatchesLock.Unlock()
+		resolvedBatches = append(resolvedBatches, b)
+	}
 
 	producerWg := &sync.WaitGroup{}
-	jobs := make(chan []shared.StreamData, runtime.NumCPU())
+	jobs := make(chan batch, runtime.NumCPU())
 	producerWg.Add(1)
-	go produce(streamData, jobs, producerWg)
+	go produce(ctx, streamData, jobs, producerWg)
 
 	consumerWg := &sync.WaitGroup{}
 	for i := 0; i < runtime.NumCPU(); i++ {
 		consumerWg.Add(1)
-		go c.consume(i, jobs, consumerWg, existingHashes, claimIDs, checkExpired, checkSpent)
+		go c.consume(ctx, i, streamData, jobs, consumerWg, existingHashes, claimIDs, publisherIDs, bidStates, invalidSince, checkExpired, checkSpent, done, fail)
 	}
 
 	producerWg.Wait()
 	close(jobs)
 	consumerWg.Wait()
 
-	for i, sd := range streamData {
-		streamData[i].Resolved = true
-		val, ok := existingHashes.Load(sd.SdHash)
-		if !ok {
-			streamData[i].Exists = false
-		} else {
+	resolved := make([]shared.StreamData, 0, len(streamData))
+	for _, b := range resolvedBatches {
+		for i := b.start; i < b.end; i++ {
+			sd := streamData[i]
+			streamData[i].Resolved = true
+			val, ok := existingHashes.Load(sd.SdHash)
+			if !ok {
+				streamData[i].Exists = false
+				streamData[i].BidState = nil
+				resolved = append(resolved, streamData[i])
+				continue
+			}
 			chainState := val.(int)
 			streamData[i].Exists = true
-			switch chainState {
-			case Expired:
-				streamData[i].Expired = true
-			case Spent:
-				streamData[i].Spent = true
+			streamData[i].Expired = chainState == Expired
+			streamData[i].Spent = chainState == Spent
+			streamData[i].InvalidSince = nil
+			if chainState != Exists {
+				if since, ok := invalidSince.Load(sd.SdHash); ok {
+					t := since.(time.Time)
+					streamData[i].InvalidSince = &t
+				}
 			}
 			resolvedClaimID, ok := claimIDs.Load(sd.SdHash)
 			if ok {
 				s := resolvedClaimID.(string)
 				streamData[i].ClaimID = &s
 			}
+			streamData[i].PublisherID = nil
+			if publisherID, ok := publisherIDs.Load(sd.SdHash); ok {
+				p := publisherID.(string)
+				streamData[i].PublisherID = &p
+			}
+			streamData[i].BidState = nil
+			if bidState, ok := bidStates.Load(sd.SdHash); ok {
+				b := bidState.(string)
+				streamData[i].BidState = &b
+			}
+			resolved = append(resolved, streamData[i])
 		}
 	}
-	return nil
+	if firstErr == nil {
+		firstErr = errors.Err(ctx.Err())
+	}
+	if firstErr != nil {
+		logrus.Warnf("resolved %d of %d batches before stopping", len(resolvedBatches), (len(streamData)+shared.MysqlMaxBatchSize-1)/shared.MysqlMaxBatchSize)
+	}
+	return resolved, firstErr
 }
 
-func (c *CQApi) claimsExist(streams []shared.StreamData, existingHashes, claimIDs *sync.Map, checkExpired bool, checkSpent bool) error {
+// claimsExist resolves the chain state of the streams. For the claims that were spent or expired, the last time their row was modified is taken as the time they became invalid.
+// The bid state recorded for a stream is the one of the claim its chain state was taken from
+func (c *CQApi) claimsExist(ctx context.Context, streams []shared.StreamData, existingHashes, claimIDs, publisherIDs, bidStates, invalidSince *sync.Map, checkExpired bool, checkSpent bool) error {
 	sdHashes := make([]interface{}, len(streams))
 	for i, sd := range streams {
 		sdHashes[i] = sd.SdHash
 	}
-	rows, err := c.dbConn.Query(`SELECT sd_hash, bid_state, claim_id FROM claim where sd_hash in (`+query.Qs(len(sdHashes))+`)`, sdHashes...)
+	rows, err := c.dbConn.QueryContext(ctx, `SELECT sd_hash, bid_state, claim_id, publisher_id, modified_at FROM claim where sd_hash in (`+query.Qs(len(sdHashes))+`)`, sdHashes...)
 	if err != nil {
 		return errors.Err(err)
 	}
 	defer shared.CloseRows(rows)
 
-	visitedSdHashes := make(map[string][]int, len(sdHashes))
+	winners := make(map[string]sdClaim, len(sdHashes))
 	for rows.Next() {
 		var sdHash string
-		var bidState string
-		var claimID string
-
-		err = rows.Scan(&sdHash, &bidState, &claimID)
+		var claim sdClaim
+		err = rows.Scan(&sdHash, &claim.bidState, &claim.claimID, &claim.publisherID, &claim.modifiedAt)
 		if err != nil {
 			return errors.Err(err)
 		}
-		newState := Exists
-		if checkExpired && bidState == "Expired" {
-			newState = Expired
+		claim.state = Exists
+		if checkExpired && claim.bidState == "Expired" {
+			claim.state = Expired
 		}
-		if checkSpent && bidState == "Spent" {
-			newState = Spent
+		if checkSpent && claim.bidState == "Spent" {
+			claim.state = Spent
 		}
-		otherClaims, ok := visitedSdHashes[sdHash]
-		if !ok {
-			otherClaims = make([]int, 0, 1)
+		winner, ok := winners[sdHash]
+		if ok && claim.state != winner.state && (claim.state == Exists || winner.state == Exists) {
+			logrus.Debugf("sd_hash %s has multiple claims, but at least one is still valid", sdHash)
 		}
-		visitedSdHashes[sdHash] = append(otherClaims, newState)
-		if ok {
-			// multiple claims could be using the same sd_hash which means that if even just one claim still exists, then the sd_hash and the related blobs should be preserved
-			for _, state := range otherClaims {
-				if state == Exists && newState != Exists {
-					newState = state
-					logrus.Debugf("sd_hash %s has multiple claims, but at least one is still valid", sdHash)
-					break
-				}
-			}
+		if !ok || claim.wins(winner) {
+			winners[sdHash] = claim
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Err(err)
+	}
+	// the chain state, bid state, claim and publisher of the stream all come from the winning claim
+	for sdHash, claim := range winners {
+		existingHashes.Store(sdHash, claim.state)
+		bidStates.Store(sdHash, claim.bidState)
+		claimIDs.Store(sdHash, claim.claimID)
+		if claim.publisherID.Valid {
+			publisherIDs.Store(sdHash, claim.publisherID.String)
+		} else {
+			publisherIDs.Delete(sdHash)
+		}
+		if claim.state != Exists {
+			invalidSince.Store(sdHash, claim.modifiedAt)
 		}
-		existingHashes.Store(sdHash, newState)
-		claimIDs.Store(sdHash, claimID)
 	}
 	return nil
 }
+
+// sdClaim is one of the claims using an sd_hash
+type sdClaim struct {
+	state       int
+	bidState    string
+	claimID     string
+	publisherID null.String
+	modifiedAt  time.Time
+}
+
+// wins tells whether the claim decides the state of the stream over the current winner. Multiple claims could be using the same
+// sd_hash, which means that if even just one claim still exists the sd_hash and the related blobs should be preserved. Otherwise the
+// stream became invalid when the last claim did
+func (c sdClaim) wins(winner sdClaim) bool {
+	if c.state == Exists || winner.state == Exists {
+		return c.state == Exists && winner.state != Exists
+	}
+	return c.modifiedAt.After(winner.modifiedAt)
+}
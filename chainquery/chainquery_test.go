@@ -1,7 +1,10 @@
 package chainquery
 
 import (
+	"context"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/nikooo777/reflector-s3-cleaner/configs"
 	"github.com/nikooo777/reflector-s3-cleaner/shared"
@@ -10,76 +13,98 @@ import (
 )
 
 func TestCQApi_GetClaimFromSDHash(t *testing.T) {
-	err := configs.Init("../config.json")
-	assert.NoError(t, err)
+	initConfig(t)
 
 	cq, err := Init()
 	assert.NoError(t, err)
 	assert.NotNil(t, cq)
 
-	c, err := cq.GetClaimFromSDHash("8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5")
+	c, err := cq.GetClaimFromSDHash(context.Background(), "8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5")
 	assert.NoError(t, err)
 	assert.NotNil(t, c)
-	c, err = cq.GetClaimFromSDHash("sdsds")
+	c, err = cq.GetClaimFromSDHash(context.Background(), "sdsds")
 	assert.NoError(t, err)
 	assert.Nil(t, c)
 }
 
 func TestCQApi_ClaimExists(t *testing.T) {
-	err := configs.Init("../config.json")
-	assert.NoError(t, err)
+	initConfig(t)
 
 	cq, err := Init()
 	assert.NoError(t, err)
 	assert.NotNil(t, cq)
 
-	c, err := cq.ClaimExists("8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5")
+	c, err := cq.ClaimExists(context.Background(), "8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5")
 	assert.NoError(t, err)
 	assert.True(t, c)
-	c, err = cq.ClaimExists("sdsds")
+	c, err = cq.ClaimExists(context.Background(), "sdsds")
 	assert.NoError(t, err)
 	assert.False(t, c)
 }
 
 func TestCQApi_BatchedClaimsExist(t *testing.T) {
-	err := configs.Init("../config.json")
-	assert.NoError(t, err)
+	initConfig(t)
 
 	cq, err := Init()
 	assert.NoError(t, err)
 	assert.NotNil(t, cq)
 
 	hashesToResolve := []shared.StreamData{
-		{"8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", 0, false, false, false, false},
-		{"98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", 0, false, false, false, false},
-		{"398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", 0, false, false, false, false},
-		{"92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", 0, false, false, false, false},
+		{SdHash: "8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
 	}
 
 	expectedResults := []shared.StreamData{
-		{"8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", 0, true, true, false, true},
-		{"98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", 0, true, false, false, true},
-		{"398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", 0, false, false, false, true},
-		{"92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", 0, true, false, true, true},
+		{SdHash: "8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", StreamID: 0, Exists: true, Expired: true, Spent: false, Resolved: true},
+		{SdHash: "98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", StreamID: 0, Exists: true, Expired: false, Spent: false, Resolved: true},
+		{SdHash: "398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: true},
+		{SdHash: "92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", StreamID: 0, Exists: true, Expired: false, Spent: true, Resolved: true},
 	}
 
-	err = cq.BatchedClaimsExist(hashesToResolve, true, true)
+	resolved, err := cq.BatchedClaimsExist(context.Background(), hashesToResolve, true, true)
 	assert.NoError(t, err)
 	assert.ElementsMatch(t, hashesToResolve, expectedResults)
+	assert.ElementsMatch(t, resolved, expectedResults)
 
 	hashesToResolve = []shared.StreamData{
-		{"8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", 0, false, false, false, false},
-		{"98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", 0, false, false, false, false},
-		{"398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", 0, false, false, false, false},
-		{"92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", 0, false, false, false, false},
+		{SdHash: "8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
 	}
 	expectedResults = []shared.StreamData{
-		{"8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", 0, true, false, false, true},
-		{"98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", 0, true, false, false, true},
-		{"398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", 0, false, false, false, true},
-		{"92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", 0, true, false, false, true},
+		{SdHash: "8ca439c2ca48512b5188bde83c631475b4727763fcd11933d0f3d62defdd35808c9d502766a6c088d4dff6e48d0335b5", StreamID: 0, Exists: true, Expired: false, Spent: false, Resolved: true},
+		{SdHash: "98733467bf2e247d9c28f090bebfb68af6f3982a8169e689fa7e053902e6b1bdb2de040e29fd764d65221def3a80666c", StreamID: 0, Exists: true, Expired: false, Spent: false, Resolved: true},
+		{SdHash: "398504b5e6c65019cba01edf03fc9c2ad02606a80e76035e04fb5ec08ced6b5d8245484970bb51a06a787747030f3b7b", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: true},
+		{SdHash: "92b4287fb0fb3a331c2e46045ca70fc8cb0a572412e1f07439455a1c6cc149421dd3d1b9504e27ea0271545b393e755d", StreamID: 0, Exists: true, Expired: false, Spent: false, Resolved: true},
 	}
-	err = cq.BatchedClaimsExist(hashesToResolve, false, false)
+	resolved, err = cq.BatchedClaimsExist(context.Background(), hashesToResolve, false, false)
 	assert.NoError(t, err)
 	assert.ElementsMatch(t, hashesToResolve, expectedResults)
+	assert.ElementsMatch(t, resolved, expectedResults)
+}
+
+func TestSdClaimWins(t *testing.T) {
+	now := time.Now()
+	active := sdClaim{state: Exists, bidState: "Active", claimID: "active", modifiedAt: now.Add(-time.Hour)}
+	spent := sdClaim{state: Spent, bidState: "Spent", claimID: "spent", modifiedAt: now.Add(-2 * time.Hour)}
+	expired := sdClaim{state: Expired, bidState: "Expired", claimID: "expired", modifiedAt: now}
+
+	// a claim that still exists wins over the invalid ones whatever the order
+	assert.True(t, active.wins(expired))
+	assert.False(t, expired.wins(active))
+	assert.False(t, active.wins(active))
+	// otherwise the claim that became invalid last wins
+	assert.True(t, expired.wins(spent))
+	assert.False(t, spent.wins(expired))
+}
+
+// initConfig loads ../config.json, the tests against the live databases are skipped without it
+func initConfig(t *testing.T) {
+	if _, err := os.Stat("../config.json"); os.IsNotExist(err) {
+		t.Skip("../config.json is missing")
+	}
+	assert.NoError(t, configs.Init("../config.json"))
 }
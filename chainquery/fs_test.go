@@ -10,14 +10,14 @@ import (
 
 func TestSaveAndLoadSDHashes(t *testing.T) {
 	existingHashes := []shared.StreamData{
-		{"test1", 0, true, false, false, false},
-		{"test2", 0, true, false, false, false},
-		{"test3", 0, true, false, false, false},
+		{SdHash: "test1", StreamID: 0, Exists: true, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "test2", StreamID: 0, Exists: true, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "test3", StreamID: 0, Exists: true, Expired: false, Spent: false, Resolved: false},
 	}
 	unresolvedHashes := []shared.StreamData{
-		{"test4", 0, false, false, false, false},
-		{"test5", 0, true, true, false, false},
-		{"test6", 0, true, false, true, false},
+		{SdHash: "test4", StreamID: 0, Exists: false, Expired: false, Spent: false, Resolved: false},
+		{SdHash: "test5", StreamID: 0, Exists: true, Expired: true, Spent: false, Resolved: false},
+		{SdHash: "test6", StreamID: 0, Exists: true, Expired: false, Spent: true, Resolved: false},
 	}
 	err := SaveHashes(existingHashes, "existing_sd_hashes.json")
 	assert.NoError(t, err)
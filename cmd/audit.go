@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	auditFormat  string
+	auditOutput  string
+	auditFrom    string
+	auditTo      string
+	auditClaimID string
+	auditChannel string
+)
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "inspect the append-only log of every deletion from S3 and from the reflector database",
+}
+
+var auditExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "export the deletion audit log as JSON lines or CSV",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := sqlite_store.AuditFilter{ClaimID: auditClaimID, Channel: auditChannel}
+		var err error
+		if auditFrom != "" {
+			filter.From, err = parseTime(auditFrom)
+			if err != nil {
+				return err
+			}
+		}
+		if auditTo != "" {
+			filter.To, err = parseTime(auditTo)
+			if err != nil {
+				return err
+			}
+		}
+		if auditFormat != "jsonl" && auditFormat != "csv" {
+			return errors.Err("unknown format %s, it must be jsonl or csv", auditFormat)
+		}
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		out := io.Writer(os.Stdout)
+		if auditOutput != "-" {
+			f, err := os.Create(auditOutput)
+			if err != nil {
+				return errors.Err(err)
+			}
+			defer f.Close()
+			out = f
+		}
+		exported, err := exportAudit(cmd, localStore, filter, out)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("exported %d audit entries", exported)
+		return nil
+	},
+}
+
+func init() {
+	auditExportCmd.Flags().StringVar(&auditFormat, "format", "jsonl", "jsonl or csv")
+	auditExportCmd.Flags().StringVarP(&auditOutput, "output", "o", "-", "file to write the entries to, - for the standard output")
+	auditExportCmd.Flags().StringVar(&auditFrom, "from", "", "only export the deletions made at or after this date (2024-12-31) or RFC3339 timestamp")
+	auditExportCmd.Flags().StringVar(&auditTo, "to", "", "only export the deletions made before this date (2024-12-31) or RFC3339 timestamp")
+	auditExportCmd.Flags().StringVar(&auditClaimID, "claim-id", "", "only export the deletions made for the stream of this claim")
+	auditExportCmd.Flags().StringVar(&auditChannel, "channel", "", "only export the deletions made for the streams published in the channel with this claim ID")
+	auditCmd.AddCommand(auditExportCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errors.Err("invalid time %s, it must be a date (2024-12-31) or an RFC3339 timestamp", value)
+}
+
+var auditColumns = []string{"id", "deleted_at", "run_id", "system", "location", "object", "action", "stream_id", "sd_hash", "claim_id", "publisher_id",
+	"reason", "bid_state", "source"}
+
+func exportAudit(cmd *cobra.Command, localStore *sqlite_store.Store, filter sqlite_store.AuditFilter, out io.Writer) (int64, error) {
+	var exported int64
+	if auditFormat == "jsonl" {
+		encoder := json.NewEncoder(out)
+		err := localStore.ExportAudit(cmd.Context(), filter, func(e sqlite_store.AuditEntry) error {
+			exported++
+			return errors.Err(encoder.Encode(e))
+		})
+		return exported, err
+	}
+
+	w := csv.NewWriter(out)
+	err := w.Write(auditColumns)
+	if err != nil {
+		return 0, errors.Err(err)
+	}
+	err = localStore.ExportAudit(cmd.Context(), filter, func(e sqlite_store.AuditEntry) error {
+		exported++
+		return errors.Err(w.Write([]string{strconv.FormatInt(e.ID, 10), e.DeletedAt.UTC().Format(time.RFC3339Nano), formatInt(e.RunID), e.System, e.Location,
+			e.Object, e.Action, formatInt(e.StreamID), formatString(e.SdHash), formatString(e.ClaimID), formatString(e.PublisherID), formatString(e.Reason),
+			formatString(e.BidState), formatString(e.Source)}))
+	})
+	if err != nil {
+		return exported, err
+	}
+	w.Flush()
+	return exported, errors.Err(w.Error())
+}
+
+func formatInt(v *int64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func formatString(v *string) string {
+	if v == nil {
+		return ""
+	}
+	return *v
+}
@@ -0,0 +1,175 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"runtime"
+	"sync"
+
+	"github.com/nikooo777/reflector-s3-cleaner/reflector"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var cleanseCmd = &cobra.Command{
+	Use:   "cleanse",
+	Short: "remove all pruned blobs, sd_blobs and streams from the reflector database",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if dryRun {
+			return runDryStage(cmd.Context(), sqlite_store.StageCleanse, func(ctx context.Context, localStore *sqlite_store.Store) error {
+				return createPlan(ctx, localStore, sqlite_store.PlanKindCleanse)
+			})
+		}
+		return runStage(cmd.Context(), sqlite_store.StageCleanse, cleanse)
+	},
+}
+
+func init() {
+	addPlanFlags(cleanseCmd)
+	addSafetyFlags(cleanseCmd)
+	addGracePeriodFlags(cleanseCmd)
+	rootCmd.AddCommand(cleanseCmd)
+}
+
+func cleanse(ctx context.Context, localStore *sqlite_store.Store) error {
+	rf, err := reflector.Init()
+	if err != nil {
+		return err
+	}
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = localStore.LoadBlobs(ctx, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyProtections(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyConsensus(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyBlobReferences(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	// the streams are classified before the plan restricts them so that the safety checks see all of them
+	counts := summarize(streamData)
+	streamData, err = applyPlan(localStore, sqlite_store.PlanKindCleanse, streamData)
+	if err != nil {
+		return err
+	}
+	streamData = applyGracePeriod(streamData)
+	var blobRows int64
+	for _, sd := range streamData {
+		blobIDs, _ := reflector.SelectBlobRows(sd)
+		blobRows += int64(len(blobIDs))
+	}
+	// the storage was already reclaimed by wipe so only the amount of blobs is checked
+	err = checkSafety(counts, blobRows, 0)
+	if err != nil {
+		return err
+	}
+
+	numCPUs := runtime.NumCPU()
+	var wg sync.WaitGroup
+
+	// Channels
+	tasks := make(chan shared.StreamData, numCPUs)
+	var errMutex sync.Mutex
+	var errs []error
+
+	// Start workers
+	for w := 0; w < numCPUs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sd := range tasks {
+				// the deletions already fed to the workers are drained even after the context is cancelled
+				err := captureStreamRows(context.Background(), localStore, rf, sd)
+				if err != nil {
+					errMutex.Lock()
+					errs = append(errs, err)
+					errMutex.Unlock()
+					continue
+				}
+				removed, err := rf.DeleteStreamBlobs(context.Background(), sd)
+				runReport.AddDBRowsRemoved(int64(len(removed)))
+				if err != nil {
+					errMutex.Lock()
+					errs = append(errs, err)
+					errMutex.Unlock()
+					continue
+				}
+				// the rows are gone for good, so a failure to record them is only reported
+				err = localStore.RecordRowDeletions(context.Background(), sd.StreamID, removed)
+				if err != nil {
+					logrus.Errorf("failed to record the rows removed for stream %d in the audit log: %s", sd.StreamID, err.Error())
+				}
+			}
+		}()
+	}
+
+	// Feed tasks to the workers
+	queued, skipped := 0, 0
+feeding:
+	for i, sd := range streamData {
+		if i%5000 == 0 {
+			logrus.Infof("pruned %d/%d streams from reflector_data", i, len(streamData))
+		}
+		if sd.IsPurgeable() {
+			if _, skipReason := reflector.SelectBlobRows(sd); skipReason != "" {
+				logrus.Warnf("skipping stream %d (sd_hash %s): %s", sd.StreamID, sd.SdHash, skipReason)
+				skipped++
+				continue
+			}
+			select {
+			case tasks <- sd:
+				queued++
+			case <-ctx.Done():
+				break feeding
+			}
+		}
+	}
+	close(tasks) // Closing tasks channel to signal workers that no more tasks are coming
+
+	// Wait for all workers to finish
+	wg.Wait()
+
+	// Log all errors
+	for _, err := range errs {
+		logrus.Error(err)
+	}
+	logrus.Infof("processed %d streams for removal from reflector_data, %d failed, %d skipped because they aren't wiped yet", queued, len(errs), skipped)
+	if ctx.Err() != nil {
+		return errors.Err("cleanse was interrupted after %d streams, run cleanse again to complete it", queued)
+	}
+	if len(errs) > 0 {
+		return errors.Err("failed to cleanse %d streams", len(errs))
+	}
+	return nil
+}
+
+// captureStreamRows saves the reflector rows of the stream in the local store so that restore can put them back. Streams whose rows can't be saved aren't cleansed
+func captureStreamRows(ctx context.Context, localStore *sqlite_store.Store, rf *reflector.ReflectorApi, sd shared.StreamData) error {
+	if _, skipReason := reflector.SelectBlobRows(sd); skipReason != "" {
+		return nil
+	}
+	captured, err := rf.CaptureStreamRows(ctx, sd)
+	if err != nil || captured == nil {
+		return err
+	}
+	rows, err := json.Marshal(captured)
+	if err != nil {
+		return errors.Err(err)
+	}
+	return localStore.StoreCapturedRows(ctx, sd.StreamID, rows)
+}
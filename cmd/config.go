@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/blockchain"
+	"github.com/nikooo777/reflector-s3-cleaner/chainquery"
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/reflector"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var checkConnectivity bool
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "inspect the configuration",
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "check that the configuration (file, environment variables and secret files) is complete and well formed",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return validateConfig(cmd.Context())
+	},
+}
+
+func init() {
+	configValidateCmd.Flags().BoolVar(&checkConnectivity, "connect", false, "also connect to the databases, the S3 bucket and the hubs")
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+func validateConfig(ctx context.Context) error {
+	err := initConfig()
+	if err != nil {
+		return err
+	}
+	problems := configs.Configuration.Validate()
+	for _, p := range problems {
+		logrus.Errorln(p.Error())
+	}
+	if len(problems) > 0 {
+		return errors.Err("the configuration has %d problems", len(problems))
+	}
+	logrus.Infof("%s is valid", configPath)
+	if !checkConnectivity {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cq, err := chainquery.Init()
+	if err == nil {
+		err = cq.Ping(ctx)
+	}
+	if err != nil {
+		return errors.Prefix("chainquery", err)
+	}
+	rf, err := reflector.Init()
+	if err == nil {
+		err = rf.Ping(ctx)
+	}
+	if err != nil {
+		return errors.Prefix("reflector", err)
+	}
+	pruner, err := purger.Init(configs.Configuration.S3, configs.Configuration.Throttling, configs.Configuration.Quarantine)
+	if err == nil {
+		err = pruner.CheckBucket(ctx)
+	}
+	if err != nil {
+		return errors.Prefix("s3", err)
+	}
+	if len(configs.Configuration.Hub.Servers) == 0 {
+		logrus.Infoln("successfully connected to chainquery, reflector and S3")
+		return nil
+	}
+	hub, err := blockchain.Init(configs.Configuration.Hub)
+	if err == nil {
+		err = hub.Ping(ctx)
+		hub.Close()
+	}
+	if err != nil {
+		return errors.Prefix("hub", err)
+	}
+	logrus.Infoln("successfully connected to chainquery, reflector, S3 and the hub")
+	return nil
+}
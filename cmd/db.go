@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var migrateDryRun bool
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "manage the local sqlite store",
+}
+
+var dbMigrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "bring the schema of the local store up to date (every other command does it when opening the store)",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return migrateStore()
+	},
+}
+
+func init() {
+	dbMigrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "only list the migrations that would be applied")
+	dbCmd.AddCommand(dbMigrateCmd)
+	rootCmd.AddCommand(dbCmd)
+}
+
+func migrateStore() error {
+	err := initConfig()
+	if err != nil {
+		return err
+	}
+	localStore, err := sqlite_store.Open(configs.Configuration.SQLitePath)
+	if err != nil {
+		return err
+	}
+	version, err := localStore.Version()
+	if err != nil {
+		return err
+	}
+	pending, err := localStore.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		logrus.Infof("%s is up to date at schema version %d", configs.Configuration.SQLitePath, version)
+		return nil
+	}
+	if migrateDryRun {
+		logrus.Infof("%s is at schema version %d, %d migrations would be applied:", configs.Configuration.SQLitePath, version, len(pending))
+		for _, m := range pending {
+			logrus.Infof("  %d: %s", m.Version, m.Description)
+		}
+		return nil
+	}
+	applied, err := localStore.Migrate()
+	if err != nil {
+		return err
+	}
+	logrus.Infof("migrated %s from schema version %d to %d", configs.Configuration.SQLitePath, version, version+len(applied))
+	return nil
+}
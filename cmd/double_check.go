@@ -0,0 +1,178 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nikooo777/reflector-s3-cleaner/blockchain"
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	doubleCheckWorkers   int
+	doubleCheckBatchSize int
+	recheck              bool
+)
+
+var doubleCheckCmd = &cobra.Command{
+	Use:   "double-check",
+	Short: "check the invalid streams against the hub to make sure they are actually invalid",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStage(cmd.Context(), sqlite_store.StageDoubleCheck, doubleCheck)
+	},
+}
+
+func init() {
+	doubleCheckCmd.Flags().IntVar(&doubleCheckWorkers, "workers", 8, "amount of batches looked up on the hub concurrently")
+	doubleCheckCmd.Flags().IntVar(&doubleCheckBatchSize, "batch-size", 100, "amount of streams looked up on the hub in a single round trip")
+	doubleCheckCmd.Flags().BoolVar(&recheck, "recheck", false, "also check the streams that were already double-checked since they were last resolved")
+	rootCmd.AddCommand(doubleCheckCmd)
+}
+
+// doubleCheckCounts are the outcomes of the double-check per category of invalid streams
+type doubleCheckCounts struct {
+	mu             sync.Mutex
+	confirmed      map[string]int64
+	falseNegatives map[string]int64
+	failed         int64
+}
+
+func (c *doubleCheckCounts) add(counts map[string]int64, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts[reason]++
+}
+
+func doubleCheck(ctx context.Context, localStore *sqlite_store.Store) error {
+	streamData, err := localStore.LoadStreams(ctx, sqlite_store.StreamsInvalid)
+	if err != nil {
+		return err
+	}
+	checked := make(map[int64]bool)
+	if !recheck {
+		checked, err = localStore.LoadDoubleChecked(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	candidates := make([]shared.StreamData, 0)
+	alreadyChecked := 0
+	for _, sd := range streamData {
+		if checked[sd.StreamID] {
+			alreadyChecked++
+			continue
+		}
+		candidates = append(candidates, sd)
+	}
+	logrus.Infof("double checking %d invalid streams against the hub, %d were already checked", len(candidates), alreadyChecked)
+	hub, err := blockchain.Init(configs.Configuration.Hub)
+	if err != nil {
+		return err
+	}
+	defer hub.Close()
+
+	batches := make(chan []shared.StreamData, doubleCheckWorkers)
+	counts := doubleCheckCounts{confirmed: make(map[string]int64), falseNegatives: make(map[string]int64)}
+	var checkedBatches int64
+	totalBatches := (len(candidates) + doubleCheckBatchSize - 1) / doubleCheckBatchSize
+	var wg sync.WaitGroup
+	for w := 0; w < doubleCheckWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				doubleCheckBatch(ctx, hub, localStore, batch, &counts)
+				if n := atomic.AddInt64(&checkedBatches, 1); n%100 == 0 {
+					logrus.Infof("double checked %d/%d batches", n, totalBatches)
+				}
+			}
+		}()
+	}
+
+feeding:
+	for start := 0; start < len(candidates); start += doubleCheckBatchSize {
+		end := start + doubleCheckBatchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		select {
+		case batches <- candidates[start:end]:
+		case <-ctx.Done():
+			break feeding
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	var falseNegatives int64
+	for _, reason := range []string{shared.ReasonNotOnChain, shared.ReasonExpired, shared.ReasonSpent} {
+		falseNegatives += counts.falseNegatives[reason]
+		logrus.Infof("%s: %d confirmed invalid, %d false negatives corrected", reason, counts.confirmed[reason], counts.falseNegatives[reason])
+	}
+	runReport.AddFalseNegatives(falseNegatives)
+	logrus.Printf("%d false negatives corrected, %d streams could not be checked", falseNegatives, counts.failed)
+	if ctx.Err() != nil {
+		return errors.Err("double check was interrupted, run it again to check the remaining streams")
+	}
+	if counts.failed > 0 {
+		return errors.Err("%d streams could not be checked against the hub, run double-check again to retry them", counts.failed)
+	}
+	return nil
+}
+
+// doubleCheckBatch looks up a batch of streams on the hub, unflags the ones it knows about and records the outcome of every lookup.
+// Streams are looked up by claim ID if chainquery returned one, by sd_hash otherwise
+func doubleCheckBatch(ctx context.Context, hub *blockchain.Client, localStore *sqlite_store.Store, batch []shared.StreamData, counts *doubleCheckCounts) {
+	lookups := make([]blockchain.Lookup, len(batch))
+	for i, sd := range batch {
+		lookups[i].SdHash = sd.SdHash
+		if sd.ClaimID != nil {
+			lookups[i].ClaimID = *sd.ClaimID
+		}
+	}
+	results, err := hub.ClaimsExist(ctx, lookups)
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.Warnf("error checking a batch of %d claims: %s", len(batch), err.Error())
+			atomic.AddInt64(&counts.failed, int64(len(batch)))
+		}
+		return
+	}
+	checks := make([]sqlite_store.DoubleCheck, 0, len(batch))
+	for i, result := range results {
+		sd := batch[i]
+		if result.Err != nil {
+			logrus.Warnf("error checking stream %s: %s", sd.SdHash, result.Err.Error())
+			atomic.AddInt64(&counts.failed, 1)
+			continue
+		}
+		reason := sd.InvalidReason()
+		if !result.Exists {
+			counts.add(counts.confirmed, reason)
+			checks = append(checks, sqlite_store.DoubleCheck{StreamID: sd.StreamID, Result: sqlite_store.DoubleCheckConfirmed})
+			continue
+		}
+		logrus.Errorf("claim of %s stream %s actually exists", reason, sd.SdHash)
+		// the corrections are persisted even if the context was cancelled meanwhile
+		err = localStore.UnflagStream(context.Background(), &sd)
+		if err != nil {
+			logrus.Errorf("error unflagging stream: %s", err.Error())
+			atomic.AddInt64(&counts.failed, 1)
+			continue
+		}
+		counts.add(counts.falseNegatives, reason)
+		checks = append(checks, sqlite_store.DoubleCheck{StreamID: sd.StreamID, Result: sqlite_store.DoubleCheckFalseNegative})
+	}
+	err = localStore.RecordDoubleChecks(context.Background(), checks)
+	if err != nil {
+		logrus.Errorf("error recording the double-check of %d streams: %s", len(checks), err.Error())
+	}
+}
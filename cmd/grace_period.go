@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// blockTime is LBRY's target block time, used to convert an age in blocks into a duration
+const blockTime = 150 * time.Second
+
+// invalidAge is a duration that can be expressed in days ("30d") or in blocks ("4320b")
+type invalidAge struct {
+	value string
+	age   time.Duration
+}
+
+func (a *invalidAge) String() string {
+	return a.value
+}
+
+func (a *invalidAge) Set(value string) error {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(value, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(value, "b"):
+		unit = blockTime
+	case value == "0":
+		a.value, a.age = value, 0
+		return nil
+	default:
+		return errors.Err("%s must be a number of days (e.g. 30d) or blocks (e.g. 4320b)", value)
+	}
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 32)
+	if err != nil {
+		return errors.Err("%s must be a number of days (e.g. 30d) or blocks (e.g. 4320b)", value)
+	}
+	a.value, a.age = value, time.Duration(n)*unit
+	return nil
+}
+
+func (a *invalidAge) Type() string {
+	return "age"
+}
+
+var minInvalidAge = invalidAge{value: "0"}
+
+func addGracePeriodFlags(c *cobra.Command) {
+	c.Flags().Var(&minInvalidAge, "min-invalid-age", "only delete the streams whose claim was spent or expired at least this long ago, in days (30d) or blocks (4320b)")
+}
+
+// applyGracePeriod leaves out the streams whose claim became invalid more recently than --min-invalid-age.
+// Streams that were never on chain aren't affected while the spent or expired ones whose invalidation time is unknown are left out
+func applyGracePeriod(streamData []shared.StreamData) []shared.StreamData {
+	if minInvalidAge.age == 0 {
+		return streamData
+	}
+	cutoff := gracePeriodCutoff()
+	eligible := make([]shared.StreamData, 0, len(streamData))
+	var tooRecent, unknown int
+	for _, sd := range streamData {
+		switch {
+		case pastGracePeriod(sd, cutoff):
+			eligible = append(eligible, sd)
+		case sd.InvalidSince == nil:
+			unknown++
+		default:
+			tooRecent++
+		}
+	}
+	logrus.Infof("grace period of %s: %d streams became invalid after %s and are kept", minInvalidAge.value, tooRecent, cutoff.UTC().Format(time.RFC3339))
+	if unknown > 0 {
+		logrus.Warnf("%d spent or expired streams are kept because it's unknown when they became invalid, run resolve again to record it", unknown)
+	}
+	return eligible
+}
+
+func gracePeriodCutoff() time.Time {
+	return time.Now().Add(-minInvalidAge.age)
+}
+
+// pastGracePeriod tells whether applyGracePeriod keeps the stream given the cutoff returned by gracePeriodCutoff
+func pastGracePeriod(sd shared.StreamData, cutoff time.Time) bool {
+	if minInvalidAge.age == 0 || sd.IsValid() || !sd.Exists {
+		return true
+	}
+	return sd.InvalidSince != nil && !sd.InvalidSince.After(cutoff)
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"runtime"
+	"sync"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// sizesBatchSize is the amount of measured sizes written to the store in a single transaction
+const sizesBatchSize = 10000
+
+var listBucket bool
+
+var measureBlobsCmd = &cobra.Command{
+	Use:   "measure-blobs",
+	Short: "fetch the size of the blobs of the invalid streams from S3",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStage(cmd.Context(), sqlite_store.StageMeasureBlobs, measureBlobs)
+	},
+}
+
+func init() {
+	measureBlobsCmd.Flags().BoolVar(&listBucket, "list", false, "list the whole bucket with ListObjectsV2 instead of sending a HeadObject request per blob")
+	rootCmd.AddCommand(measureBlobsCmd)
+}
+
+func measureBlobs(ctx context.Context, localStore *sqlite_store.Store) error {
+	pruner, err := purger.Init(configs.Configuration.S3, configs.Configuration.Throttling, configs.Configuration.Quarantine)
+	if err != nil {
+		return err
+	}
+	// only the invalid streams have blobs in the store
+	streamData, err := localStore.LoadStreams(ctx, sqlite_store.StreamsInvalid)
+	if err != nil {
+		return err
+	}
+	_, err = localStore.LoadBlobs(ctx, streamData)
+	if err != nil {
+		return err
+	}
+	// only the blobs still in S3 that weren't measured by a previous run are looked up
+	unmeasured := make(map[string]bool)
+	for _, sd := range streamData {
+		for blobHash, blobInfo := range sd.StreamBlobs {
+			if blobInfo.SizeBytes == nil && !blobInfo.Deleted {
+				unmeasured[blobHash] = true
+			}
+		}
+	}
+	logrus.Infof("measuring %d blobs", len(unmeasured))
+
+	var measured int64
+	batch := make([]sqlite_store.BlobSize, 0, sizesBatchSize)
+	flush := func() error {
+		// measured sizes are flushed even after the context is cancelled
+		err := localStore.StoreBlobSizes(context.Background(), batch)
+		if err != nil {
+			return err
+		}
+		measured += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+
+	if listBucket {
+		listErr := pruner.ListObjects(ctx, func(o purger.ObjectSize) error {
+			if !unmeasured[o.Key] {
+				return nil
+			}
+			delete(unmeasured, o.Key)
+			batch = append(batch, sqlite_store.BlobSize{BlobHash: o.Key, SizeBytes: o.SizeBytes})
+			if len(batch) == sizesBatchSize {
+				return flush()
+			}
+			return nil
+		})
+		if listErr == nil {
+			// the blobs that weren't listed are not in the bucket
+			for blobHash := range unmeasured {
+				batch = append(batch, sqlite_store.BlobSize{BlobHash: blobHash})
+			}
+		}
+		err = flush()
+		if err != nil {
+			return err
+		}
+		logrus.Infof("measured %d blobs", measured)
+		return listErr
+	}
+
+	keys := make(chan string, 1000)
+	sizes := make(chan purger.ObjectSize, 1000)
+	failures := make(chan purger.Failure, 1000)
+	var wg sync.WaitGroup
+	workers := runtime.NumCPU() * 4
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go pruner.MeasureObjects(ctx, keys, sizes, failures, &wg)
+	}
+	go func() {
+		defer close(keys)
+		for key := range unmeasured {
+			select {
+			case keys <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(sizes)
+		close(failures)
+	}()
+
+	var failed int64
+	var storeErr error
+	for sizes != nil || failures != nil {
+		select {
+		case o, ok := <-sizes:
+			if !ok {
+				sizes = nil
+				continue
+			}
+			batch = append(batch, sqlite_store.BlobSize{BlobHash: o.Key, SizeBytes: o.SizeBytes})
+			if len(batch) == sizesBatchSize && storeErr == nil {
+				storeErr = flush()
+			}
+		case f, ok := <-failures:
+			if !ok {
+				failures = nil
+				continue
+			}
+			failed++
+			logrus.Errorf("failed to measure blob %s: %s", f.Hashes[0], f.Err.Error())
+		}
+	}
+	if storeErr != nil {
+		return storeErr
+	}
+	err = flush()
+	if err != nil {
+		return err
+	}
+	logrus.Infof("measured %d blobs, %d failed", measured, failed)
+	if ctx.Err() != nil {
+		return errors.Err("measuring was interrupted after %d blobs, run measure-blobs again to complete it", measured)
+	}
+	if failed > 0 {
+		return errors.Err("failed to measure %d blobs, run measure-blobs again to retry them", failed)
+	}
+	return nil
+}
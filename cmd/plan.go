@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nikooo777/reflector-s3-cleaner/plan"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dryRun   bool
+	planFile string
+	planID   int64
+)
+
+func addPlanFlags(c *cobra.Command) {
+	c.Flags().BoolVar(&dryRun, "dry-run", false, "don't delete anything, write a deletion plan to review instead")
+	c.Flags().StringVar(&planFile, "plan-file", "", "where to write the deletion plan in dry-run mode (default \"<stage>-plan-<id>.json\")")
+	c.Flags().Int64Var(&planID, "plan", 0, "only delete what is listed in the previously reviewed plan with this ID")
+	c.MarkFlagsMutuallyExclusive("dry-run", "plan")
+}
+
+// createPlan walks the selection logic of the destructive stage and records what it would delete in the store and in a file
+func createPlan(ctx context.Context, localStore *sqlite_store.Store, kind sqlite_store.PlanKind) error {
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = localStore.LoadBlobs(ctx, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyProtections(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyConsensus(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyBlobReferences(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	summarize(streamData)
+	p, err := plan.Build(kind, applyGracePeriod(streamData))
+	if err != nil {
+		return err
+	}
+	runReport.AddBlobsSelected(p.Blobs)
+	err = localStore.StorePlan(p)
+	if err != nil {
+		return err
+	}
+	path := planFile
+	if path == "" {
+		path = fmt.Sprintf("%s-plan-%d.json", kind, p.ID)
+	}
+	err = plan.Save(p, path)
+	if err != nil {
+		return err
+	}
+	if kind == sqlite_store.PlanKindCleanse {
+		// a cleanse removes database rows, it doesn't reclaim any storage
+		logrus.Printf("%s plan %d: %d streams and %d blob rows to remove from the reflector database. Review %s and run \"%s --plan %d\" to execute it",
+			kind, p.ID, p.Streams, p.Blobs, path, kind, p.ID)
+		return nil
+	}
+	logrus.Printf("%s plan %d: %d streams and %d blobs for up to %.1f TB of space. Review %s and run \"%s --plan %d\" to execute it",
+		kind, p.ID, p.Streams, p.Blobs, toTB(p.EstimatedBytes), path, kind, p.ID)
+	return nil
+}
+
+// applyPlan restricts the streams to the ones listed in the plan selected on the command line, if any
+func applyPlan(localStore *sqlite_store.Store, kind sqlite_store.PlanKind, streamData []shared.StreamData) ([]shared.StreamData, error) {
+	if planID == 0 {
+		return streamData, nil
+	}
+	p, err := localStore.LoadPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+	if p.Kind != kind {
+		return nil, errors.Err("plan %d is a %s plan and cannot be executed by %s", p.ID, p.Kind, kind)
+	}
+	restricted := plan.Restrict(p, streamData)
+	logrus.Infof("executing %s plan %d created at %s: %d of %d planned streams are still eligible", p.Kind, p.ID, p.CreatedAt, len(restricted), p.Streams)
+	return restricted, nil
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/protection"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	protectionReason  string
+	protectionOwner   string
+	protectionExpires string
+	listAll           bool
+)
+
+var protectCmd = &cobra.Command{
+	Use:   "protect",
+	Short: "manage the sd_hashes, claim IDs and channels that must never be deleted",
+}
+
+var protectAddCmd = &cobra.Command{
+	Use:   "add <sd_hash|claim_id|channel> <value>",
+	Short: "protect a stream by sd_hash or claim ID, or all the streams of a channel by its claim ID",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kind, err := protection.ParseKind(args[0])
+		if err != nil {
+			return err
+		}
+		p := &protection.Protection{
+			Kind:   kind,
+			Value:  args[1],
+			Reason: protectionReason,
+			Owner:  protectionOwner,
+		}
+		if protectionExpires != "" {
+			expiresAt, err := parseExpiry(protectionExpires)
+			if err != nil {
+				return err
+			}
+			p.ExpiresAt = &expiresAt
+		}
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		err = localStore.AddProtection(cmd.Context(), p)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("added protection %d for %s %s", p.ID, p.Kind, p.Value)
+		return nil
+	},
+}
+
+var protectListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the active protections",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		protections, err := localStore.LoadProtections(cmd.Context())
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = w.Write([]byte("ID\tKIND\tVALUE\tOWNER\tEXPIRES\tREASON\n"))
+		for _, p := range protections {
+			if !listAll && !p.Active(now) {
+				continue
+			}
+			expires := "never"
+			if p.ExpiresAt != nil {
+				expires = p.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			_, _ = w.Write([]byte(strconv.FormatInt(p.ID, 10) + "\t" + string(p.Kind) + "\t" + p.Value + "\t" + p.Owner + "\t" + expires + "\t" + p.Reason + "\n"))
+		}
+		return errors.Err(w.Flush())
+	},
+}
+
+var protectRemoveCmd = &cobra.Command{
+	Use:   "remove <id>",
+	Short: "remove a protection",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return errors.Err("invalid protection ID %s", args[0])
+		}
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		err = localStore.RemoveProtection(cmd.Context(), id)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("removed protection %d", id)
+		return nil
+	},
+}
+
+func init() {
+	protectAddCmd.Flags().StringVar(&protectionReason, "reason", "", "why it must not be deleted")
+	protectAddCmd.Flags().StringVar(&protectionOwner, "owner", "", "who asked for the protection")
+	protectAddCmd.Flags().StringVar(&protectionExpires, "expires", "", "when the protection expires, as a date (2024-12-31), an RFC3339 timestamp or a duration from now (720h). It never expires by default")
+	_ = protectAddCmd.MarkFlagRequired("reason")
+	_ = protectAddCmd.MarkFlagRequired("owner")
+	protectListCmd.Flags().BoolVar(&listAll, "all", false, "also list the expired protections")
+	protectCmd.AddCommand(protectAddCmd, protectListCmd, protectRemoveCmd)
+	rootCmd.AddCommand(protectCmd)
+}
+
+func parseExpiry(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(d).UTC(), nil
+	}
+	return time.Time{}, errors.Err("invalid expiry %s, it must be a date (2024-12-31), an RFC3339 timestamp or a duration (720h)", value)
+}
+
+// applyProtections flags the streams that are protected so that they're skipped by the destructive stages
+func applyProtections(ctx context.Context, localStore *sqlite_store.Store, streamData []shared.StreamData) error {
+	protected, err := markProtected(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	runReport.AddStreamsProtected(protected)
+	if protected > 0 {
+		logrus.Infof("skipping %d invalid streams that are protected", protected)
+	}
+	return nil
+}
+
+// markProtected flags the streams that are protected and returns how many invalid streams it flagged
+func markProtected(ctx context.Context, localStore *sqlite_store.Store, streamData []shared.StreamData) (int64, error) {
+	protections, err := localStore.LoadProtections(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return protection.NewSet(protections).Apply(streamData), nil
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var quarantineCmd = &cobra.Command{
+	Use:   "quarantine",
+	Short: "manage the blobs that were copied to the quarantine before being deleted",
+}
+
+var quarantineExpireCmd = &cobra.Command{
+	Use:   "expire",
+	Short: "permanently delete the quarantined blobs older than the retention period",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		endPhase := runReport.StartPhase("quarantine expire")
+		err = expireQuarantine(cmd.Context(), localStore)
+		endPhase(err)
+		return err
+	},
+}
+
+func init() {
+	quarantineCmd.AddCommand(quarantineExpireCmd)
+	rootCmd.AddCommand(quarantineCmd)
+}
+
+func expireQuarantine(ctx context.Context, localStore *sqlite_store.Store) error {
+	retention := configs.Configuration.Quarantine.Retention()
+	cutoff := time.Now().Add(-retention)
+	blobs, err := localStore.LoadQuarantinedBlobs(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("%d blobs were quarantined more than %s ago", len(blobs), retention)
+	if len(blobs) == 0 {
+		return nil
+	}
+	pruner, err := purger.Init(configs.Configuration.S3, configs.Configuration.Throttling, configs.Configuration.Quarantine)
+	if err != nil {
+		return err
+	}
+
+	// the blobs may have been quarantined in different buckets if the configuration changed
+	keysByBucket := make(map[string][]string)
+	for _, b := range blobs {
+		keysByBucket[b.Location.Bucket] = append(keysByBucket[b.Location.Bucket], b.Location.Key)
+	}
+
+	var expired, failed int64
+	for bucket, keys := range keysByBucket {
+		successes := make(chan string, 10000)
+		failures := make(chan purger.Failure, 10000)
+		wg := sync.WaitGroup{}
+		wg.Add(2)
+		go func(bucket string) {
+			defer wg.Done()
+			for key := range successes {
+				// permanent deletions are always recorded, even after the context is cancelled
+				err := localStore.ExpireQuarantinedBlob(context.Background(), sqlite_store.QuarantineLocation{Bucket: bucket, Key: key})
+				if err != nil {
+					logrus.Errorf("Failed to record the expiry of %s/%s: %s", bucket, key, err.Error())
+					continue
+				}
+				expired++
+			}
+		}(bucket)
+		go func() {
+			defer wg.Done()
+			for f := range failures {
+				failed += int64(len(f.Hashes))
+				runReport.AddS3Failure(f.Hashes, f.Err)
+				logrus.Errorf("Failed to expire %d quarantined blobs: %s", len(f.Hashes), f.Err.Error())
+			}
+		}()
+		pruner.PurgeQuarantined(ctx, bucket, keys, successes, failures)
+		close(successes)
+		close(failures)
+		wg.Wait()
+	}
+	runReport.AddBlobsDeleted(expired)
+	logrus.Infof("expired %d quarantined blobs, %d failed", expired, failed)
+	if ctx.Err() != nil {
+		return errors.Err("expiring the quarantine was interrupted after %d blobs, run it again to complete it", expired)
+	}
+	if failed > 0 {
+		return errors.Err("failed to expire %d quarantined blobs, run it again to retry them", failed)
+	}
+	return nil
+}
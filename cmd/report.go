@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/nikooo777/reflector-s3-cleaner/report"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "print a summary of the resolved streams and blobs in the local store",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		err = localStore.RequireStage(sqlite_store.StageResolve)
+		if err != nil {
+			return err
+		}
+		endPhase := runReport.StartPhase("report")
+		err = printReport(cmd.Context(), localStore)
+		endPhase(err)
+		return err
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reportCmd)
+}
+
+// summarize classifies the streams and records the counts in the run report
+func summarize(streamData []shared.StreamData) report.Counts {
+	counts := report.Counts{Total: int64(len(streamData))}
+	for i, sd := range streamData {
+		if i%500000 == 0 {
+			logrus.Infof("Processed %d/%d streams", i, len(streamData))
+		}
+		switch sd.InvalidReason() {
+		case shared.ReasonNotOnChain:
+			counts.NotOnChain++
+		case shared.ReasonExpired:
+			counts.Expired++
+		case shared.ReasonSpent:
+			counts.Spent++
+		default:
+			counts.Valid++
+		}
+	}
+	runReport.SetCounts(counts)
+	return counts
+}
+
+func logSummary(counts report.Counts) {
+	invalid := counts.NotOnChain + counts.Expired + counts.Spent
+	invalidPercentage := float64(0)
+	if counts.Total > 0 {
+		invalidPercentage = float64(invalid) / float64(counts.Total) * 100
+	}
+	logrus.Printf("%d existing and %d not on the blockchain. %d expired, %d spent for a total of %d invalid streams (%.2f%% of the total)", counts.Valid,
+		counts.NotOnChain, counts.Expired, counts.Spent, invalid, invalidPercentage)
+}
+
+func printReport(ctx context.Context, localStore *sqlite_store.Store) error {
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return err
+	}
+	logSummary(summarize(streamData))
+	err = recordDisagreements(ctx, localStore)
+	if err != nil {
+		return err
+	}
+
+	if localStore.RequireStage(sqlite_store.StageResolveBlobs) != nil {
+		logrus.Infof("blobs have not been resolved yet, run resolve-blobs to see how many blobs can be deleted")
+		return nil
+	}
+	blobs, err := localStore.LoadBlobs(ctx, streamData)
+	if err != nil {
+		return err
+	}
+	runReport.AddBlobsSelected(blobs)
+	bytes, err := recordBytes(ctx, localStore)
+	if err != nil {
+		return err
+	}
+	var selected, reclaimed, unmeasured int64
+	for _, reason := range []string{shared.ReasonNotOnChain, shared.ReasonExpired, shared.ReasonSpent} {
+		b, ok := bytes[reason]
+		if !ok {
+			continue
+		}
+		logrus.Printf("%s: %.3f TB selected, %.3f TB reclaimed, %d blobs not measured", reason, toTB(b.Selected), toTB(b.Reclaimed), b.Unmeasured)
+		selected += b.Selected
+		reclaimed += b.Reclaimed
+		unmeasured += b.Unmeasured
+	}
+	if unmeasured > 0 {
+		logrus.Printf("%d blobs to delete for %.3f TB of measured space plus up to %.1f TB for the %d blobs not measured yet, run measure-blobs to measure them",
+			blobs, toTB(selected), toTB(unmeasured*shared.EstimatedBlobSize), unmeasured)
+	} else {
+		logrus.Printf("%d blobs to delete for %.3f TB of space", blobs, toTB(selected))
+	}
+	logrus.Printf("%.3f TB reclaimed so far", toTB(reclaimed))
+	return nil
+}
+
+// recordBytes records in the run report the storage selected and reclaimed per category of streams
+func recordBytes(ctx context.Context, localStore *sqlite_store.Store) (map[string]report.Bytes, error) {
+	blobBytes, err := localStore.LoadBlobBytes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	bytes := make(map[string]report.Bytes, len(blobBytes))
+	for reason, b := range blobBytes {
+		bytes[reason] = report.Bytes(b)
+	}
+	runReport.SetBytes(bytes)
+	return bytes, nil
+}
+
+func toTB(bytes int64) float64 {
+	return float64(bytes) / 1024 / 1024 / 1024 / 1024
+}
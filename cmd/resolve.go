@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/nikooo777/reflector-s3-cleaner/chainquery"
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/safety"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkExpired bool
+	checkSpent   bool
+)
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve",
+	Short: "resolve the scanned streams against the chainquery database",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStage(cmd.Context(), sqlite_store.StageResolve, resolve)
+	},
+}
+
+func init() {
+	resolveCmd.Flags().BoolVar(&checkExpired, "check-expired", true, "check for streams referenced by an expired claim")
+	resolveCmd.Flags().BoolVar(&checkSpent, "check-spent", true, "check for streams referenced by a spent claim")
+	rootCmd.AddCommand(resolveCmd)
+}
+
+func resolve(ctx context.Context, localStore *sqlite_store.Store) error {
+	cq, err := chainquery.Init()
+	if err != nil {
+		return err
+	}
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return err
+	}
+	resolved, resolveErr := cq.BatchedClaimsExist(ctx, streamData, checkExpired, checkSpent)
+	// only the streams resolved by this run are written back, the batches resolved before an interruption are flushed even if the
+	// context was cancelled
+	err = localStore.UpdateStreams(context.Background(), resolved)
+	if err != nil {
+		return err
+	}
+	if resolveErr != nil {
+		return resolveErr
+	}
+	counts := summarize(streamData)
+	logSummary(counts)
+	// nothing is deleted yet, but a suspicious classification is better noticed early
+	if err := safety.Check(configs.Configuration.Safety, selection(counts, 0, 0)); err != nil {
+		logrus.Warnf("%s: wipe and cleanse will refuse to run unless --override-safety is passed", err.Error())
+	}
+	return nil
+}
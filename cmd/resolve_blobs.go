@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/nikooo777/reflector-s3-cleaner/reflector"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var resolveBlobsCmd = &cobra.Command{
+	Use:   "resolve-blobs",
+	Short: "resolve the blobs of the invalid streams against the reflector database",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStage(cmd.Context(), sqlite_store.StageResolveBlobs, resolveBlobs)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(resolveBlobsCmd)
+}
+
+func resolveBlobs(ctx context.Context, localStore *sqlite_store.Store) error {
+	rf, err := reflector.Init()
+	if err != nil {
+		return err
+	}
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return err
+	}
+	blobsToDeleteCount, resolveErr := rf.GetBlobHashesForStream(ctx, streamData)
+	runReport.AddBlobsSelected(blobsToDeleteCount)
+	// the blobs resolved before an interruption are flushed even if the context was cancelled
+	err = localStore.StoreBlobs(context.Background(), streamData)
+	if err != nil {
+		return err
+	}
+	if resolveErr != nil {
+		logrus.Warnf("blob resolution stopped early, %d blobs were stored", blobsToDeleteCount)
+		return resolveErr
+	}
+	logrus.Infof("Found %d potential blobs to delete", blobsToDeleteCount)
+	return nil
+}
+
+// applyBlobReferences retains the blobs that are also used by streams that aren't deleted along with the stream: valid, protected,
+// unconfirmed streams, the ones still in their grace period and the ones that were never scanned. It must run after the flags
+// making streams not purgeable were applied, on all the streams of the store
+func applyBlobReferences(ctx context.Context, localStore *sqlite_store.Store, streamData []shared.StreamData) error {
+	retained, err := markRetained(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	runReport.AddBlobsRetained(retained)
+	if retained > 0 {
+		logrus.Infof("retaining %d blobs used by streams that are not deleted", retained)
+	}
+	return nil
+}
+
+// markRetained flags the blobs that applyBlobReferences retains and returns how many distinct blobs it flagged
+func markRetained(ctx context.Context, localStore *sqlite_store.Store, streamData []shared.StreamData) (int64, error) {
+	sharedBlobs, err := localStore.LoadSharedBlobs(ctx)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := gracePeriodCutoff()
+	deletable := make(map[int64]bool, len(streamData))
+	for _, sd := range streamData {
+		if !sd.IsValid() && sd.IsPurgeable() && pastGracePeriod(sd, cutoff) {
+			deletable[sd.StreamID] = true
+		}
+	}
+	retained := make(map[string]bool)
+	for i := range streamData {
+		for blobHash, blobInfo := range streamData[i].StreamBlobs {
+			for _, streamID := range sharedBlobs[blobHash] {
+				if !deletable[streamID] {
+					blobInfo.Retained = true
+					streamData[i].StreamBlobs[blobHash] = blobInfo
+					retained[blobHash] = true
+					break
+				}
+			}
+		}
+	}
+	return int64(len(retained)), nil
+}
+
+// refreshBlobReferences records the streams currently using the blobs that are still to be deleted, according to the reflector database,
+// so that a blob a stream started using since it was resolved isn't deleted
+func refreshBlobReferences(ctx context.Context, localStore *sqlite_store.Store, rf *reflector.ReflectorApi, streamData []shared.StreamData) error {
+	hashes := make(map[int64]string)
+	for _, sd := range streamData {
+		if sd.IsValid() || !sd.IsPurgeable() {
+			continue
+		}
+		for blobHash, blobInfo := range sd.StreamBlobs {
+			if !blobInfo.Deleted {
+				hashes[blobInfo.BlobID] = blobHash
+			}
+		}
+	}
+	blobIDs := make([]int64, 0, len(hashes))
+	for id := range hashes {
+		blobIDs = append(blobIDs, id)
+	}
+	logrus.Infof("checking which streams use the %d blobs left to delete", len(blobIDs))
+	references, err := rf.GetBlobReferences(ctx, blobIDs)
+	if err != nil {
+		return err
+	}
+	referencesByHash := make(map[string][]int64, len(references))
+	for id, streamIDs := range references {
+		referencesByHash[hashes[id]] = streamIDs
+	}
+	return localStore.StoreBlobReferences(ctx, referencesByHash)
+}
@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/protection"
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/reflector"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	restoreSdHash  string
+	restoreClaimID string
+	restorePlanID  int64
+	restoreRunID   int64
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "bring deleted streams back from the quarantine and put their rows back in the reflector database",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		selectors := 0
+		for _, name := range []string{"sd-hash", "claim-id", "plan", "run"} {
+			if cmd.Flags().Changed(name) {
+				selectors++
+			}
+		}
+		if selectors != 1 {
+			return errors.Err("select the streams to restore with exactly one of --sd-hash, --claim-id, --plan or --run")
+		}
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		endPhase := runReport.StartPhase("restore")
+		err = restore(cmd.Context(), localStore)
+		endPhase(err)
+		return err
+	},
+}
+
+func init() {
+	restoreCmd.Flags().StringVar(&restoreSdHash, "sd-hash", "", "restore the stream with this sd_hash")
+	restoreCmd.Flags().StringVar(&restoreClaimID, "claim-id", "", "restore the streams of this claim")
+	restoreCmd.Flags().Int64Var(&restorePlanID, "plan", 0, "restore the streams listed in this plan that had blobs deleted or reflector rows captured")
+	restoreCmd.Flags().Int64Var(&restoreRunID, "run", 0, "restore the streams that had blobs quarantined by this run, as listed by the runs command")
+	restoreCmd.Flags().StringVar(&protectionReason, "reason", "", "why the streams are restored, they're protected from further deletions with this reason")
+	restoreCmd.Flags().StringVar(&protectionOwner, "owner", "", "who asked for the restore")
+	_ = restoreCmd.MarkFlagRequired("reason")
+	_ = restoreCmd.MarkFlagRequired("owner")
+	rootCmd.AddCommand(restoreCmd)
+}
+
+func restore(ctx context.Context, localStore *sqlite_store.Store) error {
+	streamData, err := selectRestoreStreams(ctx, localStore)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("restoring %d streams", len(streamData))
+	if len(streamData) == 0 {
+		return nil
+	}
+	pruner, err := purger.Init(configs.Configuration.S3, configs.Configuration.Throttling, configs.Configuration.Quarantine)
+	if err != nil {
+		return err
+	}
+	rf, err := reflector.Init()
+	if err != nil {
+		return err
+	}
+
+	var restored, failed int64
+	for _, sd := range streamData {
+		if ctx.Err() != nil {
+			break
+		}
+		err = restoreStream(ctx, localStore, pruner, rf, sd)
+		if err != nil {
+			failed++
+			logrus.Errorf("failed to restore stream %d (sd_hash %s): %s", sd.StreamID, sd.SdHash, err.Error())
+			continue
+		}
+		restored++
+	}
+	logrus.Infof("restored %d streams, %d failed", restored, failed)
+	if ctx.Err() != nil {
+		return errors.Err("restore was interrupted after %d streams, run it again to complete it", restored)
+	}
+	if failed > 0 {
+		return errors.Err("failed to restore %d streams", failed)
+	}
+	return nil
+}
+
+// selectRestoreStreams returns the streams picked by the selector given on the command line
+func selectRestoreStreams(ctx context.Context, localStore *sqlite_store.Store) ([]shared.StreamData, error) {
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var match func(sd shared.StreamData) bool
+	switch {
+	case restoreSdHash != "":
+		match = func(sd shared.StreamData) bool { return sd.SdHash == restoreSdHash }
+	case restoreClaimID != "":
+		match = func(sd shared.StreamData) bool { return sd.ClaimID != nil && *sd.ClaimID == restoreClaimID }
+	case restorePlanID != 0:
+		p, err := localStore.LoadPlan(restorePlanID)
+		if err != nil {
+			return nil, err
+		}
+		// only the planned streams the plan actually changed are restored, the others must not be protected
+		streamIDs, err := localStore.LoadRestorableStreamIDs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		restorable := make(map[int64]bool, len(streamIDs))
+		for _, id := range streamIDs {
+			restorable[id] = true
+		}
+		planned := make(map[int64]bool, len(p.Items))
+		for _, item := range p.Items {
+			planned[item.StreamID] = restorable[item.StreamID]
+		}
+		match = func(sd shared.StreamData) bool { return planned[sd.StreamID] }
+	case restoreRunID != 0:
+		_, err := localStore.LoadRun(restoreRunID)
+		if err != nil {
+			return nil, err
+		}
+		streamIDs, err := localStore.LoadQuarantinedStreamIDs(ctx, restoreRunID)
+		if err != nil {
+			return nil, err
+		}
+		quarantined := make(map[int64]bool, len(streamIDs))
+		for _, id := range streamIDs {
+			quarantined[id] = true
+		}
+		match = func(sd shared.StreamData) bool { return quarantined[sd.StreamID] }
+	default:
+		return nil, errors.Err("no streams selected")
+	}
+	selected := make([]shared.StreamData, 0)
+	for _, sd := range streamData {
+		if match(sd) {
+			selected = append(selected, sd)
+		}
+	}
+	return selected, nil
+}
+
+// restoreStream copies the deleted blobs of the stream back from the quarantine, re-inserts its reflector rows if it was cleansed,
+// marks it as valid and protects it so that it's not deleted again. Every step can be repeated, so a failed restore can simply be run again
+func restoreStream(ctx context.Context, localStore *sqlite_store.Store, pruner *purger.Purger, rf *reflector.ReflectorApi, sd shared.StreamData) error {
+	deletedBlobs, err := localStore.LoadDeletedBlobs(ctx, sd.StreamID)
+	if err != nil {
+		return err
+	}
+	for _, b := range deletedBlobs {
+		if b.Location == nil {
+			return errors.Err("blob %s was permanently deleted and can't be restored", b.BlobHash)
+		}
+	}
+	for _, b := range deletedBlobs {
+		err = pruner.RestoreObject(ctx, b.Location.Bucket, b.Location.Key, b.BlobHash)
+		if err != nil {
+			return errors.Prefix("restoring blob "+b.BlobHash, err)
+		}
+	}
+
+	capturedRows, err := localStore.LoadCapturedRows(ctx, sd.StreamID)
+	if err != nil {
+		return err
+	}
+	if capturedRows != nil {
+		var captured reflector.StreamRows
+		err = json.Unmarshal(capturedRows, &captured)
+		if err != nil {
+			return errors.Err(err)
+		}
+		err = rf.RestoreStreamRows(ctx, &captured)
+		if err != nil {
+			return err
+		}
+	}
+
+	// from here on the stream is back, the local state is updated even if the restore is interrupted
+	err = localStore.AddProtection(context.Background(), &protection.Protection{
+		Kind:   protection.KindSdHash,
+		Value:  sd.SdHash,
+		Reason: protectionReason,
+		Owner:  protectionOwner,
+	})
+	if err != nil {
+		return err
+	}
+	err = localStore.RestoreStream(context.Background(), sd.StreamID)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("restored stream %d (sd_hash %s): %d blobs, reflector rows restored: %t", sd.StreamID, sd.SdHash, len(deletedBlobs), capturedRows != nil)
+
+	// the quarantined copies are no longer tracked once the stream is restored
+	for _, b := range deletedBlobs {
+		err = pruner.DeleteQuarantined(context.Background(), b.Location.Bucket, b.Location.Key)
+		if err != nil {
+			logrus.Warnf("failed to remove the quarantined copy %s/%s of blob %s, it must be removed by hand: %s", b.Location.Bucket, b.Location.Key, b.BlobHash, err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// initialRetryBackoff is the pause before the first round of retries, it doubles for every following round
+var initialRetryBackoff = 5 * time.Second
+
+// the confirmed deletions are flagged in the local store in batches of up to flagBatchSize blobs, committed at least every flagInterval
+const (
+	flagBatchSize = 1000
+	flagInterval  = time.Second
+)
+
+var (
+	retryRounds int
+	maxAttempts int
+)
+
+// blobPurger deletes the blobs from S3, it's implemented by purger.Purger
+type blobPurger interface {
+	Bucket() string
+	QuarantineLocation(key string) (bucket string, quarantineKey string, ok bool)
+	PurgeStreams(ctx context.Context, streams <-chan shared.StreamData, successes chan<- string, failures chan<- purger.Failure, wg *sync.WaitGroup)
+	PurgeKeys(ctx context.Context, keys []string, successes chan<- string, failures chan<- purger.Failure)
+}
+
+var retryFailuresCmd = &cobra.Command{
+	Use:   "retry-failures",
+	Short: "retry deleting from S3 only the blobs that previous wipes failed to delete",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		endPhase := runReport.StartPhase("retry-failures")
+		err = retryFailures(cmd.Context(), localStore)
+		endPhase(err)
+		return err
+	},
+}
+
+func init() {
+	retryFailuresCmd.Flags().IntVar(&retryRounds, "retry-rounds", 3, "rounds of retries, with an exponential backoff between them")
+	retryFailuresCmd.Flags().IntVar(&maxAttempts, "max-attempts", 0, "skip the blobs that already failed this many times (0 to retry all of them)")
+	rootCmd.AddCommand(retryFailuresCmd)
+}
+
+func retryFailures(ctx context.Context, localStore *sqlite_store.Store) error {
+	pruner, err := purger.Init(configs.Configuration.S3, configs.Configuration.Throttling, configs.Configuration.Quarantine)
+	if err != nil {
+		return err
+	}
+	deleted, retried, err := retryFailedDeletions(ctx, localStore, pruner)
+	if err == nil {
+		// the sd blobs held back by the failures that the retries deleted can go now
+		var sdBlobsDeleted int64
+		sdBlobsDeleted, err = deleteHeldSdBlobs(ctx, localStore, pruner, retried, nil)
+		deleted += sdBlobsDeleted
+	}
+	runReport.AddBlobsDeleted(deleted)
+	if _, bytesErr := recordBytes(context.Background(), localStore); bytesErr != nil {
+		logrus.Errorf("failed to sum the reclaimed storage: %s", bytesErr.Error())
+	}
+	if err != nil {
+		return err
+	}
+	remaining, err := localStore.CountFailedDeletions(ctx)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("deleted %d previously failed blobs, %d still failing", deleted, remaining)
+	if remaining > 0 {
+		return errors.Err("%d blobs could not be deleted, check the failed_deletions table", remaining)
+	}
+	return nil
+}
+
+// deletionResults records the outcome of the S3 deletions: the confirmed ones are flagged in the store and the failed ones are queued to be retried
+type deletionResults struct {
+	successes chan string
+	failures  chan purger.Failure
+	flags     *sqlite_store.FlagWriter
+	failed    int64
+	wg        sync.WaitGroup
+}
+
+func collectResults(localStore *sqlite_store.Store, pruner blobPurger) *deletionResults {
+	r := &deletionResults{
+		successes: make(chan string, 10000),
+		failures:  make(chan purger.Failure, 10000),
+		flags:     localStore.NewFlagWriter(flagBatchSize, flagInterval),
+	}
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+		for s := range r.successes {
+			flag := sqlite_store.BlobFlag{Bucket: pruner.Bucket(), BlobHash: s}
+			if bucket, key, ok := pruner.QuarantineLocation(s); ok {
+				flag.Location = &sqlite_store.QuarantineLocation{Bucket: bucket, Key: key}
+			}
+			r.flags.Flag(flag)
+		}
+	}()
+	go func() {
+		defer r.wg.Done()
+		for f := range r.failures {
+			atomic.AddInt64(&r.failed, int64(len(f.Hashes)))
+			runReport.AddS3Failure(f.Hashes, f.Err)
+			//json pretty print
+			prettier, err := json.Marshal(f.Hashes)
+			if err == nil {
+				logrus.Errorf("Failed to delete blobs %s: %s", string(prettier), f.Err.Error())
+			}
+			err = localStore.RecordFailedDeletions(context.Background(), f.Hashes, f.Err)
+			if err != nil {
+				logrus.Errorf("Failed to queue the failed blobs for retry: %s", err.Error())
+			}
+		}
+	}()
+	return r
+}
+
+// Deleted returns how many confirmed deletions were recorded so far
+func (r *deletionResults) Deleted() int64 {
+	return r.flags.Flagged()
+}
+
+// Failed returns how many deletions failed so far
+func (r *deletionResults) Failed() int64 {
+	return atomic.LoadInt64(&r.failed)
+}
+
+// Close waits for all the results to be recorded. Nothing can be sent on the channels afterwards
+func (r *deletionResults) Close() {
+	close(r.successes)
+	close(r.failures)
+	r.wg.Wait()
+	r.flags.Close()
+}
+
+// retryFailedDeletions re-drives the queued failed deletions for up to retryRounds rounds, backing off exponentially between them.
+// The blobs that wipe wouldn't delete anymore, because their stream was protected, became valid, isn't confirmed or is back in its
+// grace period or because they're now shared with a stream that isn't deleted, are taken out of the queue instead.
+// It returns how many blobs were deleted and the keys that were retried
+func retryFailedDeletions(ctx context.Context, localStore *sqlite_store.Store, pruner blobPurger) (int64, map[string]bool, error) {
+	var deleted int64
+	retried := make(map[string]bool)
+	streams, err := loadDeletableStreams(ctx, localStore)
+	if err != nil {
+		return deleted, retried, err
+	}
+	retryable, held := retryableKeys(streams)
+	backoff := initialRetryBackoff
+	for round := 1; round <= retryRounds; round++ {
+		failed, err := localStore.LoadFailedDeletions(ctx, maxAttempts)
+		if err != nil {
+			return deleted, retried, err
+		}
+		keys := make([]string, 0, len(failed))
+		dropped := make([]string, 0)
+		for _, f := range failed {
+			switch {
+			case retryable[f.BlobHash]:
+				keys = append(keys, f.BlobHash)
+			case !held[f.BlobHash]:
+				dropped = append(dropped, f.BlobHash)
+			}
+		}
+		if len(dropped) > 0 {
+			err = localStore.DropFailedDeletions(ctx, dropped)
+			if err != nil {
+				return deleted, retried, err
+			}
+			logrus.Warnf("dropped %d failed deletions of blobs that are not to be deleted anymore", len(dropped))
+		}
+		if len(keys) == 0 {
+			break
+		}
+		logrus.Infof("retrying %d failed deletions in %s (round %d of %d)", len(keys), backoff, round, retryRounds)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return deleted, retried, errors.Err(ctx.Err())
+		}
+		backoff *= 2
+
+		for _, key := range keys {
+			retried[key] = true
+		}
+		results := collectResults(localStore, pruner)
+		pruner.PurgeKeys(ctx, keys, results.successes, results.failures)
+		results.Close()
+		deleted += results.Deleted()
+		logrus.Infof("round %d: deleted %d blobs, %d failed again", round, results.Deleted(), results.Failed())
+	}
+	return deleted, retried, errors.Err(ctx.Err())
+}
+
+// loadDeletableStreams loads the streams whose blobs wipe would delete with the same checks: protections, consensus, blobs shared with
+// streams that aren't deleted and grace period. Unlike wipe it doesn't refresh the blob references nor report the checks
+func loadDeletableStreams(ctx context.Context, localStore *sqlite_store.Store) ([]shared.StreamData, error) {
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = localStore.LoadBlobs(ctx, streamData)
+	if err != nil {
+		return nil, err
+	}
+	_, err = markProtected(ctx, localStore, streamData)
+	if err != nil {
+		return nil, err
+	}
+	_, err = markUnconfirmed(ctx, localStore, streamData)
+	if err != nil {
+		return nil, err
+	}
+	_, err = markRetained(ctx, localStore, streamData)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := gracePeriodCutoff()
+	deletable := make([]shared.StreamData, 0)
+	for _, sd := range streamData {
+		if !sd.IsValid() && sd.IsPurgeable() && pastGracePeriod(sd, cutoff) {
+			deletable = append(deletable, sd)
+		}
+	}
+	return deletable, nil
+}
+
+// retryableKeys returns the keys of the streams that can be deleted. Like PurgeStreams does, the sd blobs of the streams that still
+// have other blobs to delete are held back: they're returned apart, to stay queued
+func retryableKeys(streams []shared.StreamData) (retryable map[string]bool, held map[string]bool) {
+	retryable, held = make(map[string]bool), make(map[string]bool)
+	for _, sd := range streams {
+		keys := purger.SelectBlobs(sd)
+		for _, key := range keys {
+			retryable[key] = true
+		}
+		if sdKey, deleteSdBlob := purger.SelectSdBlob(sd); deleteSdBlob {
+			if len(keys) > 0 {
+				held[sdKey] = true
+			} else {
+				retryable[sdKey] = true
+			}
+		}
+	}
+	return retryable, held
+}
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"context"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/protection"
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/report"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakePurger records the keys it's asked to delete instead of deleting them from S3. The keys in fail fail to be deleted as many
+// times as their count and, if cancel is set, PurgeStreams calls it and returns without taking any stream
+type fakePurger struct {
+	mu      sync.Mutex
+	deleted []string
+	fail    map[string]int
+	cancel  context.CancelFunc
+}
+
+func (p *fakePurger) Bucket() string {
+	return "bucket"
+}
+
+func (p *fakePurger) QuarantineLocation(key string) (string, string, bool) {
+	return "", "", false
+}
+
+func (p *fakePurger) PurgeStreams(ctx context.Context, streams <-chan shared.StreamData, successes chan<- string, failures chan<- purger.Failure, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if p.cancel != nil {
+		p.cancel()
+		return
+	}
+	for sd := range streams {
+		// like purger.Purger, the sd blob is held back when another blob of the stream fails
+		failed := p.purge(purger.SelectBlobs(sd), successes, failures)
+		if sdKey, deleteSdBlob := purger.SelectSdBlob(sd); deleteSdBlob && failed == 0 {
+			p.purge([]string{sdKey}, successes, failures)
+		}
+	}
+}
+
+func (p *fakePurger) PurgeKeys(ctx context.Context, keys []string, successes chan<- string, failures chan<- purger.Failure) {
+	p.purge(keys, successes, failures)
+}
+
+func (p *fakePurger) purge(keys []string, successes chan<- string, failures chan<- purger.Failure) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failed := make([]string, 0)
+	for _, key := range keys {
+		if p.fail[key] > 0 {
+			p.fail[key]--
+			failed = append(failed, key)
+			continue
+		}
+		p.deleted = append(p.deleted, key)
+		successes <- key
+	}
+	if len(failed) > 0 {
+		failures <- purger.Failure{Hashes: failed, Err: errors.Err("SlowDown")}
+	}
+	return len(failed)
+}
+
+func (p *fakePurger) Deleted() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deleted := append([]string{}, p.deleted...)
+	sort.Strings(deleted)
+	return deleted
+}
+
+func initTestStore(t *testing.T, streams []shared.StreamData) *sqlite_store.Store {
+	store, err := sqlite_store.Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.UpdateStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.TrackSdBlobs(ctx, streams))
+	configs.Configuration = &configs.Configs{}
+	runReport = report.New("test", nil)
+	initialRetryBackoff = 0
+	retryRounds, maxAttempts = 1, 0
+	return store
+}
+
+func TestRetryFailedDeletions(t *testing.T) {
+	// stream 1 can be deleted, 2 is protected and 4 shares a blob with the valid stream 3
+	store := initTestStore(t, []shared.StreamData{
+		{SdHash: "sd1", StreamID: 1, Resolved: true, Exists: true, Spent: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2}}},
+		{SdHash: "sd2", StreamID: 2, Resolved: true, Exists: true, Spent: true, StreamBlobs: map[string]shared.BlobInfo{"c": {BlobID: 3}}},
+		{SdHash: "sd3", StreamID: 3, Resolved: true, Exists: true, StreamBlobs: map[string]shared.BlobInfo{"shared": {BlobID: 4}}},
+		{SdHash: "sd4", StreamID: 4, Resolved: true, Exists: true, Spent: true, StreamBlobs: map[string]shared.BlobInfo{"shared": {BlobID: 4}}},
+	})
+	ctx := context.Background()
+	assert.NoError(t, store.AddProtection(ctx, &protection.Protection{Kind: protection.KindSdHash, Value: "sd2", Reason: "test", Owner: "test"}))
+	assert.NoError(t, store.FlagBlobs(ctx, []sqlite_store.BlobFlag{{Bucket: "bucket", BlobHash: "b"}}))
+	assert.NoError(t, store.RecordFailedDeletions(ctx, []string{"a", "sd1", "c", "shared"}, errors.Err("SlowDown")))
+
+	// the sd blob waits for the other blob of its stream, the blobs that aren't to be deleted anymore are dropped
+	pruner := &fakePurger{}
+	deleted, retried, err := retryFailedDeletions(ctx, store, pruner)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Equal(t, map[string]bool{"a": true}, retried)
+	assert.Equal(t, []string{"a"}, pruner.Deleted())
+	failed, err := store.LoadFailedDeletions(ctx, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, "sd1", failed[0].BlobHash)
+	}
+
+	// then the held sd blob goes
+	deleted, err = deleteHeldSdBlobs(ctx, store, pruner, retried, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Equal(t, []string{"a", "sd1"}, pruner.Deleted())
+	count, err := store.CountFailedDeletions(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
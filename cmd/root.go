@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/meta"
+	"github.com/nikooo777/reflector-s3-cleaner/metrics"
+	"github.com/nikooo777/reflector-s3-cleaner/report"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var (
+	debug       bool
+	configPath  string
+	reportDir   string
+	metricsAddr string
+	runReport   *report.Report
+	// runStore is the store the run is recorded in, nil if the command didn't open it
+	runStore    *sqlite_store.Store
+	stopMetrics = func() {}
+)
+
+var rootCmd = &cobra.Command{
+	Use:     "reflector-s3-cleaner",
+	Short:   "cleanup reflector storage",
+	Version: meta.VersionString(),
+	Long: `cleanup reflector storage
+
+The cleaning happens in stages which must be run in order. Every stage reads its inputs from and writes its outputs to the local SQLite store:
+  scan           load the streams from the reflector database
+  resolve        resolve the streams against the chainquery database
+  double-check   (optional) check the invalid streams against the hub to correct false negatives
+  verify         (optional) record whether a quorum of sources agrees that the invalid streams are invalid
+  resolve-blobs  resolve the blobs of the invalid streams
+  wipe           delete the blobs and sd blobs of the invalid streams from S3
+  cleanse        remove the pruned blobs, sd_blobs and streams from the reflector database
+  report         print a summary of the stored data`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		logrus.SetLevel(logrus.InfoLevel)
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+		flags := make(map[string]string)
+		cmd.Flags().VisitAll(func(f *pflag.Flag) {
+			if f.Name != "help" {
+				flags[f.Name] = f.Value.String()
+			}
+		})
+		runReport = report.New(strings.TrimPrefix(cmd.CommandPath(), cmd.Root().Name()+" "), flags)
+		if metricsAddr != "" {
+			// the metrics outlive the context of the command so that they can be scraped while it shuts down
+			var metricsCtx context.Context
+			metricsCtx, stopMetrics = context.WithCancel(context.Background())
+			metrics.Serve(metricsCtx, metricsAddr)
+		}
+	},
+}
+
+func init() {
+	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "enable debug logging")
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address (e.g. :9090) while running")
+	rootCmd.PersistentFlags().StringVar(&reportDir, "report-dir", "./reports", "where to write the JSON and Markdown report of the run, empty to disable it")
+	rootCmd.PersistentFlags().StringVarP(&configPath, "config", "c", "./config.json", "path of the JSON or YAML configuration file, any field can be overridden with a "+configs.EnvPrefix+"_<SECTION>_<FIELD> environment variable")
+}
+
+// Execute runs the command selected on the command line. SIGINT and SIGTERM cancel the context of the command so that it can drain
+// its in-flight work and persist its results; a second signal terminates the process immediately
+func Execute() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// finished is closed before the deferred stop cancels the context, so a normal exit is never mistaken for an interrupt
+			select {
+			case <-finished:
+				return
+			default:
+			}
+			logrus.Warnln("shutting down gracefully, interrupt again to force quit")
+			stop()
+		case <-finished:
+		}
+	}()
+	err := rootCmd.ExecuteContext(ctx)
+	stopMetrics()
+	if runReport != nil {
+		runReport.Finish(err)
+		if runStore != nil {
+			runErr := runStore.FinishRun(runReport.Counters(), err)
+			if runErr != nil {
+				logrus.Errorf("failed to record the end of the run: %s", runErr.Error())
+			}
+		}
+		if reportDir != "" {
+			_, reportErr := runReport.Write(reportDir)
+			if reportErr != nil {
+				logrus.Errorf("failed to write the run report: %s", reportErr.Error())
+			}
+		}
+	}
+	return err
+}
+
+func initConfig() error {
+	err := configs.Init(configPath)
+	if err != nil {
+		return err
+	}
+	runReport.SetConfig(configs.Configuration.Redacted())
+	return nil
+}
+
+// initStore opens the store and records the run in it, so that the streams and blobs it changes reference it
+func initStore() (*sqlite_store.Store, error) {
+	err := initConfig()
+	if err != nil {
+		return nil, err
+	}
+	localStore, err := sqlite_store.Init(configs.Configuration.SQLitePath)
+	if err != nil {
+		return nil, err
+	}
+	run := &sqlite_store.Run{
+		Command:           runReport.Command,
+		Flags:             runReport.Flags,
+		ConfigFingerprint: configs.Configuration.Fingerprint(),
+		Version:           meta.VersionString(),
+	}
+	err = localStore.StartRun(run)
+	if err != nil {
+		return nil, err
+	}
+	runStore = localStore
+	logrus.Debugf("recording run %d", run.ID)
+	return localStore, nil
+}
+
+// runStage makes sure the inputs of the stage are available and up-to-date, runs it and records its completion in the store
+func runStage(ctx context.Context, stage sqlite_store.Stage, run func(ctx context.Context, localStore *sqlite_store.Store) error) error {
+	localStore, err := prepareStage(stage)
+	if err != nil {
+		return err
+	}
+	endPhase := runReport.StartPhase(string(stage))
+	err = run(ctx, localStore)
+	endPhase(err)
+	if err != nil {
+		if ctx.Err() != nil {
+			logrus.Warnf("stage %s was interrupted and was not marked as completed, run it again to complete it", stage)
+		}
+		return err
+	}
+	logrus.Infof("stage %s completed", stage)
+	return localStore.CompleteStage(stage)
+}
+
+// runDryStage is like runStage but doesn't record the completion of the stage as nothing was changed
+func runDryStage(ctx context.Context, stage sqlite_store.Stage, run func(ctx context.Context, localStore *sqlite_store.Store) error) error {
+	localStore, err := prepareStage(stage)
+	if err != nil {
+		return err
+	}
+	endPhase := runReport.StartPhase(string(stage) + " (dry run)")
+	err = run(ctx, localStore)
+	endPhase(err)
+	return err
+}
+
+func prepareStage(stage sqlite_store.Stage) (*sqlite_store.Store, error) {
+	localStore, err := initStore()
+	if err != nil {
+		return nil, err
+	}
+	err = localStore.CheckStage(stage)
+	if err != nil {
+		return nil, err
+	}
+	logrus.Infof("running stage %s", stage)
+	return localStore, nil
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/spf13/cobra"
+)
+
+var runsLimit int
+
+var runsCmd = &cobra.Command{
+	Use:   "runs",
+	Short: "inspect the history of the runs recorded in the local store",
+}
+
+var runsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list the latest runs",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		runs, err := localStore.LoadRuns(runsLimit)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = w.Write([]byte("ID\tSTARTED\tFINISHED\tCOMMAND\tFLAGS\tVERSION\tCOUNTERS\tERROR\n"))
+		for _, run := range runs {
+			_, _ = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", run.ID, run.StartedAt.UTC().Format(time.RFC3339), finishedAt(run),
+				run.Command, formatFlags(run.Flags), run.Version, string(run.Counters), run.Error)
+		}
+		return errors.Err(w.Flush())
+	},
+}
+
+var runsBlobCmd = &cobra.Command{
+	Use:   "blob <blob-hash>",
+	Short: "tell which run last changed a blob, which one deleted it if it's deleted, and why",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		localStore, err := initStore()
+		if err != nil {
+			return err
+		}
+		provenance, err := localStore.LoadBlobProvenance(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+		state := "is not deleted"
+		if provenance.Deleted {
+			state = "was deleted"
+		}
+		fmt.Printf("blob %s %s, last changed by %s\n", provenance.BlobHash, state, describeRun(localStore, provenance.RunID))
+		for _, p := range provenance.Streams {
+			claimID := "unknown"
+			if p.Stream.ClaimID != nil {
+				claimID = *p.Stream.ClaimID
+			}
+			reason := p.Stream.InvalidReason()
+			if p.Stream.IsValid() {
+				reason = "valid"
+			}
+			fmt.Printf("  used by stream %d (sd_hash %s, claim_id %s): %s, last changed by %s\n", p.Stream.StreamID, p.Stream.SdHash, claimID, reason,
+				describeRun(localStore, p.RunID))
+		}
+		return nil
+	},
+}
+
+func init() {
+	runsListCmd.Flags().IntVar(&runsLimit, "limit", 20, "how many runs to list")
+	runsCmd.AddCommand(runsListCmd, runsBlobCmd)
+	rootCmd.AddCommand(runsCmd)
+}
+
+func finishedAt(run sqlite_store.Run) string {
+	if run.FinishedAt == nil {
+		return "unfinished"
+	}
+	return run.FinishedAt.UTC().Format(time.RFC3339)
+}
+
+func formatFlags(flags map[string]string) string {
+	names := make([]string, 0, len(flags))
+	for name := range flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	formatted := make([]string, 0, len(names))
+	for _, name := range names {
+		formatted = append(formatted, "--"+name+"="+flags[name])
+	}
+	return strings.Join(formatted, " ")
+}
+
+// describeRun summarizes the run with the given ID, which is 0 for the changes made before runs were recorded
+func describeRun(localStore *sqlite_store.Store, runID int64) string {
+	if runID == 0 {
+		return "an unknown run"
+	}
+	run, err := localStore.LoadRun(runID)
+	if err != nil {
+		return fmt.Sprintf("run %d (%s)", runID, err.Error())
+	}
+	return fmt.Sprintf("run %d (%s %s, started at %s, version %s)", run.ID, run.Command, formatFlags(run.Flags), run.StartedAt.UTC().Format(time.RFC3339), run.Version)
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/report"
+	"github.com/nikooo777/reflector-s3-cleaner/safety"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var overrideSafety bool
+
+func addSafetyFlags(c *cobra.Command) {
+	c.Flags().BoolVar(&overrideSafety, "override-safety", false, "delete even if the safety thresholds of the configuration are exceeded")
+}
+
+// checkSafety aborts the destructive stage if what it's about to delete exceeds the safety thresholds, unless they're overridden
+func checkSafety(counts report.Counts, blobs, bytes int64) error {
+	err := safety.Check(configs.Configuration.Safety, selection(counts, blobs, bytes))
+	if err == nil {
+		return nil
+	}
+	if overrideSafety {
+		logrus.Warnf("%s. Proceeding anyway because of --override-safety", err.Error())
+		return nil
+	}
+	return errors.Prefix("refusing to delete anything, make sure chainquery is up to date and pointed at the right database or run again with --override-safety", err)
+}
+
+func selection(counts report.Counts, blobs, bytes int64) safety.Selection {
+	return safety.Selection{
+		Streams:        counts.Total,
+		InvalidStreams: counts.NotOnChain + counts.Expired + counts.Spent,
+		Blobs:          blobs,
+		Bytes:          bytes,
+	}
+}
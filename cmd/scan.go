@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/nikooo777/reflector-s3-cleaner/reflector"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var limit int64
+
+var scanCmd = &cobra.Command{
+	Use:   "scan",
+	Short: "load the streams from the reflector database into the local store",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStage(cmd.Context(), sqlite_store.StageScan, scan)
+	},
+}
+
+func init() {
+	scanCmd.Flags().Int64Var(&limit, "limit", 50000000, "how many streams to check (approx)")
+	rootCmd.AddCommand(scanCmd)
+}
+
+func scan(ctx context.Context, localStore *sqlite_store.Store) error {
+	rf, err := reflector.Init()
+	if err != nil {
+		return err
+	}
+	streamData, scanErr := rf.GetStreams(ctx, limit)
+	// the streams retrieved before an interruption are flushed even if the context was cancelled, a new scan skips them
+	err = localStore.StoreStreams(context.Background(), streamData)
+	if err != nil {
+		return err
+	}
+	if scanErr != nil {
+		logrus.Warnf("scan stopped early, %d streams were stored", len(streamData))
+		return scanErr
+	}
+	logrus.Infof("stored %d streams", len(streamData))
+	return nil
+}
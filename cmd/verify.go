@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nikooo777/reflector-s3-cleaner/blockchain"
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/consensus"
+	"github.com/nikooo777/reflector-s3-cleaner/report"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var (
+	verifyWorkers   int
+	verifyBatchSize int
+	reverify        bool
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "ask every configured source about the invalid streams and record whether they reach the consensus quorum",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runStage(cmd.Context(), sqlite_store.StageVerify, verify)
+	},
+}
+
+func init() {
+	verifyCmd.Flags().IntVar(&verifyWorkers, "workers", 8, "amount of batches verified concurrently")
+	verifyCmd.Flags().IntVar(&verifyBatchSize, "batch-size", 100, "amount of streams sent to the sources at once")
+	verifyCmd.Flags().BoolVar(&reverify, "reverify", false, "also verify the streams that were already verified since they were last resolved")
+	rootCmd.AddCommand(verifyCmd)
+}
+
+// consensusSources returns the configured sources along with a function closing them
+func consensusSources() ([]consensus.Source, func(), error) {
+	sources := []consensus.Source{consensus.Chainquery{}}
+	var clients []*blockchain.Client
+	closeAll := func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}
+	// every hub votes on its own, so each one gets a client without failover
+	for _, address := range configs.Configuration.Hub.Servers {
+		hubConfig := configs.Configuration.Hub
+		hubConfig.Servers = []string{address}
+		client, err := blockchain.Init(hubConfig)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		clients = append(clients, client)
+		sources = append(sources, consensus.Hub{Address: address, Client: client})
+	}
+	if configs.Configuration.Consensus.Lbcd.URL != "" {
+		node := blockchain.InitNode(configs.Configuration.Consensus.Lbcd, configs.Configuration.Hub.RequestTimeout())
+		sources = append(sources, consensus.Node{Node: node})
+	}
+	return sources, closeAll, nil
+}
+
+func verify(ctx context.Context, localStore *sqlite_store.Store) error {
+	quorum := configs.Configuration.Consensus.Quorum
+	if quorum == 0 {
+		return errors.Err("consensus.quorum is not set, set it to the amount of sources that must agree before a stream is deleted")
+	}
+	if quorum < 2 {
+		return errors.Err("consensus.quorum must be at least 2, chainquery always votes invalid for the streams it flagged")
+	}
+	sources, closeSources, err := consensusSources()
+	if err != nil {
+		return err
+	}
+	defer closeSources()
+	if quorum > len(sources) {
+		return errors.Err("consensus.quorum is %d but only %d sources are configured", quorum, len(sources))
+	}
+
+	streamData, err := localStore.LoadStreams(ctx, sqlite_store.StreamsInvalid)
+	if err != nil {
+		return err
+	}
+	verified := make(map[int64]string)
+	if !reverify {
+		verified, err = localStore.LoadConsensus(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	candidates := make([]shared.StreamData, 0)
+	alreadyVerified := 0
+	for _, sd := range streamData {
+		if _, ok := verified[sd.StreamID]; ok {
+			alreadyVerified++
+			continue
+		}
+		candidates = append(candidates, sd)
+	}
+	logrus.Infof("verifying %d invalid streams against %d sources with a quorum of %d, %d were already verified", len(candidates), len(sources), quorum, alreadyVerified)
+
+	batches := make(chan []shared.StreamData, verifyWorkers)
+	var confirmed, unconfirmed, disputed, failed int64
+	var wg sync.WaitGroup
+	for w := 0; w < verifyWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				outcomes := consensus.Verify(ctx, quorum, sources, batch)
+				if ctx.Err() != nil {
+					// the ballots of interrupted lookups are abstentions that must not be recorded
+					return
+				}
+				verifications := make([]sqlite_store.Verification, len(batch))
+				for i, o := range outcomes {
+					verifications[i] = sqlite_store.Verification{StreamID: batch[i].StreamID, Outcome: o}
+				}
+				err := localStore.RecordVerifications(context.Background(), verifications)
+				if err != nil {
+					logrus.Errorf("error recording the verification of %d streams: %s", len(batch), err.Error())
+					atomic.AddInt64(&failed, int64(len(batch)))
+					continue
+				}
+				for _, o := range outcomes {
+					if o.Consensus == consensus.Confirmed {
+						atomic.AddInt64(&confirmed, 1)
+					} else {
+						atomic.AddInt64(&unconfirmed, 1)
+					}
+					if o.Disputed {
+						atomic.AddInt64(&disputed, 1)
+					}
+				}
+			}
+		}()
+	}
+
+feeding:
+	for start := 0; start < len(candidates); start += verifyBatchSize {
+		end := start + verifyBatchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		select {
+		case batches <- candidates[start:end]:
+		case <-ctx.Done():
+			break feeding
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	logrus.Infof("%d streams confirmed as invalid, %d unconfirmed, %d disputed by at least one source", confirmed, unconfirmed, disputed)
+	err = recordDisagreements(context.Background(), localStore)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return errors.Err("verify was interrupted, run it again to verify the remaining streams")
+	}
+	if failed > 0 {
+		return errors.Err("failed to record the verification of %d streams", failed)
+	}
+	return nil
+}
+
+// recordDisagreements adds the streams the sources disagree about to the run report
+func recordDisagreements(ctx context.Context, localStore *sqlite_store.Store) error {
+	disagreements, err := localStore.LoadDisagreements(ctx)
+	if err != nil {
+		return err
+	}
+	reported := make([]report.Disagreement, 0, len(disagreements))
+	for _, d := range disagreements {
+		reported = append(reported, report.Disagreement{SdHash: d.SdHash, ClaimID: d.ClaimID, Consensus: d.Consensus, Votes: d.Votes})
+	}
+	runReport.SetDisagreements(reported)
+	if len(disagreements) > 0 {
+		logrus.Warnf("the sources disagree about %d streams, review them in the run report", len(disagreements))
+	}
+	return nil
+}
+
+// applyConsensus holds back the invalid streams that didn't reach the consensus quorum, when one is configured
+func applyConsensus(ctx context.Context, localStore *sqlite_store.Store, streamData []shared.StreamData) error {
+	held, err := markUnconfirmed(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	runReport.AddStreamsUnconfirmed(held)
+	if held > 0 {
+		logrus.Warnf("skipping %d invalid streams that weren't confirmed by a quorum of %d sources, run verify to verify them", held, configs.Configuration.Consensus.Quorum)
+	}
+	return nil
+}
+
+// markUnconfirmed flags the purgeable streams that didn't reach the consensus quorum and returns how many it flagged
+func markUnconfirmed(ctx context.Context, localStore *sqlite_store.Store, streamData []shared.StreamData) (int64, error) {
+	if configs.Configuration.Consensus.Quorum == 0 {
+		return 0, nil
+	}
+	verdicts, err := localStore.LoadConsensus(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var held int64
+	for i := range streamData {
+		sd := &streamData[i]
+		if !sd.IsPurgeable() || verdicts[sd.StreamID] == consensus.Confirmed {
+			continue
+		}
+		sd.Unconfirmed = true
+		held++
+	}
+	return held, nil
+}
@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/reflector"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var wipeCmd = &cobra.Command{
+	Use:   "wipe",
+	Short: "delete the blobs of the invalid streams from S3 and flag them as deleted in the local store",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if dryRun {
+			return runDryStage(cmd.Context(), sqlite_store.StageWipe, func(ctx context.Context, localStore *sqlite_store.Store) error {
+				return createPlan(ctx, localStore, sqlite_store.PlanKindWipe)
+			})
+		}
+		return runStage(cmd.Context(), sqlite_store.StageWipe, wipe)
+	},
+}
+
+func init() {
+	addPlanFlags(wipeCmd)
+	addSafetyFlags(wipeCmd)
+	addGracePeriodFlags(wipeCmd)
+	wipeCmd.Flags().IntVar(&retryRounds, "retry-rounds", 3, "rounds of retries of the failed deletions at the end of the wipe, with an exponential backoff between them")
+	rootCmd.AddCommand(wipeCmd)
+}
+
+func wipe(ctx context.Context, localStore *sqlite_store.Store) error {
+	pruner, err := purger.Init(configs.Configuration.S3, configs.Configuration.Throttling, configs.Configuration.Quarantine)
+	if err != nil {
+		return err
+	}
+	rf, err := reflector.Init()
+	if err != nil {
+		return err
+	}
+	streamData, err := localStore.LoadStreamData(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = localStore.LoadBlobs(ctx, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyProtections(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyConsensus(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	// the blobs are deleted from S3 for good, so who uses them is checked again right before
+	err = refreshBlobReferences(ctx, localStore, rf, streamData)
+	if err != nil {
+		return err
+	}
+	err = applyBlobReferences(ctx, localStore, streamData)
+	if err != nil {
+		return err
+	}
+	// the streams are classified before the plan restricts them so that the safety checks see all of them
+	counts := summarize(streamData)
+	streamData, err = applyPlan(localStore, sqlite_store.PlanKindWipe, streamData)
+	if err != nil {
+		return err
+	}
+	streamData = applyGracePeriod(streamData)
+
+	// only queue the streams that still have blobs to delete so that a resumed wipe picks up where it stopped.
+	// The sd blobs are counted as blobs but their size is negligible
+	pendingStreams := make([]shared.StreamData, 0)
+	var blobsTotal, blobsRemaining, bytesRemaining int64
+	for _, sd := range streamData {
+		if sd.IsValid() || !sd.IsPurgeable() {
+			continue
+		}
+		blobsTotal += int64(len(sd.StreamBlobs)) + 1
+		keys := purger.SelectBlobs(sd)
+		_, deleteSdBlob := purger.SelectSdBlob(sd)
+		if len(keys) > 0 || deleteSdBlob {
+			blobsRemaining += int64(len(keys))
+			for _, key := range keys {
+				bytesRemaining += sd.StreamBlobs[key].Size()
+			}
+			if deleteSdBlob {
+				blobsRemaining++
+			}
+			pendingStreams = append(pendingStreams, sd)
+		}
+	}
+	runReport.AddBlobsSelected(blobsRemaining)
+	err = checkSafety(counts, blobsRemaining, bytesRemaining)
+	if err != nil {
+		return err
+	}
+	err = localStore.TrackSdBlobs(ctx, pendingStreams)
+	if err != nil {
+		return err
+	}
+	run, resumed, err := localStore.StartWipeRun(planID, blobsTotal, blobsRemaining)
+	if err != nil {
+		return err
+	}
+	if resumed {
+		logrus.Infof("resuming wipe run %d started at %s: %d of %d blobs remain to be deleted", run.ID, run.StartedAt, blobsRemaining, blobsTotal)
+	} else {
+		logrus.Infof("starting wipe run %d: %d of %d blobs remain to be deleted", run.ID, blobsRemaining, blobsTotal)
+	}
+
+	return purgePending(ctx, localStore, pruner, run, pendingStreams, blobsRemaining)
+}
+
+// purgePending deletes the blobs of the pending streams of the run, retries the failed deletions and checkpoints the progress of the run,
+// which is only finished if the context wasn't cancelled
+func purgePending(ctx context.Context, localStore *sqlite_store.Store, pruner blobPurger, run *sqlite_store.WipeRun, pendingStreams []shared.StreamData, blobsRemaining int64) error {
+	results := collectResults(localStore, pruner)
+
+	// Create channel for StreamData and start a goroutine to send all StreamData onto the channel
+	streamDataChan := make(chan shared.StreamData, 64)
+
+	var wg sync.WaitGroup
+	maxThreads := runtime.NumCPU() * 4
+	wg.Add(maxThreads)
+
+	// fed is how many of the pending streams were sent to PurgeStreams
+	fed := 0
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(streamDataChan)
+		for i, sd := range pendingStreams {
+			if i%5000 == 0 {
+				logrus.Infof("Queued %d/%d streams for pruning", i, len(pendingStreams))
+			}
+			select {
+			case streamDataChan <- sd:
+				fed++
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Start the PurgeStreams function in separate goroutines
+	for i := 0; i < maxThreads; i++ {
+		go pruner.PurgeStreams(ctx, streamDataChan, results.successes, results.failures, &wg)
+	}
+
+	// periodically persist the progress of the run
+	previouslyDeleted := run.BlobsDeleted
+	var retried int64
+	checkpoint := func() {
+		deleted := results.Deleted() + atomic.LoadInt64(&retried)
+		run.BlobsDeleted = previouslyDeleted + deleted
+		run.BlobsFailed = results.Failed()
+		run.BlobsRemaining = blobsRemaining - deleted
+		err := localStore.CheckpointWipeRun(run)
+		if err != nil {
+			logrus.Errorf("Failed to checkpoint wipe run %d: %s", run.ID, err.Error())
+		}
+	}
+	stopCheckpoints := make(chan struct{})
+	checkpointsWg := sync.WaitGroup{}
+	checkpointsWg.Add(1)
+	go func() {
+		defer checkpointsWg.Done()
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				checkpoint()
+			case <-stopCheckpoints:
+				return
+			}
+		}
+	}()
+
+	// Wait for the PurgeStreams function to finish
+	wg.Wait()
+	results.Close()
+
+	// once the context is cancelled PurgeStreams leaves the streams still buffered in the channel, so the run is interrupted even if
+	// all of them were fed. Otherwise every stream fed was processed
+	interrupted := ctx.Err() != nil
+
+	// failures are retried within the run unless it was interrupted, what still fails is left for retry-failures
+	if !interrupted && results.Failed() > 0 {
+		deleted, retriedKeys, err := retryFailedDeletions(ctx, localStore, pruner)
+		if err == nil && ctx.Err() == nil {
+			// the sd blobs held back by the failures that the retries deleted can go now, only for the streams this run processed
+			processed := make(map[int64]bool, fed)
+			for _, sd := range pendingStreams[:fed] {
+				if _, deleteSdBlob := purger.SelectSdBlob(sd); deleteSdBlob {
+					processed[sd.StreamID] = true
+				}
+			}
+			var sdBlobsDeleted int64
+			sdBlobsDeleted, err = deleteHeldSdBlobs(ctx, localStore, pruner, retriedKeys, processed)
+			deleted += sdBlobsDeleted
+		}
+		atomic.StoreInt64(&retried, deleted)
+		if err != nil {
+			logrus.Errorf("retrying the failed deletions stopped: %s", err.Error())
+		}
+		interrupted = ctx.Err() != nil
+	}
+	close(stopCheckpoints)
+	checkpointsWg.Wait()
+
+	checkpoint()
+	stillFailing, err := localStore.CountFailedDeletions(context.Background())
+	if err != nil {
+		return err
+	}
+	run.BlobsFailed = stillFailing
+	deleted := results.Deleted() + retried
+	runReport.AddBlobsDeleted(deleted)
+	if _, bytesErr := recordBytes(context.Background(), localStore); bytesErr != nil {
+		logrus.Errorf("failed to sum the reclaimed storage: %s", bytesErr.Error())
+	}
+	logrus.Infof("wipe run %d: deleted %d blobs, %d failed, %d remain", run.ID, deleted, run.BlobsFailed, run.BlobsRemaining)
+	if interrupted {
+		err = localStore.CheckpointWipeRun(run)
+		if err != nil {
+			return err
+		}
+		return errors.Err("wipe run %d was interrupted with %d blobs left to delete, run wipe again to resume it", run.ID, run.BlobsRemaining)
+	}
+	if stillFailing > 0 {
+		logrus.Warnf("%d blobs could not be deleted, run retry-failures to retry them", stillFailing)
+	}
+	return localStore.FinishWipeRun(run)
+}
+
+// deleteHeldSdBlobs deletes the sd blobs that PurgeStreams held back because some blobs of their stream failed to be deleted, once
+// the retries deleted these blobs and no other blob of the stream is left. The streams are checked against their current state, when
+// streams isn't nil only the ones it contains are considered. It returns how many sd blobs were deleted
+func deleteHeldSdBlobs(ctx context.Context, localStore *sqlite_store.Store, pruner blobPurger, retried map[string]bool, streams map[int64]bool) (int64, error) {
+	deletable, err := loadDeletableStreams(ctx, localStore)
+	if err != nil {
+		return 0, err
+	}
+	sdKeys := make([]string, 0)
+	for _, sd := range deletable {
+		if streams != nil && !streams[sd.StreamID] {
+			continue
+		}
+		sdKey, deleteSdBlob := purger.SelectSdBlob(sd)
+		if !deleteSdBlob || retried[sdKey] || len(purger.SelectBlobs(sd)) > 0 {
+			continue
+		}
+		for blobHash, blobInfo := range sd.StreamBlobs {
+			if !blobInfo.Retained && retried[blobHash] {
+				sdKeys = append(sdKeys, sdKey)
+				break
+			}
+		}
+	}
+	if len(sdKeys) == 0 {
+		return 0, nil
+	}
+	logrus.Infof("deleting %d sd blobs whose other blobs were deleted by the retries", len(sdKeys))
+	results := collectResults(localStore, pruner)
+	pruner.PurgeKeys(ctx, sdKeys, results.successes, results.failures)
+	results.Close()
+	return results.Deleted(), errors.Err(ctx.Err())
+}
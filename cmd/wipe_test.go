@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var wipeTestStreams = []shared.StreamData{
+	{SdHash: "sd1", StreamID: 1, Resolved: true, Exists: true, Spent: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2}}},
+	{SdHash: "sd2", StreamID: 2, Resolved: true, Exists: true, Spent: true, StreamBlobs: map[string]shared.BlobInfo{"c": {BlobID: 3}}},
+}
+
+func TestPurgePending(t *testing.T) {
+	store := initTestStore(t, wipeTestStreams)
+	ctx := context.Background()
+	run, _, err := store.StartWipeRun(0, 5, 5)
+	assert.NoError(t, err)
+
+	// a fails once, so the sd blob of its stream is only deleted after the retry
+	pruner := &fakePurger{fail: map[string]int{"a": 1}}
+	assert.NoError(t, purgePending(ctx, store, pruner, run, wipeTestStreams, 5))
+	assert.Equal(t, []string{"a", "b", "c", "sd1", "sd2"}, pruner.Deleted())
+
+	run, err = store.LoadWipeRun(run.ID)
+	assert.NoError(t, err)
+	assert.NotNil(t, run.FinishedAt)
+	assert.Equal(t, int64(5), run.BlobsDeleted)
+	assert.Equal(t, int64(0), run.BlobsRemaining)
+	assert.Equal(t, int64(0), run.BlobsFailed)
+}
+
+func TestPurgePendingCancelled(t *testing.T) {
+	store := initTestStore(t, wipeTestStreams)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run, _, err := store.StartWipeRun(0, 5, 5)
+	assert.NoError(t, err)
+
+	// the streams all fit in the channel but are never taken, so the run isn't finished
+	pruner := &fakePurger{cancel: cancel}
+	assert.Error(t, purgePending(ctx, store, pruner, run, wipeTestStreams, 5))
+	assert.Empty(t, pruner.Deleted())
+
+	run, err = store.LoadWipeRun(run.ID)
+	assert.NoError(t, err)
+	assert.Nil(t, run.FinishedAt)
+	assert.Equal(t, int64(5), run.BlobsRemaining)
+}
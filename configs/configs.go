@@ -1,27 +1,128 @@
 package configs
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
-	"github.com/tkanos/gonfig"
 )
 
 type DbConfig struct {
-	Host     string `json:"host"`
-	User     string `json:"user"`
-	Database string `json:"database"`
-	Password string `json:"password"`
+	Host         string `json:"host"`
+	User         string `json:"user"`
+	Database     string `json:"database"`
+	Password     string `json:"password"`
+	PasswordFile string `json:"password_file"`
 }
 type AWSS3Config struct {
-	AccessKey string `json:"access_key"`
-	SecretKey string `json:"secret_key"`
-	Bucket    string `json:"bucket"`
-	Region    string `json:"region"`
-	Endpoint  string `json:"endpoint"`
+	AccessKey     string `json:"access_key"`
+	AccessKeyFile string `json:"access_key_file"`
+	SecretKey     string `json:"secret_key"`
+	SecretKeyFile string `json:"secret_key_file"`
+	Bucket        string `json:"bucket"`
+	Region        string `json:"region"`
+	Endpoint      string `json:"endpoint"`
+}
+
+// ThrottlingConfig limits the rate of the destructive requests. A rate of 0 means unlimited
+type ThrottlingConfig struct {
+	S3RequestsPerSecond   float64 `json:"s3_requests_per_second"`
+	S3KeysPerSecond       float64 `json:"s3_keys_per_second"`
+	MySQLDeletesPerSecond float64 `json:"mysql_deletes_per_second"`
+	MaxBackoffSeconds     int     `json:"max_backoff_seconds"`
+	MaxRetries            int     `json:"max_retries"`
+}
+
+// SafetyConfig holds the thresholds the destructive stages refuse to exceed. A threshold of 0 disables the check
+type SafetyConfig struct {
+	MaxInvalidPercent float64 `json:"max_invalid_percent"`
+	MaxBlobsPerRun    int64   `json:"max_blobs_per_run"`
+	MaxBytesPerRun    int64   `json:"max_bytes_per_run"`
+}
+
+// QuarantineConfig makes the destructive stages copy the objects to a quarantine bucket or prefix before deleting them
+type QuarantineConfig struct {
+	Enabled bool `json:"enabled"`
+	// Bucket defaults to the bucket of the blobs, in which case Prefix is required
+	Bucket        string `json:"bucket"`
+	Prefix        string `json:"prefix"`
+	StorageClass  string `json:"storage_class"`
+	RetentionDays int    `json:"retention_days"`
+}
+
+// HubConfig lists the hubs the streams are double-checked against, as host:port addresses: the port is required, usually 50001 or 50002 with TLS.
+// Requests are spread over the healthy servers in turn and fail over to the next one. Settings left to 0 take their default value
+type HubConfig struct {
+	Servers                    []string `json:"servers"`
+	TLS                        bool     `json:"tls"`
+	TLSSkipVerify              bool     `json:"tls_skip_verify"`
+	ConnectionsPerServer       int      `json:"connections_per_server"`
+	DialTimeoutSeconds         int      `json:"dial_timeout_seconds"`
+	RequestTimeoutSeconds      int      `json:"request_timeout_seconds"`
+	HealthCheckIntervalSeconds int      `json:"health_check_interval_seconds"`
+}
+
+// LbcdConfig is a local lbcd node queried over JSON-RPC, e.g. https://127.0.0.1:9245
+type LbcdConfig struct {
+	URL           string `json:"url"`
+	User          string `json:"user"`
+	Password      string `json:"password"`
+	PasswordFile  string `json:"password_file"`
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+}
+
+// ConsensusConfig makes the destructive stages delete only the streams that at least Quorum independent sources agree are invalid.
+// The sources are chainquery, every hub of the hub section and the lbcd node if set. A quorum of 0 disables it, otherwise it must be at
+// least 2 as chainquery always votes invalid for the streams it flagged
+type ConsensusConfig struct {
+	Quorum int        `json:"quorum"`
+	Lbcd   LbcdConfig `json:"lbcd"`
 }
 type Configs struct {
-	Chainquery DbConfig    `json:"chainquery"`
-	Reflector  DbConfig    `json:"reflector"`
-	S3         AWSS3Config `json:"s3"`
+	Chainquery DbConfig         `json:"chainquery"`
+	Reflector  DbConfig         `json:"reflector"`
+	S3         AWSS3Config      `json:"s3"`
+	SQLitePath string           `json:"sqlite_path"`
+	Throttling ThrottlingConfig `json:"throttling"`
+	Safety     SafetyConfig     `json:"safety"`
+	Quarantine QuarantineConfig `json:"quarantine"`
+	Hub        HubConfig        `json:"hub"`
+	Consensus  ConsensusConfig  `json:"consensus"`
+}
+
+// EnvPrefix prefixes the environment variables that override the configuration, e.g. CLEANER_S3_SECRET_KEY or CLEANER_REFLECTOR_PASSWORD_FILE
+const EnvPrefix = "CLEANER"
+
+const DefaultSQLitePath = "./cleaner.sqlite"
+
+var DefaultThrottling = ThrottlingConfig{
+	MaxBackoffSeconds: 60,
+	MaxRetries:        5,
+}
+
+var DefaultSafety = SafetyConfig{
+	MaxInvalidPercent: 50,
+}
+
+var DefaultQuarantine = QuarantineConfig{
+	Prefix:        "quarantine/",
+	RetentionDays: 30,
+}
+
+var DefaultHub = HubConfig{
+	ConnectionsPerServer:       4,
+	DialTimeoutSeconds:         5,
+	RequestTimeoutSeconds:      30,
+	HealthCheckIntervalSeconds: 30,
 }
 
 var Configuration *Configs
@@ -30,11 +131,353 @@ func Init(configPath string) error {
 	if Configuration != nil {
 		return nil
 	}
-	c := Configs{}
-	err := gonfig.GetConf(configPath, &c)
+	c, err := Load(configPath)
 	if err != nil {
-		return errors.Err(err)
+		return err
 	}
-	Configuration = &c
+	Configuration = c
 	return nil
 }
+
+// Load reads the configuration in layers: the JSON or YAML file first, then the environment variables overriding any of its fields
+// and lastly the secrets read from the files referenced by the *_file fields
+func Load(configPath string) (*Configs, error) {
+	c := &Configs{
+		SQLitePath: DefaultSQLitePath,
+		Throttling: DefaultThrottling,
+		Safety:     DefaultSafety,
+		Quarantine: DefaultQuarantine,
+		Hub:        DefaultHub,
+	}
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	// JSON is a subset of YAML so both are parsed the same way
+	err = yaml.Unmarshal(content, c)
+	if err != nil {
+		return nil, errors.Prefix(configPath, err)
+	}
+	err = applyEnv(reflect.ValueOf(c).Elem(), EnvPrefix)
+	if err != nil {
+		return nil, err
+	}
+	err = c.resolveSecretFiles()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// applyEnv overrides every field of the struct with the environment variable named after its path of json tags
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			err := applyEnv(fv, name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		err := setValue(fv, value)
+		if err != nil {
+			return errors.Prefix(name, err)
+		}
+	}
+	return nil
+}
+
+func setValue(fv reflect.Value, value string) error {
+	if fv.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.Err(err)
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Err(err)
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return errors.Err(err)
+		}
+		fv.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return errors.Err(err)
+		}
+		fv.SetFloat(f)
+	case reflect.Slice:
+		// slices are set from comma separated values
+		parts := strings.Split(value, ",")
+		slice := reflect.MakeSlice(fv.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			err := setValue(slice.Index(i), strings.TrimSpace(part))
+			if err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+	default:
+		return errors.Err("unsupported type %s", fv.Type())
+	}
+	return nil
+}
+
+func (c *Configs) resolveSecretFiles() error {
+	secrets := []struct {
+		name  string
+		value *string
+		file  string
+	}{
+		{"chainquery.password", &c.Chainquery.Password, c.Chainquery.PasswordFile},
+		{"reflector.password", &c.Reflector.Password, c.Reflector.PasswordFile},
+		{"s3.access_key", &c.S3.AccessKey, c.S3.AccessKeyFile},
+		{"s3.secret_key", &c.S3.SecretKey, c.S3.SecretKeyFile},
+		{"consensus.lbcd.password", &c.Consensus.Lbcd.Password, c.Consensus.Lbcd.PasswordFile},
+	}
+	for _, s := range secrets {
+		if s.file == "" {
+			continue
+		}
+		if *s.value != "" {
+			return errors.Err("only one of %s and %s_file can be set", s.name, s.name)
+		}
+		content, err := os.ReadFile(s.file)
+		if err != nil {
+			return errors.Prefix(s.name+"_file", err)
+		}
+		*s.value = strings.TrimRight(string(content), "\r\n")
+	}
+	return nil
+}
+
+// Redacted returns a copy of the configuration with the secrets masked so that it can be logged or reported
+func (c Configs) Redacted() Configs {
+	mask := func(secret string) string {
+		if secret == "" {
+			return ""
+		}
+		return "[redacted]"
+	}
+	c.Chainquery.Password = mask(c.Chainquery.Password)
+	c.Reflector.Password = mask(c.Reflector.Password)
+	c.S3.AccessKey = mask(c.S3.AccessKey)
+	c.S3.SecretKey = mask(c.S3.SecretKey)
+	c.Consensus.Lbcd.Password = mask(c.Consensus.Lbcd.Password)
+	return c
+}
+
+// Fingerprint identifies the configuration without revealing its secrets, so that runs made with different settings can be told apart
+func (c Configs) Fingerprint() string {
+	content, err := json.Marshal(c.Redacted())
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// ConsensusSources returns how many sources can take part in the consensus
+func (c *Configs) ConsensusSources() int {
+	sources := 1 + len(c.Hub.Servers)
+	if c.Consensus.Lbcd.URL != "" {
+		sources++
+	}
+	return sources
+}
+
+// Validate checks that the required fields are set and that addresses are well formed. It doesn't connect to anything
+func (c *Configs) Validate() []error {
+	var problems []error
+	problems = append(problems, c.Chainquery.validate("chainquery")...)
+	problems = append(problems, c.Reflector.validate("reflector")...)
+	problems = append(problems, c.S3.validate()...)
+	if c.SQLitePath == "" {
+		problems = append(problems, errors.Err("sqlite_path is required"))
+	}
+	problems = append(problems, c.Throttling.validate()...)
+	problems = append(problems, c.Safety.validate()...)
+	problems = append(problems, c.Quarantine.validate(c.S3.Bucket)...)
+	problems = append(problems, c.Hub.validate()...)
+	if c.Consensus.Quorum < 0 {
+		problems = append(problems, errors.Err("consensus.quorum cannot be negative"))
+	} else if c.Consensus.Quorum == 1 {
+		problems = append(problems, errors.Err("consensus.quorum must be 0 to disable it or at least 2, chainquery always votes invalid for the streams it flagged"))
+	} else if c.Consensus.Quorum > c.ConsensusSources() {
+		problems = append(problems, errors.Err("consensus.quorum is %d but only %d sources are configured", c.Consensus.Quorum, c.ConsensusSources()))
+	}
+	if c.Consensus.Lbcd.URL != "" {
+		u, err := url.Parse(c.Consensus.Lbcd.URL)
+		if err != nil {
+			problems = append(problems, errors.Err("consensus.lbcd.url: %s", err.Error()))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, errors.Err("consensus.lbcd.url: %s is not an http(s) URL", c.Consensus.Lbcd.URL))
+		}
+	}
+	return problems
+}
+
+func (d DbConfig) validate(name string) []error {
+	var problems []error
+	required := []struct{ field, value string }{{"host", d.Host}, {"user", d.User}, {"database", d.Database}}
+	for _, r := range required {
+		if r.value == "" {
+			problems = append(problems, errors.Err("%s.%s is required", name, r.field))
+		}
+	}
+	if strings.Contains(d.Host, ":") {
+		_, port, err := net.SplitHostPort(d.Host)
+		if err != nil {
+			problems = append(problems, errors.Err("%s.host: %s", name, err.Error()))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems = append(problems, errors.Err("%s.host: invalid port %s", name, port))
+		}
+	}
+	return problems
+}
+
+func (s AWSS3Config) validate() []error {
+	var problems []error
+	required := []struct{ field, value string }{{"access_key", s.AccessKey}, {"secret_key", s.SecretKey}, {"bucket", s.Bucket}, {"region", s.Region}}
+	for _, r := range required {
+		if r.value == "" {
+			problems = append(problems, errors.Err("s3.%s is required", r.field))
+		}
+	}
+	if s.Endpoint != "" {
+		u, err := url.Parse(s.Endpoint)
+		if err != nil {
+			problems = append(problems, errors.Err("s3.endpoint: %s", err.Error()))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, errors.Err("s3.endpoint: %s is not an http(s) URL", s.Endpoint))
+		}
+	}
+	return problems
+}
+
+func (t ThrottlingConfig) validate() []error {
+	var problems []error
+	rates := []struct {
+		field string
+		value float64
+	}{{"s3_requests_per_second", t.S3RequestsPerSecond}, {"s3_keys_per_second", t.S3KeysPerSecond}, {"mysql_deletes_per_second", t.MySQLDeletesPerSecond}}
+	for _, r := range rates {
+		if r.value < 0 {
+			problems = append(problems, errors.Err("throttling.%s cannot be negative", r.field))
+		}
+	}
+	if t.MaxBackoffSeconds < 0 {
+		problems = append(problems, errors.Err("throttling.max_backoff_seconds cannot be negative"))
+	}
+	if t.MaxRetries < 0 {
+		problems = append(problems, errors.Err("throttling.max_retries cannot be negative"))
+	}
+	return problems
+}
+
+// MaxBackoff returns the longest pause taken when the remote end throttles requests
+func (t ThrottlingConfig) MaxBackoff() time.Duration {
+	return time.Duration(t.MaxBackoffSeconds) * time.Second
+}
+
+func (s SafetyConfig) validate() []error {
+	var problems []error
+	if s.MaxInvalidPercent < 0 || s.MaxInvalidPercent > 100 {
+		problems = append(problems, errors.Err("safety.max_invalid_percent must be between 0 and 100"))
+	}
+	if s.MaxBlobsPerRun < 0 {
+		problems = append(problems, errors.Err("safety.max_blobs_per_run cannot be negative"))
+	}
+	if s.MaxBytesPerRun < 0 {
+		problems = append(problems, errors.Err("safety.max_bytes_per_run cannot be negative"))
+	}
+	return problems
+}
+
+func (q QuarantineConfig) validate(bucket string) []error {
+	var problems []error
+	if q.Enabled && (q.Bucket == "" || q.Bucket == bucket) && q.Prefix == "" {
+		problems = append(problems, errors.Err("quarantine.prefix is required when quarantining in the bucket of the blobs"))
+	}
+	if q.RetentionDays < 0 {
+		problems = append(problems, errors.Err("quarantine.retention_days cannot be negative"))
+	}
+	return problems
+}
+
+// Retention returns how long quarantined objects are kept before they can be expired
+func (q QuarantineConfig) Retention() time.Duration {
+	return time.Duration(q.RetentionDays) * 24 * time.Hour
+}
+
+func (h HubConfig) validate() []error {
+	var problems []error
+	for _, server := range h.Servers {
+		_, port, err := net.SplitHostPort(server)
+		if err != nil {
+			problems = append(problems, errors.Err("hub.servers: %s", err.Error()))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems = append(problems, errors.Err("hub.servers: invalid port %s", port))
+		}
+	}
+	settings := []struct {
+		field string
+		value int
+	}{{"connections_per_server", h.ConnectionsPerServer}, {"dial_timeout_seconds", h.DialTimeoutSeconds}, {"request_timeout_seconds", h.RequestTimeoutSeconds}, {"health_check_interval_seconds", h.HealthCheckIntervalSeconds}}
+	for _, p := range settings {
+		if p.value < 0 {
+			problems = append(problems, errors.Err("hub.%s cannot be negative", p.field))
+		}
+	}
+	return problems
+}
+
+func orDefault(value, defaultValue int) int {
+	if value == 0 {
+		return defaultValue
+	}
+	return value
+}
+
+// Connections returns how many connections are kept open to each hub
+func (h HubConfig) Connections() int {
+	return orDefault(h.ConnectionsPerServer, DefaultHub.ConnectionsPerServer)
+}
+
+// DialTimeout returns how long connecting to a hub may take
+func (h HubConfig) DialTimeout() time.Duration {
+	return time.Duration(orDefault(h.DialTimeoutSeconds, DefaultHub.DialTimeoutSeconds)) * time.Second
+}
+
+// RequestTimeout returns how long a hub may take to answer a batch of requests
+func (h HubConfig) RequestTimeout() time.Duration {
+	return time.Duration(orDefault(h.RequestTimeoutSeconds, DefaultHub.RequestTimeoutSeconds)) * time.Second
+}
+
+// HealthCheckInterval returns how often the hubs are pinged
+func (h HubConfig) HealthCheckInterval() time.Duration {
+	return time.Duration(orDefault(h.HealthCheckIntervalSeconds, DefaultHub.HealthCheckIntervalSeconds)) * time.Second
+}
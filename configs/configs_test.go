@@ -0,0 +1,76 @@
+package configs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(configPath, []byte(`
+chainquery:
+  host: chainquery.lbry.com
+  user: user
+  database: chainquery
+  password: password
+reflector:
+  host: reflector:3306
+  user: lbry
+  database: reflector_blobs
+s3:
+  bucket: BUCKET_NAME
+  region: us-east-1
+  endpoint: https://s3.amazonaws.com
+`), 0600)
+	assert.NoError(t, err)
+	secretPath := filepath.Join(dir, "secret_key")
+	err = os.WriteFile(secretPath, []byte("SECRET_KEY\n"), 0600)
+	assert.NoError(t, err)
+
+	t.Setenv("CLEANER_REFLECTOR_PASSWORD", "env_password")
+	t.Setenv("CLEANER_S3_ACCESS_KEY", "ACCESS_KEY")
+	t.Setenv("CLEANER_S3_SECRET_KEY_FILE", secretPath)
+	t.Setenv("CLEANER_THROTTLING_S3_KEYS_PER_SECOND", "500")
+
+	c, err := Load(configPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "password", c.Chainquery.Password)
+	assert.Equal(t, "env_password", c.Reflector.Password)
+	assert.Equal(t, "ACCESS_KEY", c.S3.AccessKey)
+	assert.Equal(t, "SECRET_KEY", c.S3.SecretKey)
+	assert.Equal(t, DefaultSQLitePath, c.SQLitePath)
+	assert.Equal(t, 500.0, c.Throttling.S3KeysPerSecond)
+	assert.Equal(t, DefaultThrottling.MaxRetries, c.Throttling.MaxRetries)
+	assert.Empty(t, c.Validate())
+
+	// the fingerprint doesn't depend on the secrets
+	other := *c
+	other.S3.SecretKey = "OTHER_SECRET_KEY"
+	assert.Equal(t, c.Fingerprint(), other.Fingerprint())
+	other.S3.Bucket = "OTHER_BUCKET"
+	assert.NotEqual(t, c.Fingerprint(), other.Fingerprint())
+
+	t.Setenv("CLEANER_S3_SECRET_KEY", "SECRET_KEY")
+	_, err = Load(configPath)
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	c := Configs{
+		Chainquery: DbConfig{Host: "chainquery:port", User: "user", Database: "chainquery"},
+		S3:         AWSS3Config{AccessKey: "a", SecretKey: "s", Bucket: "b", Region: "r", Endpoint: "s3.amazonaws.com"},
+	}
+	problems := c.Validate()
+	// invalid chainquery port, missing reflector host, user and database, invalid endpoint and missing sqlite path
+	assert.Len(t, problems, 6)
+
+	// chainquery alone always reaches a quorum of 1
+	c.Consensus.Quorum = 1
+	assert.Len(t, c.Validate(), 7)
+	c.Consensus.Quorum = 0
+	assert.Len(t, c.Validate(), 6)
+}
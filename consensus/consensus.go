@@ -0,0 +1,172 @@
+package consensus
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nikooo777/reflector-s3-cleaner/blockchain"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+)
+
+// Vote is the opinion of a source about a stream chainquery reported as invalid
+type Vote string
+
+const (
+	VoteInvalid Vote = "invalid"
+	VoteValid   Vote = "valid"
+	// VoteAbstain is cast when the source failed or can't look the stream up
+	VoteAbstain Vote = "abstain"
+)
+
+const (
+	// Confirmed streams were reported as invalid by at least a quorum of sources and can be deleted
+	Confirmed = "confirmed"
+	// Unconfirmed streams didn't reach the quorum or were reported as valid by a source and are kept
+	Unconfirmed = "unconfirmed"
+)
+
+// Ballot is the vote of a source about a stream. Err explains an abstention caused by a failure
+type Ballot struct {
+	Source string
+	Vote   Vote
+	Err    error
+}
+
+// Outcome is the result of the vote about a stream. It's disputed if any source considers the stream valid, which keeps it unconfirmed
+// whatever the amount of invalid votes so that it's reviewed by hand
+type Outcome struct {
+	Consensus string
+	Disputed  bool
+	Ballots   []Ballot
+}
+
+// Tally counts the ballots about a stream
+func Tally(quorum int, ballots []Ballot) Outcome {
+	o := Outcome{Consensus: Unconfirmed, Ballots: ballots}
+	invalid := 0
+	for _, b := range ballots {
+		switch b.Vote {
+		case VoteInvalid:
+			invalid++
+		case VoteValid:
+			o.Disputed = true
+		}
+	}
+	if invalid >= quorum && !o.Disputed {
+		o.Consensus = Confirmed
+	}
+	return o
+}
+
+// Source is an independent source of truth about the chain state of the streams
+type Source interface {
+	Name() string
+	// Vote returns a ballot for every stream, in the same order
+	Vote(ctx context.Context, streams []shared.StreamData) []Ballot
+}
+
+// Verify asks every source about the streams at the same time and tallies their ballots
+func Verify(ctx context.Context, quorum int, sources []Source, streams []shared.StreamData) []Outcome {
+	ballots := make([][]Ballot, len(sources))
+	var wg sync.WaitGroup
+	for i, s := range sources {
+		wg.Add(1)
+		go func(i int, s Source) {
+			defer wg.Done()
+			ballots[i] = s.Vote(ctx, streams)
+		}(i, s)
+	}
+	wg.Wait()
+	outcomes := make([]Outcome, len(streams))
+	for j := range streams {
+		streamBallots := make([]Ballot, len(sources))
+		for i := range sources {
+			streamBallots[i] = ballots[i][j]
+		}
+		outcomes[j] = Tally(quorum, streamBallots)
+	}
+	return outcomes
+}
+
+// Chainquery votes with the classification of the resolve stage
+type Chainquery struct{}
+
+func (Chainquery) Name() string {
+	return "chainquery"
+}
+
+func (c Chainquery) Vote(ctx context.Context, streams []shared.StreamData) []Ballot {
+	ballots := make([]Ballot, len(streams))
+	for i, sd := range streams {
+		ballots[i] = Ballot{Source: c.Name(), Vote: VoteInvalid}
+		if sd.IsValid() {
+			ballots[i].Vote = VoteValid
+		}
+	}
+	return ballots
+}
+
+// Hub votes with the answers of a single hub, looking the streams up by claim ID or by sd_hash
+type Hub struct {
+	Address string
+	Client  *blockchain.Client
+}
+
+func (h Hub) Name() string {
+	return "hub " + h.Address
+}
+
+func (h Hub) Vote(ctx context.Context, streams []shared.StreamData) []Ballot {
+	lookups := make([]blockchain.Lookup, len(streams))
+	for i, sd := range streams {
+		lookups[i].SdHash = sd.SdHash
+		if sd.ClaimID != nil {
+			lookups[i].ClaimID = *sd.ClaimID
+		}
+	}
+	ballots := make([]Ballot, len(streams))
+	results, err := h.Client.ClaimsExist(ctx, lookups)
+	for i := range streams {
+		switch {
+		case err != nil:
+			ballots[i] = Ballot{Vote: VoteAbstain, Err: err}
+		case results[i].Err != nil:
+			ballots[i] = Ballot{Vote: VoteAbstain, Err: results[i].Err}
+		case results[i].Exists:
+			ballots[i] = Ballot{Vote: VoteValid}
+		default:
+			ballots[i] = Ballot{Vote: VoteInvalid}
+		}
+		ballots[i].Source = h.Name()
+	}
+	return ballots
+}
+
+// Node votes with the claimtrie of an lbcd node. It can only look claims up by ID, so it abstains for the streams without one
+type Node struct {
+	Node *blockchain.Node
+}
+
+func (Node) Name() string {
+	return "lbcd"
+}
+
+func (n Node) Vote(ctx context.Context, streams []shared.StreamData) []Ballot {
+	ballots := make([]Ballot, len(streams))
+	for i, sd := range streams {
+		ballots[i] = Ballot{Source: n.Name(), Vote: VoteAbstain}
+		if sd.ClaimID == nil {
+			continue
+		}
+		exists, err := n.Node.ClaimExists(ctx, *sd.ClaimID)
+		switch {
+		case err != nil:
+			ballots[i].Err = err
+		case exists:
+			ballots[i].Vote = VoteValid
+		default:
+			ballots[i].Vote = VoteInvalid
+		}
+	}
+	return ballots
+}
@@ -0,0 +1,73 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTally(t *testing.T) {
+	invalid := Ballot{Vote: VoteInvalid}
+	valid := Ballot{Vote: VoteValid}
+	abstain := Ballot{Vote: VoteAbstain}
+
+	o := Tally(2, []Ballot{invalid, invalid, abstain})
+	assert.Equal(t, Confirmed, o.Consensus)
+	assert.False(t, o.Disputed)
+
+	o = Tally(2, []Ballot{invalid, abstain, abstain})
+	assert.Equal(t, Unconfirmed, o.Consensus)
+	assert.False(t, o.Disputed)
+
+	// a single source voting valid holds the stream back even when the quorum is reached
+	o = Tally(2, []Ballot{invalid, invalid, valid})
+	assert.Equal(t, Unconfirmed, o.Consensus)
+	assert.True(t, o.Disputed)
+
+	o = Tally(2, []Ballot{invalid, valid})
+	assert.Equal(t, Unconfirmed, o.Consensus)
+	assert.True(t, o.Disputed)
+}
+
+type fixedSource struct {
+	name  string
+	votes []Vote
+}
+
+func (f fixedSource) Name() string {
+	return f.name
+}
+
+func (f fixedSource) Vote(ctx context.Context, streams []shared.StreamData) []Ballot {
+	ballots := make([]Ballot, len(streams))
+	for i := range streams {
+		ballots[i] = Ballot{Source: f.name, Vote: f.votes[i]}
+	}
+	return ballots
+}
+
+func TestVerify(t *testing.T) {
+	streams := []shared.StreamData{{SdHash: "a", Resolved: true}, {SdHash: "b", Resolved: true}}
+	hub := fixedSource{name: "hub", votes: []Vote{VoteInvalid, VoteValid}}
+	outcomes := Verify(context.Background(), 2, []Source{Chainquery{}, hub}, streams)
+	if assert.Len(t, outcomes, 2) {
+		assert.Equal(t, Confirmed, outcomes[0].Consensus)
+		assert.Equal(t, Unconfirmed, outcomes[1].Consensus)
+		assert.True(t, outcomes[1].Disputed)
+		assert.Equal(t, []Ballot{{Source: "chainquery", Vote: VoteInvalid}, {Source: "hub", Vote: VoteValid}}, outcomes[1].Ballots)
+	}
+}
+
+func TestVerifyOneSourceValid(t *testing.T) {
+	streams := []shared.StreamData{{SdHash: "a", Resolved: true}}
+	hub := fixedSource{name: "hub", votes: []Vote{VoteInvalid}}
+	lbcd := fixedSource{name: "lbcd", votes: []Vote{VoteValid}}
+	outcomes := Verify(context.Background(), 2, []Source{Chainquery{}, hub, lbcd}, streams)
+	if assert.Len(t, outcomes, 1) {
+		assert.Equal(t, Unconfirmed, outcomes[0].Consensus)
+		assert.True(t, outcomes[0].Disputed)
+	}
+}
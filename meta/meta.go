@@ -0,0 +1,36 @@
+package meta
+
+import (
+	"strconv"
+	"time"
+)
+
+// Version and Time are injected at build time by the Makefile
+var (
+	Version = ""
+	Time    = ""
+)
+
+// BuildTime is when the binary was built, zero if it wasn't built by the Makefile
+var BuildTime time.Time
+
+func init() {
+	if Time == "" {
+		return
+	}
+	seconds, err := strconv.ParseInt(Time, 10, 64)
+	if err == nil {
+		BuildTime = time.Unix(seconds, 0).UTC()
+	}
+}
+
+// VersionString describes the binary, "unknown" if it wasn't built by the Makefile
+func VersionString() string {
+	if Version == "" {
+		return "unknown"
+	}
+	if BuildTime.IsZero() {
+		return Version
+	}
+	return Version + " built at " + BuildTime.Format(time.RFC3339)
+}
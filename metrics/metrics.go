@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+const namespace = "reflector_cleaner"
+
+var (
+	StreamsScanned = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "streams_scanned_total",
+		Help:      "Streams retrieved from the reflector database",
+	})
+	ChainqueryBatchesResolved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chainquery_batches_resolved_total",
+		Help:      "Batches of streams resolved against chainquery",
+	})
+	BlobsResolved = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blobs_resolved_total",
+		Help:      "Blobs of invalid streams resolved from the reflector database",
+	})
+	S3DeleteBatchesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_delete_batches_sent_total",
+		Help:      "DeleteObjects requests sent to S3",
+	})
+	S3DeleteBatchesSucceeded = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_delete_batches_succeeded_total",
+		Help:      "DeleteObjects requests that succeeded",
+	})
+	S3DeleteBatchesFailed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_delete_batches_failed_total",
+		Help:      "DeleteObjects requests that failed",
+	})
+	S3DeleteBatchesThrottled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_delete_batches_throttled_total",
+		Help:      "DeleteObjects requests S3 throttled and that were retried after backing off",
+	})
+	S3ObjectsQuarantined = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_objects_quarantined_total",
+		Help:      "Objects copied to the quarantine before being deleted",
+	})
+	S3ObjectsDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "s3_objects_deleted_total",
+		Help:      "Objects S3 confirmed as deleted",
+	})
+	DBDeletesThrottled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_deletes_throttled_total",
+		Help:      "Reflector database deletions that were retried after backing off",
+	})
+	SQLiteFlagDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sqlite_flag_duration_seconds",
+		Help:      "Time taken to flag deleted blobs in the local store",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 14),
+	})
+	DBRowsCleansed = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_rows_cleansed_total",
+		Help:      "Rows removed from the reflector database",
+	})
+)
+
+// Serve exposes the metrics on addr until the context is cancelled
+func Serve(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		logrus.Infof("serving metrics on %s/metrics", addr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("metrics server stopped: %s", errors.FullTrace(err))
+		}
+	}()
+}
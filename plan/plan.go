@@ -0,0 +1,125 @@
+package plan
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/purger"
+	"github.com/nikooo777/reflector-s3-cleaner/reflector"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/sqlite_store"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Build walks the same selection logic used by purger.PurgeStreams (wipe) or reflector.DeleteStreamBlobs (cleanse)
+// and returns what they would delete without deleting anything
+func Build(kind sqlite_store.PlanKind, streamData []shared.StreamData) (*sqlite_store.Plan, error) {
+	p := &sqlite_store.Plan{
+		Kind:      kind,
+		CreatedAt: time.Now().UTC(),
+		Items:     make([]sqlite_store.PlanItem, 0),
+	}
+	for i, sd := range streamData {
+		if i%500000 == 0 {
+			logrus.Infof("planned %d/%d streams", i, len(streamData))
+		}
+		item := sqlite_store.PlanItem{
+			StreamID: sd.StreamID,
+			SdHash:   sd.SdHash,
+			ClaimID:  sd.ClaimID,
+			Reason:   sd.InvalidReason(),
+		}
+		switch kind {
+		case sqlite_store.PlanKindWipe:
+			item.BlobKeys = purger.SelectBlobs(sd)
+			_, item.DeleteSdBlob = purger.SelectSdBlob(sd)
+			if len(item.BlobKeys) == 0 && !item.DeleteSdBlob {
+				continue
+			}
+		case sqlite_store.PlanKindCleanse:
+			blobIDs, skipReason := reflector.SelectBlobRows(sd)
+			if skipReason != "" {
+				continue
+			}
+			item.BlobIDs = blobIDs
+		default:
+			return nil, errors.Err("unknown plan kind %s", kind)
+		}
+		// blobs that weren't measured yet are estimated. A cleanse only removes database rows, so it doesn't reclaim any
+		for _, key := range item.BlobKeys {
+			item.EstimatedBytes += sd.StreamBlobs[key].Size()
+		}
+		add(p, item)
+	}
+	return p, nil
+}
+
+func add(p *sqlite_store.Plan, item sqlite_store.PlanItem) {
+	p.Items = append(p.Items, item)
+	p.Streams++
+	p.Blobs += int64(len(item.BlobKeys) + len(item.BlobIDs))
+	if item.DeleteSdBlob {
+		p.Blobs++
+	}
+	p.EstimatedBytes += item.EstimatedBytes
+}
+
+// Save writes the plan to the given path as indented JSON so that it can be reviewed
+func Save(p *sqlite_store.Plan, path string) error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return errors.Err(err)
+	}
+	err = os.WriteFile(path, content, 0644)
+	if err != nil {
+		return errors.Err(err)
+	}
+	logrus.Infof("saved %s plan %d to %s", p.Kind, p.ID, path)
+	return nil
+}
+
+// Restrict returns the streams that are part of the plan, stripped of any blob that the plan doesn't include.
+// Streams whose blobs changed since the plan was made are left out so that nothing that wasn't reviewed gets deleted
+func Restrict(p *sqlite_store.Plan, streamData []shared.StreamData) []shared.StreamData {
+	items := make(map[int64]sqlite_store.PlanItem, len(p.Items))
+	for _, item := range p.Items {
+		items[item.StreamID] = item
+	}
+	restricted := make([]shared.StreamData, 0, len(p.Items))
+	for _, sd := range streamData {
+		item, ok := items[sd.StreamID]
+		if !ok {
+			continue
+		}
+		if item.SdHash != sd.SdHash {
+			logrus.Warnf("stream %d has sd_hash %s but plan %d expected %s, skipping!", sd.StreamID, sd.SdHash, p.ID, item.SdHash)
+			continue
+		}
+		planned := make(map[string]bool, len(item.BlobKeys))
+		for _, key := range item.BlobKeys {
+			planned[key] = true
+		}
+		plannedIDs := make(map[int64]bool, len(item.BlobIDs))
+		for _, id := range item.BlobIDs {
+			plannedIDs[id] = true
+		}
+		streamBlobs := make(map[string]shared.BlobInfo, len(sd.StreamBlobs))
+		for blobHash, blobInfo := range sd.StreamBlobs {
+			// the retained blobs of a cleansed stream aren't deleted but must stay with the stream to tell them apart from unplanned ones
+			if (p.Kind == sqlite_store.PlanKindWipe && planned[blobHash]) || (p.Kind == sqlite_store.PlanKindCleanse && (plannedIDs[blobInfo.BlobID] || blobInfo.Retained)) {
+				streamBlobs[blobHash] = blobInfo
+			}
+		}
+		if p.Kind == sqlite_store.PlanKindCleanse && len(streamBlobs) != len(sd.StreamBlobs) {
+			logrus.Warnf("stream %s has blobs that are not part of plan %d, skipping!", sd.SdHash, p.ID)
+			continue
+		}
+		sd.StreamBlobs = streamBlobs
+		sd.KeepSdBlob = p.Kind == sqlite_store.PlanKindWipe && !item.DeleteSdBlob
+		restricted = append(restricted, sd)
+	}
+	return restricted
+}
@@ -0,0 +1,98 @@
+package protection
+
+import (
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Kind is what a protection matches streams by
+type Kind string
+
+const (
+	KindSdHash  Kind = "sd_hash"
+	KindClaimID Kind = "claim_id"
+	// KindChannel matches every stream published by the channel, its value is the claim ID of the channel (publisher_id in chainquery)
+	KindChannel Kind = "channel"
+)
+
+// ParseKind validates the kind of a protection
+func ParseKind(kind string) (Kind, error) {
+	switch Kind(kind) {
+	case KindSdHash, KindClaimID, KindChannel:
+		return Kind(kind), nil
+	}
+	return "", errors.Err("unknown protection kind %s, it must be one of %s, %s or %s", kind, KindSdHash, KindClaimID, KindChannel)
+}
+
+// Protection prevents the matching streams from being deleted regardless of their chain state, until it expires if it has an expiry
+type Protection struct {
+	ID        int64      `json:"id"`
+	Kind      Kind       `json:"kind"`
+	Value     string     `json:"value"`
+	Reason    string     `json:"reason"`
+	Owner     string     `json:"owner"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// Active returns true if the protection hasn't expired at the given time
+func (p Protection) Active(at time.Time) bool {
+	return p.ExpiresAt == nil || p.ExpiresAt.After(at)
+}
+
+// Set looks up the protections that apply to a stream
+type Set struct {
+	byKind map[Kind]map[string]Protection
+}
+
+// NewSet indexes the protections that are active now
+func NewSet(protections []Protection) *Set {
+	s := &Set{byKind: make(map[Kind]map[string]Protection)}
+	now := time.Now()
+	for _, p := range protections {
+		if !p.Active(now) {
+			continue
+		}
+		if s.byKind[p.Kind] == nil {
+			s.byKind[p.Kind] = make(map[string]Protection)
+		}
+		s.byKind[p.Kind][p.Value] = p
+	}
+	return s
+}
+
+// Match returns the protection that applies to the stream or nil if it isn't protected
+func (s *Set) Match(sd shared.StreamData) *Protection {
+	if p, ok := s.byKind[KindSdHash][sd.SdHash]; ok {
+		return &p
+	}
+	if sd.ClaimID != nil {
+		if p, ok := s.byKind[KindClaimID][*sd.ClaimID]; ok {
+			return &p
+		}
+	}
+	if sd.PublisherID != nil {
+		if p, ok := s.byKind[KindChannel][*sd.PublisherID]; ok {
+			return &p
+		}
+	}
+	return nil
+}
+
+// Apply flags the protected streams and returns how many of them would otherwise be deleted
+func (s *Set) Apply(streamData []shared.StreamData) int64 {
+	var protected int64
+	for i, sd := range streamData {
+		if s.Match(sd) == nil {
+			continue
+		}
+		streamData[i].Protected = true
+		if sd.IsPurgeable() {
+			protected++
+		}
+	}
+	return protected
+}
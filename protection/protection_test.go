@@ -0,0 +1,43 @@
+package protection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	claimID := "claim"
+	channelID := "channel"
+	expired := time.Now().Add(-time.Hour)
+	set := NewSet([]Protection{
+		{Kind: KindSdHash, Value: "sd1"},
+		{Kind: KindClaimID, Value: claimID},
+		{Kind: KindChannel, Value: channelID},
+		{Kind: KindSdHash, Value: "sd4", ExpiresAt: &expired},
+	})
+	streams := []shared.StreamData{
+		{SdHash: "sd1", Exists: false},
+		{SdHash: "sd2", Exists: true, Spent: true, ClaimID: &claimID},
+		{SdHash: "sd3", Exists: true, Spent: true, PublisherID: &channelID},
+		{SdHash: "sd4", Exists: false},
+		{SdHash: "sd5", Exists: true, PublisherID: &channelID},
+	}
+	assert.Equal(t, int64(3), set.Apply(streams))
+	for i, protected := range []bool{true, true, true, false, true} {
+		assert.Equal(t, protected, streams[i].Protected, streams[i].SdHash)
+		assert.False(t, protected && streams[i].IsPurgeable(), streams[i].SdHash)
+	}
+	assert.True(t, streams[3].IsPurgeable())
+}
+
+func TestParseKind(t *testing.T) {
+	kind, err := ParseKind("channel")
+	assert.NoError(t, err)
+	assert.Equal(t, KindChannel, kind)
+	_, err = ParseKind("publisher")
+	assert.Error(t, err)
+}
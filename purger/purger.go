@@ -1,25 +1,35 @@
 package purger
 
 import (
+	"context"
+	"sort"
 	"sync"
 
 	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/metrics"
 	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/throttle"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
 )
 
 type Purger struct {
-	session *session.Session
-	client  *s3.S3
-	bucket  string
+	session    *session.Session
+	client     *s3.S3
+	bucket     string
+	requests   *throttle.Limiter
+	keys       *throttle.Limiter
+	maxRetries int
+	quarantine configs.QuarantineConfig
 }
 
-func Init(awsCreds configs.AWSS3Config) (*Purger, error) {
+func Init(awsCreds configs.AWSS3Config, throttling configs.ThrottlingConfig, quarantine configs.QuarantineConfig) (*Purger, error) {
 	creds := credentials.NewStaticCredentials(awsCreds.AccessKey, awsCreds.SecretKey, "")
 	sess, err := session.NewSession(&aws.Config{
 		Region:           aws.String(awsCreds.Region),
@@ -34,12 +44,82 @@ func Init(awsCreds configs.AWSS3Config) (*Purger, error) {
 	svc := s3.New(sess)
 
 	return &Purger{
-		session: sess,
-		client:  svc,
-		bucket:  awsCreds.Bucket,
+		session:    sess,
+		client:     svc,
+		bucket:     awsCreds.Bucket,
+		requests:   throttle.New(throttling.S3RequestsPerSecond, throttling.MaxBackoff()),
+		keys:       throttle.New(throttling.S3KeysPerSecond, throttling.MaxBackoff()),
+		maxRetries: throttling.MaxRetries,
+		quarantine: quarantine,
 	}, nil
 }
 
+// Bucket is the bucket the blobs are deleted from
+func (p *Purger) Bucket() string {
+	return p.bucket
+}
+
+// CheckBucket checks that the bucket is reachable with the configured credentials
+func (p *Purger) CheckBucket(ctx context.Context) error {
+	_, err := p.client.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(p.bucket)})
+	return errors.Err(err)
+}
+
+// ObjectSize is the size of an object in the bucket. Objects that don't exist have a size of 0
+type ObjectSize struct {
+	Key       string
+	SizeBytes int64
+}
+
+// MeasureObjects looks up the size of every key received on the channel with a HeadObject request
+func (p *Purger) MeasureObjects(ctx context.Context, keys <-chan string, sizes chan<- ObjectSize, failures chan<- Failure, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for key := range keys {
+		err := p.requests.Wait(ctx, 1)
+		if err != nil {
+			return
+		}
+		resp, err := p.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(p.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 404 {
+				sizes <- ObjectSize{Key: key}
+				continue
+			}
+			if isThrottlingError(err) {
+				p.requests.Throttled()
+			}
+			failures <- Failure{Hashes: []string{key}, Err: errors.Err(err)}
+			continue
+		}
+		p.requests.Succeeded()
+		sizes <- ObjectSize{Key: key, SizeBytes: aws.Int64Value(resp.ContentLength)}
+	}
+}
+
+// ListObjects pages through the whole bucket with ListObjectsV2 and calls fn with the size of every object. Listing stops at the first error fn returns
+func (p *Purger) ListObjects(ctx context.Context, fn func(ObjectSize) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(p.bucket),
+	}
+	var fnErr error
+	err := p.client.ListObjectsV2PagesWithContext(ctx, input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, o := range page.Contents {
+			fnErr = fn(ObjectSize{Key: aws.StringValue(o.Key), SizeBytes: aws.Int64Value(o.Size)})
+			if fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return errors.Err(err)
+}
+
 type Failure struct {
 	Hashes []string
 	Err    error
@@ -49,61 +129,235 @@ type DeleteResults struct {
 	Successes []string
 }
 
-func (p *Purger) deleteObjects(delInput *s3.Delete) ([]string, error) {
+// deleteObjects returns the keys S3 confirmed as deleted along with the keys it failed to delete individually
+func (p *Purger) deleteObjects(bucket string, delInput *s3.Delete) ([]string, []Failure, error) {
 	input := &s3.DeleteObjectsInput{
-		Bucket: aws.String(p.bucket),
+		Bucket: aws.String(bucket),
 		Delete: delInput,
 	}
 
 	resp, err := p.client.DeleteObjects(input)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var deletedKeys []string
 	for _, deleted := range resp.Deleted {
 		deletedKeys = append(deletedKeys, *deleted.Key)
 	}
+	var keyFailures []Failure
+	for _, e := range resp.Errors {
+		keyFailures = append(keyFailures, Failure{
+			Hashes: []string{aws.StringValue(e.Key)},
+			Err:    errors.Err("%s: %s", aws.StringValue(e.Code), aws.StringValue(e.Message)),
+		})
+	}
+
+	return deletedKeys, keyFailures, nil
+}
+
+// SelectBlobs returns the keys of the blobs of the stream that PurgeStreams would delete from S3.
+// Blobs that were already deleted by a previous (possibly interrupted) wipe and blobs retained for other streams are skipped
+func SelectBlobs(sd shared.StreamData) []string {
+	if sd.IsValid() || !sd.IsPurgeable() {
+		return nil
+	}
+	keys := make([]string, 0, len(sd.StreamBlobs))
+	for blobHash, blobInfo := range sd.StreamBlobs {
+		if blobInfo.Deleted || blobInfo.Retained {
+			continue
+		}
+		keys = append(keys, blobHash)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SelectSdBlob returns the key of the sd blob of the stream if PurgeStreams would delete it from S3 once the selected blobs are
+func SelectSdBlob(sd shared.StreamData) (string, bool) {
+	if sd.IsValid() || !sd.IsPurgeable() || sd.SdBlobDeleted || sd.KeepSdBlob {
+		return "", false
+	}
+	return sd.SdHash, true
+}
 
-	return deletedKeys, nil
+// pendingSdBlob is an sd blob waiting for the other blobs of its stream to be deleted
+type pendingSdBlob struct {
+	key       string
+	remaining int
+	failed    bool
 }
 
-func (p *Purger) PurgeStreams(streams <-chan shared.StreamData, successes chan<- string, failures chan<- Failure, wg *sync.WaitGroup) {
+// PurgeStreams deletes the selected blobs of the streams received on the channel in batches of up to 1000 keys. The sd blob of a stream
+// is only deleted after all its selected blobs were, so a stream whose deletion failed can still be found through its sd blob.
+// Once the context is cancelled no new streams are taken, but the batches being accumulated are still sent so that they're drained
+func (p *Purger) PurgeStreams(ctx context.Context, streams <-chan shared.StreamData, successes chan<- string, failures chan<- Failure, wg *sync.WaitGroup) {
 	defer wg.Done()
 	delInput := &s3.Delete{
 		Objects: []*s3.ObjectIdentifier{},
 	}
+	sdInput := &s3.Delete{
+		Objects: []*s3.ObjectIdentifier{},
+	}
+	queueSdBlob := func(key string) {
+		sdInput.Objects = append(sdInput.Objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		if len(sdInput.Objects) == 1000 {
+			p.tryDeleteObjects(sdInput, successes, failures)
+		}
+	}
+	// the sd blobs waiting for the blobs of the batch being accumulated, by blob. A blob shared by streams is only sent once
+	waiting := make(map[string][]*pendingSdBlob)
+	deleteBlobs := func() {
+		deleted := make(map[string]bool, len(delInput.Objects))
+		for _, key := range p.tryDeleteObjects(delInput, successes, failures) {
+			deleted[key] = true
+		}
+		for key, sdBlobs := range waiting {
+			for _, sdBlob := range sdBlobs {
+				if !deleted[key] {
+					sdBlob.failed = true
+				}
+				sdBlob.remaining--
+				if sdBlob.remaining == 0 && !sdBlob.failed {
+					queueSdBlob(sdBlob.key)
+				}
+			}
+		}
+		waiting = make(map[string][]*pendingSdBlob)
+	}
 
-	for sd := range streams {
-		if sd.IsValid() {
+	for {
+		var sd shared.StreamData
+		var ok bool
+		select {
+		case sd, ok = <-streams:
+		case <-ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		keys := SelectBlobs(sd)
+		sdKey, deleteSdBlob := SelectSdBlob(sd)
+		if deleteSdBlob && len(keys) == 0 {
+			queueSdBlob(sdKey)
 			continue
 		}
-		if sd.Spent || !sd.Exists {
-			for blobHash, _ := range sd.StreamBlobs {
+		sdBlob := &pendingSdBlob{key: sdKey, remaining: len(keys)}
+		for _, blobHash := range keys {
+			if _, queued := waiting[blobHash]; !queued {
 				delInput.Objects = append(delInput.Objects, &s3.ObjectIdentifier{Key: aws.String(blobHash)})
+				waiting[blobHash] = nil
+			}
+			if deleteSdBlob {
+				waiting[blobHash] = append(waiting[blobHash], sdBlob)
+			}
 
-				if len(delInput.Objects) == 1000 {
-					p.tryDeleteObjects(delInput, successes, failures)
-				}
+			if len(delInput.Objects) == 1000 {
+				deleteBlobs()
 			}
 		}
 	}
 
-	// delete remaining objects
+	// delete remaining objects, then the sd blobs they were holding back
+	if len(delInput.Objects) > 0 {
+		deleteBlobs()
+	}
+	if len(sdInput.Objects) > 0 {
+		p.tryDeleteObjects(sdInput, successes, failures)
+	}
+}
+
+// PurgeKeys deletes the given keys in batches of up to 1000 keys. It stops sending batches once the context is cancelled
+func (p *Purger) PurgeKeys(ctx context.Context, keys []string, successes chan<- string, failures chan<- Failure) {
+	delInput := &s3.Delete{
+		Objects: []*s3.ObjectIdentifier{},
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		delInput.Objects = append(delInput.Objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		if len(delInput.Objects) == 1000 {
+			p.tryDeleteObjects(delInput, successes, failures)
+		}
+	}
 	if len(delInput.Objects) > 0 {
 		p.tryDeleteObjects(delInput, successes, failures)
 	}
 }
 
-func (p *Purger) tryDeleteObjects(delInput *s3.Delete, successes chan<- string, failures chan<- Failure) {
-	deletedKeys, err := p.deleteObjects(delInput)
+// isThrottlingError tells whether S3 rejected the request because it's being sent too many of them
+func isThrottlingError(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 503 {
+		return true
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "TooManyRequests", "ServiceUnavailable":
+			return true
+		}
+	}
+	return false
+}
+
+// deleteObjectsThrottled sends the DeleteObjects request within the configured rates, backing off and retrying while S3 throttles it.
+// Batches are always sent to completion, even after the wipe is interrupted, so the waits aren't bound to its context
+func (p *Purger) deleteObjectsThrottled(bucket string, delInput *s3.Delete) ([]string, []Failure, error) {
+	for attempt := 0; ; attempt++ {
+		err := p.keys.Wait(context.Background(), len(delInput.Objects))
+		if err != nil {
+			return nil, nil, err
+		}
+		err = p.requests.Wait(context.Background(), 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		metrics.S3DeleteBatchesSent.Inc()
+		deletedKeys, keyFailures, err := p.deleteObjects(bucket, delInput)
+		if err == nil {
+			p.requests.Succeeded()
+			p.keys.Succeeded()
+			return deletedKeys, keyFailures, nil
+		}
+		if !isThrottlingError(err) || attempt >= p.maxRetries {
+			return nil, nil, err
+		}
+		metrics.S3DeleteBatchesThrottled.Inc()
+		backoff := p.requests.Throttled()
+		p.keys.Throttled()
+		logrus.Warnf("S3 is throttling deletions (%s), backing off for %s before retry %d of %d", err.Error(), backoff, attempt+1, p.maxRetries)
+	}
+}
+
+// tryDeleteObjects deletes the objects from the primary bucket. In quarantine mode the objects are copied to the quarantine first
+// and only the ones that were copied are deleted. It returns the keys that were deleted
+func (p *Purger) tryDeleteObjects(delInput *s3.Delete, successes chan<- string, failures chan<- Failure) []string {
+	if p.quarantine.Enabled {
+		p.quarantineObjects(delInput, failures)
+		if len(delInput.Objects) == 0 {
+			return nil
+		}
+	}
+	return p.tryDeleteObjectsFrom(p.bucket, delInput, successes, failures)
+}
+
+// tryDeleteObjectsFrom permanently deletes the objects from the given bucket and returns the keys that were deleted
+func (p *Purger) tryDeleteObjectsFrom(bucket string, delInput *s3.Delete, successes chan<- string, failures chan<- Failure) []string {
+	deletedKeys, keyFailures, err := p.deleteObjectsThrottled(bucket, delInput)
+	for _, f := range keyFailures {
+		failures <- f
+	}
 	if err != nil {
+		metrics.S3DeleteBatchesFailed.Inc()
 		var failure Failure
 		for _, key := range delInput.Objects {
 			failure.Hashes = append(failure.Hashes, *key.Key)
 		}
 		failure.Err = err
 		failures <- failure
+	} else {
+		metrics.S3DeleteBatchesSucceeded.Inc()
+		metrics.S3ObjectsDeleted.Add(float64(len(deletedKeys)))
 	}
 	for _, key := range deletedKeys {
 		successes <- key
@@ -111,4 +365,5 @@ func (p *Purger) tryDeleteObjects(delInput *s3.Delete, successes chan<- string,
 
 	// Clear the delete list for the next batch
 	delInput.Objects = delInput.Objects[:0]
+	return deletedKeys
 }
@@ -1,29 +1,32 @@
 package purger
 
 import (
+	"context"
 	"os"
 	"testing"
 
-	"reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestPurger_DeleteStream(t *testing.T) {
-	p, err := Init(Credentials{
+func TestPurger_PurgeKeys(t *testing.T) {
+	if os.Getenv("S3_BUCKET") == "" {
+		t.Skip("S3_BUCKET is not set")
+	}
+	p, err := Init(configs.AWSS3Config{
 		AccessKey: os.Getenv("S3_ACCESS_KEY"),
-		Secret:    os.Getenv("S3_SECRET"),
+		SecretKey: os.Getenv("S3_SECRET"),
 		Region:    os.Getenv("S3_REGION"),
 		Bucket:    os.Getenv("S3_BUCKET"),
-	})
-	assert.NoError(t, err)
-	streamToDelete := shared.StreamBlobs{
-		BlobHashes: []string{"nikonikoniko", "nikonikoniko2", "nikonikoniko3"},
-		BlobIds:    nil,
-	}
-	res, err := p.DeleteStream(streamToDelete)
+	}, configs.ThrottlingConfig{}, configs.QuarantineConfig{})
 	assert.NoError(t, err)
+	successes := make(chan string, 3)
+	failures := make(chan Failure, 3)
+	p.PurgeKeys(context.Background(), []string{"nikonikoniko", "nikonikoniko2", "nikonikoniko3"}, successes, failures)
+	close(successes)
+	close(failures)
 
-	assert.Len(t, res.Failures, 0)
-	assert.Len(t, res.Successes, 3)
+	assert.Len(t, failures, 0)
+	assert.Len(t, successes, 3)
 }
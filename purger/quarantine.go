@@ -0,0 +1,125 @@
+package purger
+
+import (
+	"context"
+
+	"github.com/nikooo777/reflector-s3-cleaner/metrics"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// QuarantineLocation returns where the object is copied before being deleted, ok is false if quarantine mode is disabled
+func (p *Purger) QuarantineLocation(key string) (bucket string, quarantineKey string, ok bool) {
+	if !p.quarantine.Enabled {
+		return "", "", false
+	}
+	bucket = p.quarantine.Bucket
+	if bucket == "" {
+		bucket = p.bucket
+	}
+	return bucket, p.quarantine.Prefix + key, true
+}
+
+// quarantineObjects copies the objects to the quarantine location. The objects that couldn't be copied are reported as failures and
+// removed from delInput so that they're not deleted
+func (p *Purger) quarantineObjects(delInput *s3.Delete, failures chan<- Failure) {
+	copied := delInput.Objects[:0]
+	for _, o := range delInput.Objects {
+		err := p.copyToQuarantine(aws.StringValue(o.Key))
+		if err != nil {
+			failures <- Failure{Hashes: []string{aws.StringValue(o.Key)}, Err: errors.Prefix("quarantine", err)}
+			continue
+		}
+		copied = append(copied, o)
+	}
+	delInput.Objects = copied
+}
+
+func (p *Purger) copyToQuarantine(key string) error {
+	// like the deletions, the copies of a batch are completed even after the wipe is interrupted
+	err := p.requests.Wait(context.Background(), 1)
+	if err != nil {
+		return err
+	}
+	bucket, quarantineKey, _ := p.QuarantineLocation(key)
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(quarantineKey),
+		CopySource: aws.String(p.bucket + "/" + key),
+	}
+	if p.quarantine.StorageClass != "" {
+		input.StorageClass = aws.String(p.quarantine.StorageClass)
+	}
+	_, err = p.client.CopyObject(input)
+	if err != nil {
+		if isThrottlingError(err) {
+			p.requests.Throttled()
+		}
+		return errors.Err(err)
+	}
+	p.requests.Succeeded()
+	metrics.S3ObjectsQuarantined.Inc()
+	return nil
+}
+
+// PurgeQuarantined permanently deletes the given keys from the quarantine bucket in batches of up to 1000 keys
+func (p *Purger) PurgeQuarantined(ctx context.Context, bucket string, keys []string, successes chan<- string, failures chan<- Failure) {
+	delInput := &s3.Delete{
+		Objects: []*s3.ObjectIdentifier{},
+	}
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			return
+		}
+		delInput.Objects = append(delInput.Objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		if len(delInput.Objects) == 1000 {
+			p.tryDeleteObjectsFrom(bucket, delInput, successes, failures)
+		}
+	}
+	if len(delInput.Objects) > 0 {
+		p.tryDeleteObjectsFrom(bucket, delInput, successes, failures)
+	}
+}
+
+// RestoreObject copies the object back from the quarantine to its original key in the primary bucket
+func (p *Purger) RestoreObject(ctx context.Context, bucket, quarantineKey, key string) error {
+	err := p.requests.Wait(ctx, 1)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(p.bucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(bucket + "/" + quarantineKey),
+	})
+	if err != nil {
+		if isThrottlingError(err) {
+			p.requests.Throttled()
+		}
+		return errors.Err(err)
+	}
+	p.requests.Succeeded()
+	return nil
+}
+
+// DeleteQuarantined permanently deletes a single object from the quarantine
+func (p *Purger) DeleteQuarantined(ctx context.Context, bucket, quarantineKey string) error {
+	err := p.requests.Wait(ctx, 1)
+	if err != nil {
+		return err
+	}
+	_, err = p.client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(quarantineKey),
+	})
+	if err != nil {
+		if isThrottlingError(err) {
+			p.requests.Throttled()
+		}
+		return errors.Err(err)
+	}
+	p.requests.Succeeded()
+	return nil
+}
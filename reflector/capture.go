@@ -0,0 +1,132 @@
+package reflector
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Row is a database row as column name to value, NULL values are nil
+type Row map[string]*string
+
+// StreamRows are the rows DeleteStreamBlobs removes for a stream, captured beforehand so that they can be restored
+type StreamRows struct {
+	SdBlob      Row   `json:"sd_blob"`
+	Blobs       []Row `json:"blobs"`
+	Stream      Row   `json:"stream"`
+	StreamBlobs []Row `json:"stream_blobs"`
+}
+
+// CaptureStreamRows reads all the columns of the blob_, stream and stream_blob rows of the stream. It returns nil if the stream is no longer in the database
+func (c *ReflectorApi) CaptureStreamRows(ctx context.Context, stream shared.StreamData) (*StreamRows, error) {
+	captured := &StreamRows{}
+	sdBlobs, err := c.queryRows(ctx, "SELECT * FROM blob_ WHERE hash = ?", stream.SdHash)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := c.queryRows(ctx, "SELECT * FROM stream WHERE id = ?", stream.StreamID)
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 {
+		// already cleansed by a previous run
+		return nil, nil
+	}
+	if len(sdBlobs) != 1 {
+		return nil, errors.Err("the sd blob %s of stream %d is not in the reflector database", stream.SdHash, stream.StreamID)
+	}
+	captured.SdBlob = sdBlobs[0]
+	captured.Stream = streams[0]
+	captured.Blobs, err = c.queryRows(ctx, "SELECT b.* FROM blob_ b INNER JOIN stream_blob sb ON b.id = sb.blob_id WHERE sb.stream_id = ?", stream.StreamID)
+	if err != nil {
+		return nil, err
+	}
+	captured.StreamBlobs, err = c.queryRows(ctx, "SELECT * FROM stream_blob WHERE stream_id = ?", stream.StreamID)
+	if err != nil {
+		return nil, err
+	}
+	return captured, nil
+}
+
+func (c *ReflectorApi) queryRows(ctx context.Context, query string, args ...interface{}) ([]Row, error) {
+	rows, err := c.dbConn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer shared.CloseRows(rows)
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	result := make([]Row, 0)
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		row := make(Row, len(columns))
+		for i, column := range columns {
+			if values[i].Valid {
+				v := values[i].String
+				row[column] = &v
+			} else {
+				row[column] = nil
+			}
+		}
+		result = append(result, row)
+	}
+	return result, errors.Err(rows.Err())
+}
+
+// RestoreStreamRows re-inserts the captured rows of a stream in a single transaction. Rows that still exist are left untouched
+func (c *ReflectorApi) RestoreStreamRows(ctx context.Context, captured *StreamRows) error {
+	tx, err := c.dbConn.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	// the blobs go first as the stream and stream_blob rows reference them
+	inserts := []struct {
+		table string
+		rows  []Row
+	}{
+		{"blob_", append([]Row{captured.SdBlob}, captured.Blobs...)},
+		{"stream", []Row{captured.Stream}},
+		{"stream_blob", captured.StreamBlobs},
+	}
+	for _, insert := range inserts {
+		for _, row := range insert.rows {
+			err = insertRow(ctx, tx, insert.table, row)
+			if err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+	}
+	return errors.Err(tx.Commit())
+}
+
+func insertRow(ctx context.Context, tx *sql.Tx, table string, row Row) error {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		if row[column] != nil {
+			values[i] = *row[column]
+		}
+	}
+	_, err := tx.ExecContext(ctx, "INSERT IGNORE INTO "+table+" (`"+strings.Join(columns, "`, `")+"`) VALUES (?"+strings.Repeat(", ?", len(columns)-1)+")", values...)
+	return errors.Err(err)
+}
@@ -4,16 +4,16 @@ import (
 	"os"
 	"testing"
 
-	"reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestSaveAndLoadSDHashes(t *testing.T) {
 	streamData := []shared.StreamData{
-		{SdHash: "test1", StreamID: 1, SdBlobID: 1},
-		{SdHash: "test2", StreamID: 2, SdBlobID: 2},
-		{SdHash: "test3", StreamID: 3, SdBlobID: 3},
+		{SdHash: "test1", StreamID: 1},
+		{SdHash: "test2", StreamID: 2},
+		{SdHash: "test3", StreamID: 3},
 	}
 	err := SaveStreamData(streamData, "test1.json")
 	assert.NoError(t, err)
@@ -1,25 +1,31 @@
 package reflector
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/nikooo777/reflector-s3-cleaner/configs"
+	"github.com/nikooo777/reflector-s3-cleaner/metrics"
 	"github.com/nikooo777/reflector-s3-cleaner/shared"
+	"github.com/nikooo777/reflector-s3-cleaner/throttle"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
 	"github.com/lbryio/lbry.go/v2/extras/query"
 	"github.com/sirupsen/logrus"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 type ReflectorApi struct {
-	dbConn *sql.DB
+	dbConn     *sql.DB
+	deletes    *throttle.Limiter
+	maxRetries int
 }
 
 var instance *ReflectorApi
@@ -32,23 +38,31 @@ func Init() (*ReflectorApi, error) {
 	if err != nil {
 		return nil, err
 	}
+	throttling := configs.Configuration.Throttling
 	instance = &ReflectorApi{
-		dbConn: db,
+		dbConn:     db,
+		deletes:    throttle.New(throttling.MySQLDeletesPerSecond, throttling.MaxBackoff()),
+		maxRetries: throttling.MaxRetries,
 	}
 	return instance, nil
 }
 
+// Ping checks that the database is reachable with the configured credentials
+func (c *ReflectorApi) Ping(ctx context.Context) error {
+	return errors.Err(c.dbConn.PingContext(ctx))
+}
+
 func connect() (*sql.DB, error) {
 	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s)/%s", configs.Configuration.Reflector.User, configs.Configuration.Reflector.Password, configs.Configuration.Reflector.Host, configs.Configuration.Reflector.Database))
 	return db, errors.Err(err)
 }
 
-func (c *ReflectorApi) GetSDblobHashes(blobsIDs []int64) (map[int64]string, error) {
+func (c *ReflectorApi) GetSDblobHashes(ctx context.Context, blobsIDs []int64) (map[int64]string, error) {
 	args := make([]interface{}, len(blobsIDs))
 	for i, b := range blobsIDs {
 		args[i] = b
 	}
-	rows, err := c.dbConn.Query(`SELECT id, hash FROM blob_ where id in(`+query.Qs(len(blobsIDs))+`)`, args...)
+	rows, err := c.dbConn.QueryContext(ctx, `SELECT id, hash FROM blob_ where id in(`+query.Qs(len(blobsIDs))+`)`, args...)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
@@ -72,9 +86,10 @@ const batchSize = 10000
 // GetStreams returns a slice of StreamData containing all necessary stream information
 // limit is an indicator for the function for when to stop looking for new IDs
 // it's not guaranteed that the amount of returned IDs matches the limit
-func (c *ReflectorApi) GetStreams(limit int64) ([]shared.StreamData, error) {
+// if the context is cancelled, the streams retrieved so far are returned along with the error
+func (c *ReflectorApi) GetStreams(ctx context.Context, limit int64) ([]shared.StreamData, error) {
 	// get the most recent stream ID
-	mostRecentStreamID, err := c.getMostRecentStreamID()
+	mostRecentStreamID, err := c.getMostRecentStreamID(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -91,6 +106,17 @@ func (c *ReflectorApi) GetStreams(limit int64) ([]shared.StreamData, error) {
 	allStreamData := make([]shared.StreamData, 0, limit)
 	streamDataLock := sync.Mutex{}
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	errOnce := sync.Once{}
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
 	jobs := make(chan offsets, runtime.NumCPU())
 	producerWg := sync.WaitGroup{}
 	consumerWg := sync.WaitGroup{}
@@ -104,7 +130,11 @@ func (c *ReflectorApi) GetStreams(limit int64) ([]shared.StreamData, error) {
 				end = mostRecentStreamID
 			}
 			logrus.Debugf("adding job for %d to %d", i, end)
-			jobs <- offsets{start: i, end: end}
+			select {
+			case jobs <- offsets{start: i, end: end}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -114,13 +144,15 @@ func (c *ReflectorApi) GetStreams(limit int64) ([]shared.StreamData, error) {
 			defer consumerWg.Done()
 			for job := range jobs {
 				logrus.Infof("getting stream data for ids between %d and %d", job.start, job.end)
-				sd, err := c.getStreamDataV2(job.start, job.end)
+				sd, err := c.getStreamDataV2(ctx, job.start, job.end)
 				if err != nil {
-					logrus.Fatal(err)
+					fail(err)
+					continue
 				}
 				streamDataLock.Lock()
 				allStreamData = append(allStreamData, sd...)
 				streamDataLock.Unlock()
+				metrics.StreamsScanned.Add(float64(len(sd)))
 			}
 		}()
 	}
@@ -129,13 +161,20 @@ func (c *ReflectorApi) GetStreams(limit int64) ([]shared.StreamData, error) {
 	close(jobs)
 	consumerWg.Wait()
 
+	if firstErr == nil {
+		firstErr = errors.Err(ctx.Err())
+	}
+	if firstErr != nil {
+		logrus.Warnf("stopped retrieving streams after finding %d streams out of the %d max expected", len(allStreamData), mostRecentStreamID)
+		return allStreamData, firstErr
+	}
 	logrus.Infof("found %d streams out of the %d max expected", len(allStreamData), mostRecentStreamID)
 	return allStreamData, nil
 }
 
 // getStreams returns a slice of StreamData containing all necessary stream information and an offset for the subsequent call which should be passed in as offset
-func (c *ReflectorApi) getStreamDataV2(start int64, end int64) ([]shared.StreamData, error) {
-	rows, err := c.dbConn.Query(`SELECT s.id, b.hash FROM stream s INNER JOIN blob_ b on s.sd_blob_id = b.id WHERE s.id > ? and s.id < ? order by s.id`, start, end)
+func (c *ReflectorApi) getStreamDataV2(ctx context.Context, start int64, end int64) ([]shared.StreamData, error) {
+	rows, err := c.dbConn.QueryContext(ctx, `SELECT s.id, b.hash FROM stream s INNER JOIN blob_ b on s.sd_blob_id = b.id WHERE s.id > ? and s.id < ? order by s.id`, start, end)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
@@ -157,18 +196,19 @@ func (c *ReflectorApi) getStreamDataV2(start int64, end int64) ([]shared.StreamD
 }
 
 // getMostRecentStreamID returns the most recent stream ID
-func (c *ReflectorApi) getMostRecentStreamID() (int64, error) {
+func (c *ReflectorApi) getMostRecentStreamID(ctx context.Context) (int64, error) {
 	var streamID int64
-	err := c.dbConn.QueryRow(`SELECT id FROM stream ORDER BY id DESC LIMIT 1`).Scan(&streamID)
+	err := c.dbConn.QueryRowContext(ctx, `SELECT id FROM stream ORDER BY id DESC LIMIT 1`).Scan(&streamID)
 	if err != nil {
 		return 0, errors.Err(err)
 	}
 	return streamID, nil
 }
 
-// getBlobHashesForStream returns an object containing the blob hashes and ids for a given stream
-func (c *ReflectorApi) getBlobHashesForStream(streamId int64) (map[string]shared.BlobInfo, error) {
-	rows, err := c.dbConn.Query(`SELECT b.id, b.hash FROM blob_ b inner join stream_blob sb on b.id = sb.blob_id where sb.stream_id = ?`, streamId)
+// getBlobHashesForStream returns an object containing the blob hashes and ids for a given stream, along with the other streams using each blob
+func (c *ReflectorApi) getBlobHashesForStream(ctx context.Context, streamId int64) (map[string]shared.BlobInfo, error) {
+	rows, err := c.dbConn.QueryContext(ctx, `SELECT b.id, b.hash, ref.stream_id FROM blob_ b inner join stream_blob sb on b.id = sb.blob_id
+inner join stream_blob ref on ref.blob_id = b.id where sb.stream_id = ?`, streamId)
 	if err != nil {
 		return nil, errors.Err(err)
 	}
@@ -176,17 +216,24 @@ func (c *ReflectorApi) getBlobHashesForStream(streamId int64) (map[string]shared
 	streamBlobs := make(map[string]shared.BlobInfo)
 	blobsFound := 0
 	for rows.Next() {
-		var id int64
+		var id, referencingStreamID int64
 		var hash string
-		err = rows.Scan(&id, &hash)
+		err = rows.Scan(&id, &hash, &referencingStreamID)
 		if err != nil {
 			return nil, errors.Err(err)
 		}
-		streamBlobs[hash] = shared.BlobInfo{
-			BlobID:  id,
-			Deleted: false,
+		blobInfo, found := streamBlobs[hash]
+		if !found {
+			blobInfo = shared.BlobInfo{
+				BlobID:  id,
+				Deleted: false,
+			}
+			blobsFound++
+		}
+		if referencingStreamID != streamId {
+			blobInfo.ReferencedBy = append(blobInfo.ReferencedBy, referencingStreamID)
 		}
-		blobsFound++
+		streamBlobs[hash] = blobInfo
 	}
 	err = rows.Err()
 	if err != nil {
@@ -198,62 +245,215 @@ func (c *ReflectorApi) getBlobHashesForStream(streamId int64) (map[string]shared
 	return streamBlobs, nil
 }
 
+// GetBlobReferences returns the streams using each of the given blobs, queried in batches of up to shared.MysqlMaxBatchSize blobs
+func (c *ReflectorApi) GetBlobReferences(ctx context.Context, blobIDs []int64) (map[int64][]int64, error) {
+	references := make(map[int64][]int64, len(blobIDs))
+	for start := 0; start < len(blobIDs); start += shared.MysqlMaxBatchSize {
+		end := start + shared.MysqlMaxBatchSize
+		if end > len(blobIDs) {
+			end = len(blobIDs)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, id := range blobIDs[start:end] {
+			args = append(args, id)
+		}
+		rows, err := c.dbConn.QueryContext(ctx, `SELECT blob_id, stream_id FROM stream_blob WHERE blob_id IN (`+query.Qs(len(args))+`)`, args...)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		for rows.Next() {
+			var blobID, streamID int64
+			err = rows.Scan(&blobID, &streamID)
+			if err != nil {
+				shared.CloseRows(rows)
+				return nil, errors.Err(err)
+			}
+			references[blobID] = append(references[blobID], streamID)
+		}
+		err = rows.Err()
+		shared.CloseRows(rows)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+	}
+	return references, nil
+}
+
+// SelectBlobRows returns the IDs of the blob_ rows that DeleteStreamBlobs would delete for the stream, on top of the stream and its sd_blob.
+// The rows of the retained blobs are kept as other streams use them. skipReason tells why the stream must not be removed from the database,
+// it's empty if it can be
+func SelectBlobRows(stream shared.StreamData) (blobIDs []int64, skipReason string) {
+	if stream.IsValid() || !stream.IsPurgeable() {
+		return nil, "the stream is not purged"
+	}
+	if !stream.SdBlobDeleted {
+		return nil, fmt.Sprintf("sd blob %s is not marked as deleted", stream.SdHash)
+	}
+	blobIDs = make([]int64, 0, len(stream.StreamBlobs))
+	for sb, blobInfo := range stream.StreamBlobs {
+		if blobInfo.Retained {
+			continue
+		}
+		if !blobInfo.Deleted {
+			return nil, fmt.Sprintf("blob %s is not marked as deleted", sb)
+		}
+		blobIDs = append(blobIDs, blobInfo.BlobID)
+	}
+	sort.Slice(blobIDs, func(i, j int) bool { return blobIDs[i] < blobIDs[j] })
+	return blobIDs, ""
+}
+
 // DeleteStreamBlobs deletes blobs for a list of streams (granted that they're marked as deleted in memory)
 // After deleting the blobs, stream_blob entries should have been deleted as well (on delete cascade)
 // this allows for the deletion of the entry in `stream` which has to happen right before deleting the sd_blob
-func (c *ReflectorApi) DeleteStreamBlobs(stream shared.StreamData) error {
+// it returns the blob_ and stream rows that were removed (cascaded stream_blob rows are not included)
+func (c *ReflectorApi) DeleteStreamBlobs(ctx context.Context, stream shared.StreamData) ([]shared.RemovedRow, error) {
 	if stream.IsValid() {
-		return errors.Err("stream is valid and should not be deleted!")
+		return nil, errors.Err("stream is valid and should not be deleted!")
 	}
 
-	blobsToDelete := make([]interface{}, 0, len(stream.StreamBlobs))
-	for sb, blobInfo := range stream.StreamBlobs {
-		if !blobInfo.Deleted {
-			logrus.Warnf("blob %s is not marked as deleted for stream %s (sd_hash), skipping!", sb, stream.SdHash)
-			return nil
+	blobIDs, skipReason := SelectBlobRows(stream)
+	if skipReason != "" {
+		return nil, nil
+	}
+	blobsToDelete := make([]interface{}, 0, len(blobIDs))
+	for _, id := range blobIDs {
+		blobsToDelete = append(blobsToDelete, id)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.deletes.Wait(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		removed, err := c.deleteStream(ctx, stream, blobsToDelete)
+		if err == nil {
+			c.deletes.Succeeded()
+			metrics.DBRowsCleansed.Add(float64(len(removed)))
+			return removed, nil
 		}
-		blobsToDelete = append(blobsToDelete, blobInfo.BlobID)
+		if !isRetryableError(err) || attempt >= c.maxRetries {
+			return nil, err
+		}
+		metrics.DBDeletesThrottled.Inc()
+		backoff := c.deletes.Throttled()
+		logrus.Warnf("deleting stream %d failed (%s), backing off for %s before retry %d of %d", stream.StreamID, err.Error(), backoff, attempt+1, c.maxRetries)
+	}
+}
+
+// isRetryableError tells whether the database rejected the transaction because it's overloaded, in which case it was rolled back and can be retried
+func isRetryableError(err error) bool {
+	mysqlErr, ok := errors.Unwrap(err).(*mysql.MySQLError)
+	if !ok {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1040, 1205, 1213: // too many connections, lock wait timeout, deadlock
+		return true
 	}
+	return false
+}
 
-	// delete blobs in a transaction
-	tx, err := c.dbConn.Begin()
+// deleteStream deletes the blobs, the stream and its sd_blob in a single transaction and returns the rows that were removed
+func (c *ReflectorApi) deleteStream(ctx context.Context, stream shared.StreamData, blobsToDelete []interface{}) ([]shared.RemovedRow, error) {
+	tx, err := c.dbConn.BeginTx(ctx, nil)
 	if err != nil {
-		return errors.Err(err)
+		return nil, errors.Err(err)
 	}
 
-	// Construct and execute the DELETE query for blobs
-	if len(blobsToDelete) > 0 {
-		q := "DELETE FROM blob_ WHERE id IN (?" + strings.Repeat(",?", len(blobsToDelete)-1) + ")"
-		_, err = tx.Exec(q, blobsToDelete...)
+	var removed []shared.RemovedRow
+	exec := func(row shared.RemovedRow, q string, args ...interface{}) error {
+		res, err := tx.ExecContext(ctx, q, args...)
 		if err != nil {
 			_ = tx.Rollback() // Rollback transaction in case of error
 			return errors.Err(err)
 		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+		if affected > 0 {
+			removed = append(removed, row)
+		}
+		return nil
+	}
+
+	// Select and lock the blobs to delete, keeping the ones another stream started using since they were resolved, so that every removed row is known
+	if len(blobsToDelete) > 0 {
+		rows, err := tx.QueryContext(ctx, "SELECT id FROM blob_ WHERE id IN (?"+strings.Repeat(",?", len(blobsToDelete)-1)+") AND NOT EXISTS (SELECT 1 FROM stream_blob sb WHERE sb.blob_id = blob_.id AND sb.stream_id <> ?) FOR UPDATE",
+			append(blobsToDelete, stream.StreamID)...)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, errors.Err(err)
+		}
+		var blobIDs []int64
+		for rows.Next() {
+			var id int64
+			err = rows.Scan(&id)
+			if err != nil {
+				shared.CloseRows(rows)
+				_ = tx.Rollback()
+				return nil, errors.Err(err)
+			}
+			blobIDs = append(blobIDs, id)
+		}
+		err = rows.Err()
+		shared.CloseRows(rows)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, errors.Err(err)
+		}
+		if len(blobIDs) > 0 {
+			args := make([]interface{}, 0, len(blobIDs))
+			for _, id := range blobIDs {
+				args = append(args, id)
+			}
+			// the rows are locked so they're all deleted
+			_, err = tx.ExecContext(ctx, "DELETE FROM blob_ WHERE id IN (?"+strings.Repeat(",?", len(args)-1)+")", args...)
+			if err != nil {
+				_ = tx.Rollback()
+				return nil, errors.Err(err)
+			}
+			for _, id := range blobIDs {
+				removed = append(removed, shared.RemovedRow{Table: "blob_", Row: fmt.Sprintf("id=%d", id)})
+			}
+		}
 	}
 
-	// Execute the DELETE query for associated stream_blob entries
-	_, err = tx.Exec("DELETE FROM stream WHERE id = ?", stream.StreamID)
+	// Execute the DELETE query for the stream entry, its remaining stream_blob entries cascade
+	err = exec(shared.RemovedRow{Table: "stream", Row: fmt.Sprintf("id=%d", stream.StreamID)}, "DELETE FROM stream WHERE id = ?", stream.StreamID)
 	if err != nil {
-		_ = tx.Rollback() // Rollback transaction in case of error
-		return errors.Err(err)
+		return nil, err
 	}
 
 	// Execute the DELETE query for sd_blob
-	_, err = tx.Exec("DELETE FROM blob_ WHERE hash = ?", stream.SdHash)
+	err = exec(shared.RemovedRow{Table: "blob_", Row: "hash=" + stream.SdHash}, "DELETE FROM blob_ WHERE hash = ?", stream.SdHash)
 	if err != nil {
-		_ = tx.Rollback() // Rollback transaction in case of error
-		return errors.Err(err)
+		return nil, err
 	}
 
 	err = tx.Commit() // Commit the transaction
 	if err != nil {
-		return errors.Err(err)
+		return nil, errors.Err(err)
 	}
-	return nil
+	return removed, nil
 }
 
 // GetBlobHashesForStream takes a slice of streams, feeds it into a channel, schedules workers to get the blob hashes for each stream, and returns a slice of StreamBlobs
-func (c *ReflectorApi) GetBlobHashesForStream(streams []shared.StreamData) (int64, error) {
+// if the context is cancelled or an error occurs, the blobs retrieved so far are still attached to their streams
+func (c *ReflectorApi) GetBlobHashesForStream(ctx context.Context, streams []shared.StreamData) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var firstErr error
+	errOnce := sync.Once{}
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
 	streamsChan := make(chan shared.StreamData, runtime.NumCPU()*4)
 	var streamBlobsWg sync.WaitGroup
 	var streamsToBlobsMap = sync.Map{}
@@ -263,24 +463,31 @@ func (c *ReflectorApi) GetBlobHashesForStream(streams []shared.StreamData) (int6
 		go func() {
 			defer streamBlobsWg.Done()
 			for stream := range streamsChan {
-				blobs, err := c.getBlobHashesForStream(stream.StreamID)
+				blobs, err := c.getBlobHashesForStream(ctx, stream.StreamID)
 				if err != nil {
-					logrus.Fatal(err)
+					fail(err)
+					continue
 				}
 				if blobs != nil {
 					logrus.Debugf("found %d blobs for stream %s (%d total)", len(blobs), stream.SdHash, atomic.LoadInt64(&blobsCount))
 					streamsToBlobsMap.Store(stream.StreamID, blobs)
 					atomic.AddInt64(&blobsCount, int64(len(blobs)))
+					metrics.BlobsResolved.Add(float64(len(blobs)))
 				}
 			}
 		}()
 	}
+queueing:
 	for i, stream := range streams {
 		if i%100 == 0 {
 			logrus.Infof("queued %d/%d streams for blob hash retrieval", i, len(streams))
 		}
 		if stream.Resolved && !stream.IsValid() {
-			streamsChan <- stream
+			select {
+			case streamsChan <- stream:
+			case <-ctx.Done():
+				break queueing
+			}
 		}
 	}
 	close(streamsChan)
@@ -292,5 +499,8 @@ func (c *ReflectorApi) GetBlobHashesForStream(streams []shared.StreamData) (int6
 			streams[i].StreamBlobs = val.(map[string]shared.BlobInfo)
 		}
 	}
-	return blobsCount, nil
+	if firstErr == nil {
+		firstErr = errors.Err(ctx.Err())
+	}
+	return blobsCount, firstErr
 }
@@ -0,0 +1,339 @@
+package report
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/meta"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Counts is the classification of the streams
+type Counts struct {
+	Total          int64 `json:"total"`
+	Valid          int64 `json:"valid"`
+	NotOnChain     int64 `json:"not_on_chain"`
+	Expired        int64 `json:"expired"`
+	Spent          int64 `json:"spent"`
+	FalseNegatives int64 `json:"false_negatives"`
+}
+
+// Bytes is the storage taken by the blobs of a category of streams, as measured in S3
+type Bytes struct {
+	Selected   int64 `json:"selected"`
+	Reclaimed  int64 `json:"reclaimed"`
+	Unmeasured int64 `json:"unmeasured_blobs"`
+}
+
+// Disagreement is a stream the consensus sources disagree about, to be reviewed by hand
+type Disagreement struct {
+	SdHash    string            `json:"sd_hash"`
+	ClaimID   *string           `json:"claim_id"`
+	Consensus string            `json:"consensus"`
+	Votes     map[string]string `json:"votes"`
+}
+
+// Phase is a timed step of the run
+type Phase struct {
+	Name           string    `json:"name"`
+	StartedAt      time.Time `json:"started_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+	Completed      bool      `json:"completed"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// Failure is a batch of S3 keys that could not be deleted
+type Failure struct {
+	Keys  []string `json:"keys"`
+	Error string   `json:"error"`
+}
+
+// Report is the machine-readable outcome of a run. It's safe for concurrent use
+type Report struct {
+	mu sync.Mutex
+
+	Command          string            `json:"command"`
+	Version          string            `json:"version"`
+	Flags            map[string]string `json:"flags"`
+	Config           interface{}       `json:"config"`
+	StartedAt        time.Time         `json:"started_at"`
+	FinishedAt       time.Time         `json:"finished_at"`
+	ElapsedSeconds   float64           `json:"elapsed_seconds"`
+	Streams          Counts            `json:"streams"`
+	Bytes            map[string]Bytes  `json:"bytes,omitempty"`
+	StreamsProtected int64             `json:"streams_protected"`
+	// StreamsUnconfirmed are the invalid streams skipped because the sources didn't reach the consensus quorum about them
+	StreamsUnconfirmed int64          `json:"streams_unconfirmed"`
+	Disagreements      []Disagreement `json:"disagreements,omitempty"`
+	// BlobsRetained are the blobs of the selected streams kept because other streams that aren't deleted use them too
+	BlobsRetained int64     `json:"blobs_retained"`
+	BlobsSelected int64     `json:"blobs_selected"`
+	BlobsDeleted  int64     `json:"blobs_deleted"`
+	S3Failures    []Failure `json:"s3_failures"`
+	DBRowsRemoved int64     `json:"db_rows_removed"`
+	Phases        []*Phase  `json:"phases"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// New starts the report of a run of the given command
+func New(command string, flags map[string]string) *Report {
+	return &Report{
+		Command:    command,
+		Version:    meta.VersionString(),
+		Flags:      flags,
+		StartedAt:  time.Now().UTC(),
+		S3Failures: make([]Failure, 0),
+		Phases:     make([]*Phase, 0),
+	}
+}
+
+// SetConfig records the configuration used by the run. It must not contain any secret
+func (r *Report) SetConfig(config interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Config = config
+}
+
+// StartPhase starts timing a phase of the run. The returned function ends it with the outcome of the phase
+func (r *Report) StartPhase(name string) func(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p := &Phase{Name: name, StartedAt: time.Now().UTC()}
+	r.Phases = append(r.Phases, p)
+	return func(err error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		p.ElapsedSeconds = time.Since(p.StartedAt).Seconds()
+		p.Completed = err == nil
+		if err != nil {
+			p.Error = err.Error()
+		}
+	}
+}
+
+// SetCounts records the classification of the streams, keeping the false negatives already recorded
+func (r *Report) SetCounts(counts Counts) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts.FalseNegatives = r.Streams.FalseNegatives
+	r.Streams = counts
+}
+
+// SetBytes records the storage selected and reclaimed per category of streams
+func (r *Report) SetBytes(bytes map[string]Bytes) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Bytes = bytes
+}
+
+func (r *Report) AddFalseNegatives(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Streams.FalseNegatives += n
+}
+
+func (r *Report) AddStreamsProtected(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.StreamsProtected += n
+}
+
+func (r *Report) AddStreamsUnconfirmed(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.StreamsUnconfirmed += n
+}
+
+func (r *Report) AddBlobsRetained(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.BlobsRetained += n
+}
+
+// SetDisagreements records the streams the consensus sources disagree about
+func (r *Report) SetDisagreements(disagreements []Disagreement) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Disagreements = disagreements
+}
+
+func (r *Report) AddBlobsSelected(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.BlobsSelected += n
+}
+
+func (r *Report) AddBlobsDeleted(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.BlobsDeleted += n
+}
+
+func (r *Report) AddS3Failure(keys []string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.S3Failures = append(r.S3Failures, Failure{Keys: keys, Error: err.Error()})
+}
+
+func (r *Report) AddDBRowsRemoved(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.DBRowsRemoved += n
+}
+
+// Counters are the totals of the run, without the details of the report
+type Counters struct {
+	Streams            Counts `json:"streams"`
+	StreamsProtected   int64  `json:"streams_protected"`
+	StreamsUnconfirmed int64  `json:"streams_unconfirmed"`
+	BlobsRetained      int64  `json:"blobs_retained"`
+	BlobsSelected      int64  `json:"blobs_selected"`
+	BlobsDeleted       int64  `json:"blobs_deleted"`
+	S3FailedKeys       int    `json:"s3_failed_keys"`
+	DBRowsRemoved      int64  `json:"db_rows_removed"`
+}
+
+// Counters returns the totals of the run so far
+func (r *Report) Counters() Counters {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Counters{
+		Streams:            r.Streams,
+		StreamsProtected:   r.StreamsProtected,
+		StreamsUnconfirmed: r.StreamsUnconfirmed,
+		BlobsRetained:      r.BlobsRetained,
+		BlobsSelected:      r.BlobsSelected,
+		BlobsDeleted:       r.BlobsDeleted,
+		S3FailedKeys:       r.failedKeys(),
+		DBRowsRemoved:      r.DBRowsRemoved,
+	}
+}
+
+// Finish records the end of the run and its outcome
+func (r *Report) Finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.FinishedAt = time.Now().UTC()
+	r.ElapsedSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Write saves the report in dir as JSON and Markdown and returns the path of the JSON file
+func (r *Report) Write(dir string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	name := fmt.Sprintf("%s-%s", r.StartedAt.Format("20060102T150405Z"), strings.ReplaceAll(r.Command, " ", "-"))
+	jsonPath := filepath.Join(dir, name+".json")
+
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	err = os.WriteFile(jsonPath, content, 0644)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+".md"), []byte(r.markdown()), 0644)
+	if err != nil {
+		return "", errors.Err(err)
+	}
+	logrus.Infof("run report written to %s", jsonPath)
+	return jsonPath, nil
+}
+
+func (r *Report) markdown() string {
+	b := &strings.Builder{}
+	outcome := "succeeded"
+	if r.Error != "" {
+		outcome = "failed: " + r.Error
+	}
+	fmt.Fprintf(b, "# reflector-s3-cleaner %s\n\n", r.Command)
+	fmt.Fprintf(b, "- started: %s\n- finished: %s\n- elapsed: %s\n- outcome: %s\n\n", r.StartedAt.Format(time.RFC3339), r.FinishedAt.Format(time.RFC3339),
+		time.Duration(r.ElapsedSeconds*float64(time.Second)).Round(time.Second), outcome)
+
+	fmt.Fprintf(b, "## Streams\n\n| category | count |\n|---|---|\n")
+	fmt.Fprintf(b, "| total | %d |\n| valid | %d |\n| not on chain | %d |\n| expired | %d |\n| spent | %d |\n| false negatives | %d |\n\n",
+		r.Streams.Total, r.Streams.Valid, r.Streams.NotOnChain, r.Streams.Expired, r.Streams.Spent, r.Streams.FalseNegatives)
+
+	fmt.Fprintf(b, "## Deletions\n\n| | count |\n|---|---|\n")
+	fmt.Fprintf(b, "| protected streams skipped | %d |\n| unconfirmed streams skipped | %d |\n| shared blobs retained | %d |\n| blobs selected | %d |\n| blobs deleted | %d |\n| S3 keys failed | %d |\n| DB rows removed | %d |\n\n",
+		r.StreamsProtected, r.StreamsUnconfirmed, r.BlobsRetained, r.BlobsSelected, r.BlobsDeleted, r.failedKeys(), r.DBRowsRemoved)
+
+	if len(r.Bytes) > 0 {
+		fmt.Fprintf(b, "## Storage\n\n| category | selected bytes | reclaimed bytes | unmeasured blobs |\n|---|---|---|---|\n")
+		categories := make([]string, 0, len(r.Bytes))
+		for c := range r.Bytes {
+			categories = append(categories, c)
+		}
+		sort.Strings(categories)
+		for _, c := range categories {
+			fmt.Fprintf(b, "| %s | %d | %d | %d |\n", c, r.Bytes[c].Selected, r.Bytes[c].Reclaimed, r.Bytes[c].Unmeasured)
+		}
+		fmt.Fprintf(b, "\n")
+	}
+
+	fmt.Fprintf(b, "## Phases\n\n| phase | elapsed | completed | error |\n|---|---|---|---|\n")
+	for _, p := range r.Phases {
+		fmt.Fprintf(b, "| %s | %s | %t | %s |\n", p.Name, time.Duration(p.ElapsedSeconds*float64(time.Second)).Round(time.Millisecond), p.Completed, p.Error)
+	}
+
+	fmt.Fprintf(b, "\n## Flags\n\n| flag | value |\n|---|---|\n")
+	flags := make([]string, 0, len(r.Flags))
+	for f := range r.Flags {
+		flags = append(flags, f)
+	}
+	sort.Strings(flags)
+	for _, f := range flags {
+		fmt.Fprintf(b, "| --%s | %s |\n", f, r.Flags[f])
+	}
+
+	if len(r.Disagreements) > 0 {
+		fmt.Fprintf(b, "\n## Disagreements\n\n| sd_hash | claim_id | consensus | votes |\n|---|---|---|---|\n")
+		for _, d := range r.Disagreements {
+			claimID := ""
+			if d.ClaimID != nil {
+				claimID = *d.ClaimID
+			}
+			sources := make([]string, 0, len(d.Votes))
+			for source := range d.Votes {
+				sources = append(sources, source)
+			}
+			sort.Strings(sources)
+			votes := make([]string, 0, len(sources))
+			for _, source := range sources {
+				votes = append(votes, source+": "+d.Votes[source])
+			}
+			fmt.Fprintf(b, "| %s | %s | %s | %s |\n", d.SdHash, claimID, d.Consensus, strings.Join(votes, "; "))
+		}
+	}
+
+	if len(r.S3Failures) > 0 {
+		fmt.Fprintf(b, "\n## S3 failures\n\n")
+		for _, f := range r.S3Failures {
+			fmt.Fprintf(b, "- %s: %s\n", f.Error, strings.Join(f.Keys, ", "))
+		}
+	}
+	return b.String()
+}
+
+func (r *Report) failedKeys() int {
+	n := 0
+	for _, f := range r.S3Failures {
+		n += len(f.Keys)
+	}
+	return n
+}
@@ -0,0 +1,39 @@
+package safety
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Selection is what a destructive stage is about to delete, out of the streams that were scanned
+type Selection struct {
+	Streams        int64
+	InvalidStreams int64
+	Blobs          int64
+	Bytes          int64
+}
+
+// Check returns an error listing every threshold the selection exceeds, nil if it's within all of them
+func Check(limits configs.SafetyConfig, s Selection) error {
+	var exceeded []string
+	if limits.MaxInvalidPercent > 0 && s.Streams > 0 {
+		invalidPercent := float64(s.InvalidStreams) / float64(s.Streams) * 100
+		if invalidPercent > limits.MaxInvalidPercent {
+			exceeded = append(exceeded, fmt.Sprintf("%.2f%% of the streams are invalid (max_invalid_percent is %.2f%%)", invalidPercent, limits.MaxInvalidPercent))
+		}
+	}
+	if limits.MaxBlobsPerRun > 0 && s.Blobs > limits.MaxBlobsPerRun {
+		exceeded = append(exceeded, fmt.Sprintf("%d blobs are selected (max_blobs_per_run is %d)", s.Blobs, limits.MaxBlobsPerRun))
+	}
+	if limits.MaxBytesPerRun > 0 && s.Bytes > limits.MaxBytesPerRun {
+		exceeded = append(exceeded, fmt.Sprintf("%d bytes are selected (max_bytes_per_run is %d)", s.Bytes, limits.MaxBytesPerRun))
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+	return errors.Err("safety thresholds exceeded: %s", strings.Join(exceeded, ", "))
+}
@@ -0,0 +1,26 @@
+package safety
+
+import (
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/configs"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	limits := configs.SafetyConfig{MaxInvalidPercent: 50, MaxBlobsPerRun: 1000, MaxBytesPerRun: 1 << 30}
+
+	assert.NoError(t, Check(limits, Selection{Streams: 100, InvalidStreams: 50, Blobs: 1000, Bytes: 1 << 30}))
+	assert.NoError(t, Check(configs.SafetyConfig{}, Selection{Streams: 100, InvalidStreams: 100, Blobs: 1 << 40, Bytes: 1 << 50}))
+
+	err := Check(limits, Selection{Streams: 100, InvalidStreams: 99, Blobs: 10})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "99.00% of the streams are invalid")
+	}
+	err = Check(limits, Selection{Streams: 100, InvalidStreams: 1, Blobs: 1001, Bytes: 1<<30 + 1})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "max_blobs_per_run")
+		assert.Contains(t, err.Error(), "max_bytes_per_run")
+	}
+}
@@ -2,6 +2,7 @@ package shared
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -18,7 +19,28 @@ func CloseRows(rows *sql.Rows) {
 type BlobInfo struct {
 	BlobID  int64
 	Deleted bool
+	// SizeBytes is the size of the object in S3, nil until it's measured
+	SizeBytes *int64
+	// ReferencedBy are the IDs of all the streams using the blob in the reflector database, only set when the blobs are resolved
+	ReferencedBy []int64
+	// Retained blobs are also used by streams that aren't deleted along with this one, so they must be kept
+	Retained bool
 }
+
+// Size returns the measured size of the blob or EstimatedBlobSize if it wasn't measured
+func (b BlobInfo) Size() int64 {
+	if b.SizeBytes == nil {
+		return EstimatedBlobSize
+	}
+	return *b.SizeBytes
+}
+
+// RemovedRow is a row removed from the reflector database, identified by its table and the column and value it was removed by
+type RemovedRow struct {
+	Table string
+	Row   string
+}
+
 type StreamData struct {
 	SdHash      string              `json:"sd_hash"`
 	StreamID    int64               `json:"stream_id"`
@@ -28,6 +50,20 @@ type StreamData struct {
 	Resolved    bool                `json:"resolved"`
 	StreamBlobs map[string]BlobInfo `json:"stream_blobs"`
 	ClaimID     *string             `json:"claim_id"`
+	// InvalidSince is when the claim of the stream was spent or expired according to chainquery, nil if it's unknown or not applicable
+	InvalidSince *time.Time `json:"invalid_since"`
+	// PublisherID is the claim ID of the channel the claim of the stream was published in, if any
+	PublisherID *string `json:"publisher_id"`
+	// BidState is the bid_state chainquery returned for the claim of the stream, nil if it has no claim
+	BidState *string `json:"bid_state"`
+	// Protected streams must never be deleted, regardless of their chain state
+	Protected bool `json:"protected"`
+	// Unconfirmed streams didn't reach the consensus quorum and must not be deleted until they do
+	Unconfirmed bool `json:"unconfirmed"`
+	// SdBlobDeleted is set once the sd blob was deleted from S3, which only happens after all the other blobs of the stream were
+	SdBlobDeleted bool `json:"sd_blob_deleted"`
+	// KeepSdBlob is set when the sd blob must not be deleted in this run because the plan being executed doesn't include it
+	KeepSdBlob bool `json:"-"`
 }
 
 func (stream *StreamData) IsValid() bool {
@@ -36,3 +72,31 @@ func (stream *StreamData) IsValid() bool {
 	}
 	return true
 }
+
+const (
+	ReasonNotOnChain = "not_on_chain"
+	ReasonExpired    = "expired"
+	ReasonSpent      = "spent"
+)
+
+// InvalidReason returns why the stream is considered invalid or an empty string if it's valid
+func (stream *StreamData) InvalidReason() string {
+	switch {
+	case !stream.Exists:
+		return ReasonNotOnChain
+	case stream.Expired:
+		return ReasonExpired
+	case stream.Spent:
+		return ReasonSpent
+	}
+	return ""
+}
+
+// IsPurgeable returns true if the stream and its blobs should be deleted. Streams of expired claims, protected streams and
+// streams the sources didn't agree about are not purged
+func (stream *StreamData) IsPurgeable() bool {
+	return (stream.Spent || !stream.Exists) && !stream.Protected && !stream.Unconfirmed
+}
+
+// EstimatedBlobSize is the size assumed for a blob when estimating how much space can be reclaimed
+const EstimatedBlobSize = 2 * 1024 * 1024
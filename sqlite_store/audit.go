@@ -0,0 +1,175 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+const (
+	AuditSystemS3        = "s3"
+	AuditSystemReflector = "reflector"
+
+	AuditActionDeleted           = "deleted"
+	AuditActionQuarantineExpired = "quarantine_expired"
+)
+
+// AuditEntry is a deletion recorded in the audit log, along with what the cleaner knew about the stream it was made for
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+	RunID     *int64    `json:"run_id"`
+	// System is s3 or reflector, Location the bucket or the table the object or row was deleted from
+	System   string `json:"system"`
+	Location string `json:"location"`
+	Object   string `json:"object"`
+	Action   string `json:"action"`
+	// the stream is unknown if the object isn't used by any stored stream
+	StreamID    *int64  `json:"stream_id"`
+	SdHash      *string `json:"sd_hash"`
+	ClaimID     *string `json:"claim_id"`
+	PublisherID *string `json:"publisher_id"`
+	Reason      *string `json:"reason"`
+	BidState    *string `json:"bid_state"`
+	// Source tells which sources the classification of the stream was based on
+	Source *string `json:"source"`
+}
+
+// AuditFilter selects the entries of the audit log to export. Zero values don't filter
+type AuditFilter struct {
+	From    time.Time
+	To      time.Time
+	ClaimID string
+	Channel string
+}
+
+func createDeletionAudit(tx *sql.Tx) error {
+	err := addColumnIfMissing(tx, "streams", "bid_state", "varchar(16) DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS deletion_audit (
+    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+    deleted_at datetime NOT NULL,
+    run_id integer DEFAULT NULL,
+    system varchar(16) NOT NULL,
+    location varchar(255) NOT NULL,
+    object varchar(255) NOT NULL,
+    action varchar(32) NOT NULL,
+    stream_id bigint(20) DEFAULT NULL,
+    sd_hash char(96) DEFAULT NULL,
+    claim_id char(40) DEFAULT NULL,
+    publisher_id char(40) DEFAULT NULL,
+    reason varchar(16) DEFAULT NULL,
+    bid_state varchar(16) DEFAULT NULL,
+    source text DEFAULT NULL
+    )`,
+		`CREATE INDEX IF NOT EXISTS deletion_audit_deleted_at_index on deletion_audit (deleted_at)`,
+		`CREATE INDEX IF NOT EXISTS deletion_audit_claim_id_index on deletion_audit (claim_id)`,
+		`CREATE INDEX IF NOT EXISTS deletion_audit_publisher_id_index on deletion_audit (publisher_id)`,
+		// the log is append-only, even for the cleaner itself
+		`CREATE TRIGGER IF NOT EXISTS deletion_audit_no_update BEFORE UPDATE ON deletion_audit BEGIN SELECT RAISE(ABORT, 'the deletion audit log is append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS deletion_audit_no_delete BEFORE DELETE ON deletion_audit BEGIN SELECT RAISE(ABORT, 'the deletion audit log is append-only'); END`,
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	return nil
+}
+
+// auditQuery appends an entry per stored stream matched by the condition, or a single entry without a stream if there are none.
+// The condition is on the streams table aliased as s, its arguments follow the ones of the entry so the first one is ?7
+func auditQuery(condition string) string {
+	return `INSERT INTO deletion_audit (deleted_at, run_id, system, location, object, action, stream_id, sd_hash, claim_id, publisher_id, reason, bid_state, source)
+SELECT ?, ?, ?, ?, ?, ?, s.stream_id, s.sd_hash, s.claim_id, s.publisher_id,
+    CASE WHEN s.stream_id IS NULL THEN NULL WHEN s.exists_in_blockchain = 0 THEN '` + shared.ReasonNotOnChain + `' WHEN s.expired = 1 THEN '` + shared.ReasonExpired + `'
+        WHEN s.spent = 1 THEN '` + shared.ReasonSpent + `' ELSE 'valid' END,
+    s.bid_state,
+    CASE WHEN s.stream_id IS NULL THEN NULL
+        WHEN s.consensus IS NOT NULL THEN 'consensus ' || s.consensus || ': ' || COALESCE((SELECT group_concat(v.source || '=' || v.vote, ', ') FROM source_votes v WHERE v.stream_id = s.stream_id), '')
+        WHEN s.double_check_result IS NOT NULL THEN 'chainquery, double-checked against the hub'
+        ELSE 'chainquery' END
+FROM (SELECT 1) LEFT JOIN streams s ON ` + condition
+}
+
+// blobAuditCondition matches the streams using the blob, the hash of the blob is its argument
+const blobAuditCondition = "s.stream_id IN (SELECT stream_id FROM stream_blobs WHERE blob_hash = ?7) OR s.sd_hash = ?7"
+
+func (s *Store) auditArgs(system, location, object, action string, conditionArgs ...interface{}) []interface{} {
+	return append([]interface{}{time.Now().UTC(), s.run(), system, location, object, action}, conditionArgs...)
+}
+
+func (s *Store) auditDeletion(tx *sql.Tx, system, location, object, action, condition string, args ...interface{}) error {
+	_, err := tx.Exec(auditQuery(condition), s.auditArgs(system, location, object, action, args...)...)
+	return errors.Err(err)
+}
+
+// auditBlobDeletion records the deletion of the object of a blob from an S3 bucket, for every stored stream using the blob
+func (s *Store) auditBlobDeletion(tx *sql.Tx, bucket, key, action, blobHash string) error {
+	return s.auditDeletion(tx, AuditSystemS3, bucket, key, action, blobAuditCondition, blobHash)
+}
+
+// RecordRowDeletions records in the audit log the rows removed from the reflector database for the stream
+func (s *Store) RecordRowDeletions(ctx context.Context, streamID int64, rows []shared.RemovedRow) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	for _, row := range rows {
+		err = s.auditDeletion(tx, AuditSystemReflector, row.Table, row.Row, AuditActionDeleted, "s.stream_id = ?7", streamID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return errors.Err(tx.Commit())
+}
+
+// ExportAudit calls fn with every entry of the audit log selected by the filter, oldest first
+func (s *Store) ExportAudit(ctx context.Context, filter AuditFilter, fn func(AuditEntry) error) error {
+	query := `SELECT id, deleted_at, run_id, system, location, object, action, stream_id, sd_hash, claim_id, publisher_id, reason, bid_state, source
+FROM deletion_audit WHERE 1 = 1`
+	var args []interface{}
+	if !filter.From.IsZero() {
+		query += " AND deleted_at >= ?"
+		args = append(args, filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		query += " AND deleted_at < ?"
+		args = append(args, filter.To.UTC())
+	}
+	if filter.ClaimID != "" {
+		query += " AND claim_id = ?"
+		args = append(args, filter.ClaimID)
+	}
+	if filter.Channel != "" {
+		query += " AND publisher_id = ?"
+		args = append(args, filter.Channel)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return errors.Err(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e AuditEntry
+		err = rows.Scan(&e.ID, &e.DeletedAt, &e.RunID, &e.System, &e.Location, &e.Object, &e.Action, &e.StreamID, &e.SdHash, &e.ClaimID, &e.PublisherID,
+			&e.Reason, &e.BidState, &e.Source)
+		if err != nil {
+			return errors.Err(err)
+		}
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Err(rows.Err())
+}
@@ -0,0 +1,73 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeletionAudit(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+	assert.NoError(t, store.StartRun(&Run{Command: "wipe", Flags: map[string]string{}}))
+
+	claimID, channel, bidState := "claim1", "channel1", "Spent"
+	streams := []shared.StreamData{
+		{SdHash: "sd1", StreamID: 1, Resolved: true, Exists: true, Spent: true, ClaimID: &claimID, PublisherID: &channel, BidState: &bidState,
+			StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}}},
+		{SdHash: "sd2", StreamID: 2, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"b": {BlobID: 2}}},
+	}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.UpdateStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.TrackSdBlobs(ctx, streams))
+
+	before := time.Now().UTC().Add(-time.Second)
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "a"))
+	assert.NoError(t, store.FlagQuarantinedBlob(ctx, "bucket", "sd1", QuarantineLocation{Bucket: "quarantine", Key: "q/sd1"}))
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "b"))
+	assert.NoError(t, store.ExpireQuarantinedBlob(ctx, QuarantineLocation{Bucket: "quarantine", Key: "q/sd1"}))
+	assert.NoError(t, store.RecordRowDeletions(ctx, 1, []shared.RemovedRow{{Table: "blob_", Row: "id=1"}, {Table: "stream", Row: "id=1"}}))
+
+	export := func(filter AuditFilter) []AuditEntry {
+		entries := make([]AuditEntry, 0)
+		assert.NoError(t, store.ExportAudit(ctx, filter, func(e AuditEntry) error {
+			entries = append(entries, e)
+			return nil
+		}))
+		return entries
+	}
+	entries := export(AuditFilter{ClaimID: claimID})
+	if assert.Len(t, entries, 5) {
+		objects := make([]string, 0, len(entries))
+		for _, e := range entries {
+			objects = append(objects, e.System+":"+e.Location+":"+e.Object+":"+e.Action)
+			assert.Equal(t, int64(1), *e.StreamID)
+			assert.Equal(t, shared.ReasonSpent, *e.Reason)
+			assert.Equal(t, bidState, *e.BidState)
+			assert.Equal(t, "chainquery", *e.Source)
+			assert.NotNil(t, e.RunID)
+		}
+		assert.Equal(t, []string{"s3:bucket:a:deleted", "s3:bucket:sd1:deleted", "s3:quarantine:q/sd1:quarantine_expired", "reflector:blob_:id=1:deleted",
+			"reflector:stream:id=1:deleted"}, objects)
+	}
+	assert.Len(t, export(AuditFilter{Channel: channel}), 5)
+	assert.Len(t, export(AuditFilter{From: before}), 6)
+	assert.Empty(t, export(AuditFilter{To: before}))
+	notOnChain := export(AuditFilter{})[2]
+	assert.Equal(t, "b", notOnChain.Object)
+	assert.Equal(t, shared.ReasonNotOnChain, *notOnChain.Reason)
+	assert.Nil(t, notOnChain.ClaimID)
+
+	// the log can't be rewritten
+	_, err = store.db.Exec("UPDATE deletion_audit SET object = 'c'")
+	assert.Error(t, err)
+	_, err = store.db.Exec("DELETE FROM deletion_audit")
+	assert.Error(t, err)
+}
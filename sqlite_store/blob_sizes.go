@@ -0,0 +1,76 @@
+package sqlite_store
+
+import (
+	"context"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// BlobSize is the size of a blob as measured in S3
+type BlobSize struct {
+	BlobHash  string
+	SizeBytes int64
+}
+
+// StoreBlobSizes records the measured sizes of the blobs
+func (s *Store) StoreBlobSizes(ctx context.Context, sizes []BlobSize) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	stmt, err := tx.Prepare("UPDATE blobs SET size_bytes = ? WHERE blob_hash = ?")
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	defer stmt.Close()
+	for _, size := range sizes {
+		_, err = stmt.Exec(size.SizeBytes, size.BlobHash)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+	}
+	return errors.Err(tx.Commit())
+}
+
+// BlobBytes is the storage taken by the blobs of a category of streams
+type BlobBytes struct {
+	// Selected is the size of the blobs still to be deleted
+	Selected int64 `json:"selected"`
+	// Reclaimed is the size of the blobs deleted so far
+	Reclaimed int64 `json:"reclaimed"`
+	// Unmeasured is the amount of blobs still to be deleted whose size is unknown, they aren't part of Selected
+	Unmeasured int64 `json:"unmeasured_blobs"`
+}
+
+// LoadBlobBytes sums the measured sizes of the blobs in the store by the reason their stream is invalid. A blob used by several streams
+// in the store is counted once, as valid if any of them is
+func (s *Store) LoadBlobBytes(ctx context.Context) (map[string]BlobBytes, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT
+    CASE WHEN s.exists_in_blockchain = 0 THEN ? WHEN s.expired = 1 THEN ? WHEN s.spent = 1 THEN ? ELSE 'valid' END AS reason,
+    COALESCE(SUM(CASE WHEN b.deleted = 0 THEN b.size_bytes END), 0),
+    COALESCE(SUM(CASE WHEN b.deleted = 1 THEN b.size_bytes END), 0),
+    SUM(CASE WHEN b.deleted = 0 AND b.size_bytes IS NULL THEN 1 ELSE 0 END)
+FROM blobs b INNER JOIN streams s ON s.stream_id = (
+    SELECT ls.stream_id FROM stream_blobs sb INNER JOIN streams ls ON ls.stream_id = sb.stream_id WHERE sb.blob_hash = b.blob_hash
+    ORDER BY ls.exists_in_blockchain = 1 AND ls.expired = 0 AND ls.spent = 0 DESC, ls.stream_id LIMIT 1)
+GROUP BY reason`, shared.ReasonNotOnChain, shared.ReasonExpired, shared.ReasonSpent)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	bytes := make(map[string]BlobBytes)
+	for rows.Next() {
+		var reason string
+		var b BlobBytes
+		err = rows.Scan(&reason, &b.Selected, &b.Reclaimed, &b.Unmeasured)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		bytes[reason] = b
+	}
+	return bytes, errors.Err(rows.Err())
+}
@@ -0,0 +1,43 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadBlobBytes(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	streams := []shared.StreamData{
+		{SdHash: "sd1", StreamID: 1, Exists: false, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2}, "c": {BlobID: 3}}},
+		{SdHash: "sd2", StreamID: 2, Exists: true, Spent: true, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"d": {BlobID: 4}}},
+	}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.StoreBlobSizes(ctx, []BlobSize{{"a", 2097152}, {"b", 1000}, {"d", 500}}))
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "b"))
+
+	bytes, err := store.LoadBlobBytes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, BlobBytes{Selected: 2097152, Reclaimed: 1000, Unmeasured: 1}, bytes[shared.ReasonNotOnChain])
+	assert.Equal(t, BlobBytes{Selected: 500}, bytes[shared.ReasonSpent])
+
+	loaded, err := store.LoadStreamData(ctx)
+	assert.NoError(t, err)
+	_, err = store.LoadBlobs(ctx, loaded)
+	assert.NoError(t, err)
+	for _, sd := range loaded {
+		if sd.StreamID == 1 {
+			assert.Equal(t, int64(2097152), sd.StreamBlobs["a"].Size())
+			assert.Nil(t, sd.StreamBlobs["c"].SizeBytes)
+			assert.Equal(t, int64(shared.EstimatedBlobSize), sd.StreamBlobs["c"].Size())
+		}
+	}
+}
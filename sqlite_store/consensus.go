@@ -0,0 +1,124 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/consensus"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func createSourceVotes(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS source_votes (
+    stream_id bigint(20) NOT NULL,
+    source varchar(255) NOT NULL,
+    vote varchar(8) NOT NULL,
+    error text DEFAULT NULL,
+    voted_at datetime NOT NULL,
+    PRIMARY KEY (stream_id, source),
+    FOREIGN KEY (stream_id) REFERENCES streams(stream_id)
+    )`)
+	return errors.Err(err)
+}
+
+// Verification is the outcome of the vote of the sources about a stream
+type Verification struct {
+	StreamID int64
+	Outcome  consensus.Outcome
+}
+
+// RecordVerifications persists the consensus reached about the streams along with the ballot of every source, replacing the previous ones
+func (s *Store) RecordVerifications(ctx context.Context, verifications []Verification) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	now := time.Now().UTC()
+	for _, v := range verifications {
+		_, err = tx.ExecContext(ctx, "UPDATE streams SET consensus = ?, disputed = ?, verified_at = ?, run_id = ? WHERE stream_id = ?", v.Outcome.Consensus, v.Outcome.Disputed, now, s.run(), v.StreamID)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM source_votes WHERE stream_id = ?", v.StreamID)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+		for _, b := range v.Outcome.Ballots {
+			var ballotErr *string
+			if b.Err != nil {
+				e := b.Err.Error()
+				ballotErr = &e
+			}
+			_, err = tx.ExecContext(ctx, "INSERT INTO source_votes (stream_id, source, vote, error, voted_at) VALUES (?, ?, ?, ?, ?)", v.StreamID, b.Source, string(b.Vote), ballotErr, now)
+			if err != nil {
+				_ = tx.Rollback()
+				return errors.Err(err)
+			}
+		}
+	}
+	return errors.Err(tx.Commit())
+}
+
+// LoadConsensus returns the consensus reached about the streams that were verified since they were last resolved.
+// Disputed streams are unconfirmed, including the ones verified before disputes held streams back
+func (s *Store) LoadConsensus(ctx context.Context) (map[int64]string, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT stream_id, CASE WHEN disputed = 1 THEN ? ELSE consensus END FROM streams WHERE consensus IS NOT NULL", consensus.Unconfirmed)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	verdicts := make(map[int64]string)
+	for rows.Next() {
+		var streamID int64
+		var verdict string
+		err = rows.Scan(&streamID, &verdict)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		verdicts[streamID] = verdict
+	}
+	return verdicts, errors.Err(rows.Err())
+}
+
+// Disagreement is a stream the sources disagree about, to be reviewed by hand
+type Disagreement struct {
+	StreamID  int64
+	SdHash    string
+	ClaimID   *string
+	Consensus string
+	// Votes is the vote of every source, followed by the error that made it abstain if any
+	Votes map[string]string
+}
+
+// LoadDisagreements returns the disputed streams along with the vote of every source
+func (s *Store) LoadDisagreements(ctx context.Context) ([]Disagreement, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT s.stream_id, s.sd_hash, s.claim_id, s.consensus, v.source, v.vote, v.error FROM streams s
+INNER JOIN source_votes v ON v.stream_id = s.stream_id WHERE s.disputed = 1 ORDER BY s.stream_id, v.source`)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	disagreements := make([]Disagreement, 0)
+	for rows.Next() {
+		var d Disagreement
+		var source, vote string
+		var voteErr sql.NullString
+		err = rows.Scan(&d.StreamID, &d.SdHash, &d.ClaimID, &d.Consensus, &source, &vote, &voteErr)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if n := len(disagreements); n == 0 || disagreements[n-1].StreamID != d.StreamID {
+			d.Votes = make(map[string]string)
+			disagreements = append(disagreements, d)
+		}
+		if voteErr.Valid {
+			vote += ": " + voteErr.String
+		}
+		disagreements[len(disagreements)-1].Votes[source] = vote
+	}
+	return disagreements, errors.Err(rows.Err())
+}
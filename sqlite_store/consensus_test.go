@@ -0,0 +1,61 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/consensus"
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifications(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	claimID := "claim2"
+	streams := []shared.StreamData{
+		{SdHash: "sd1", StreamID: 1, Resolved: true, Exists: true, Spent: true},
+		{SdHash: "sd2", StreamID: 2, Resolved: true, Exists: true, Spent: true, ClaimID: &claimID},
+	}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.RecordVerifications(ctx, []Verification{
+		{StreamID: 1, Outcome: consensus.Outcome{Consensus: consensus.Confirmed, Ballots: []consensus.Ballot{
+			{Source: "chainquery", Vote: consensus.VoteInvalid},
+			{Source: "hub", Vote: consensus.VoteInvalid},
+		}}},
+		{StreamID: 2, Outcome: consensus.Outcome{Consensus: consensus.Unconfirmed, Disputed: true, Ballots: []consensus.Ballot{
+			{Source: "chainquery", Vote: consensus.VoteInvalid},
+			{Source: "hub", Vote: consensus.VoteValid},
+			{Source: "lbcd", Vote: consensus.VoteAbstain, Err: errors.Err("timeout")},
+		}}},
+	}))
+
+	verdicts, err := store.LoadConsensus(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64]string{1: consensus.Confirmed, 2: consensus.Unconfirmed}, verdicts)
+
+	disagreements, err := store.LoadDisagreements(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []Disagreement{{
+		StreamID:  2,
+		SdHash:    "sd2",
+		ClaimID:   &claimID,
+		Consensus: consensus.Unconfirmed,
+		Votes:     map[string]string{"chainquery": "invalid", "hub": "valid", "lbcd": "abstain: timeout"},
+	}}, disagreements)
+
+	// resolving the streams again only invalidates the verifications of the streams whose chain state changed
+	streams[1].Expired = true
+	assert.NoError(t, store.UpdateStreams(ctx, streams))
+	verdicts, err = store.LoadConsensus(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64]string{1: consensus.Confirmed}, verdicts)
+	disagreements, err = store.LoadDisagreements(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, disagreements)
+}
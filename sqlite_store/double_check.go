@@ -0,0 +1,63 @@
+package sqlite_store
+
+import (
+	"context"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+const (
+	// DoubleCheckConfirmed means the hub agrees that the stream is invalid
+	DoubleCheckConfirmed = "confirmed"
+	// DoubleCheckFalseNegative means the hub found the claim of a stream chainquery reported as invalid, so it was unflagged
+	DoubleCheckFalseNegative = "false_negative"
+)
+
+// DoubleCheck is the outcome of checking a stream against the hub
+type DoubleCheck struct {
+	StreamID int64
+	Result   string
+}
+
+// RecordDoubleChecks persists the outcome of the double-checks along with the time they were recorded at
+func (s *Store) RecordDoubleChecks(ctx context.Context, checks []DoubleCheck) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	stmt, err := tx.Prepare("UPDATE streams SET double_checked_at = ?, double_check_result = ?, run_id = ? WHERE stream_id = ?")
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, c := range checks {
+		_, err = stmt.Exec(now, c.Result, s.run(), c.StreamID)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+	}
+	return errors.Err(tx.Commit())
+}
+
+// LoadDoubleChecked returns the IDs of the streams that were already double-checked since they were last resolved
+func (s *Store) LoadDoubleChecked(ctx context.Context) (map[int64]bool, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT stream_id FROM streams WHERE double_check_result IS NOT NULL")
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	checked := make(map[int64]bool)
+	for rows.Next() {
+		var streamID int64
+		err = rows.Scan(&streamID)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		checked[streamID] = true
+	}
+	return checked, errors.Err(rows.Err())
+}
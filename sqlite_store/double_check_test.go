@@ -0,0 +1,33 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoubleChecks(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	streams := []shared.StreamData{
+		{SdHash: "sd1", StreamID: 1, Resolved: true, Exists: true, Spent: true},
+		{SdHash: "sd2", StreamID: 2, Resolved: true},
+	}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.RecordDoubleChecks(ctx, []DoubleCheck{{StreamID: 1, Result: DoubleCheckConfirmed}}))
+	checked, err := store.LoadDoubleChecked(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64]bool{1: true}, checked)
+
+	// resolving the streams again invalidates the previous checks
+	assert.NoError(t, store.UpdateStreams(ctx, streams))
+	checked, err = store.LoadDoubleChecked(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, checked)
+}
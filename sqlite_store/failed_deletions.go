@@ -0,0 +1,104 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// FailedDeletion is a blob that S3 failed to delete and that is queued to be retried
+type FailedDeletion struct {
+	BlobHash    string
+	StreamID    int64
+	Error       string
+	Attempts    int
+	LastAttempt time.Time
+}
+
+func createFailedDeletions(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS failed_deletions (
+    blob_hash char(96) NOT NULL PRIMARY KEY,
+    stream_id bigint(20) DEFAULT NULL,
+    error text NOT NULL,
+    attempts integer NOT NULL,
+    last_attempt datetime NOT NULL
+    )`)
+	return errors.Err(err)
+}
+
+// RecordFailedDeletions queues the blobs to be retried or, if they're already queued, bumps their attempts
+func (s *Store) RecordFailedDeletions(ctx context.Context, blobHashes []string, deletionErr error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO failed_deletions (blob_hash, stream_id, error, attempts, last_attempt)
+VALUES (?, COALESCE(
+    (SELECT MIN(sb.stream_id) FROM stream_blobs sb INNER JOIN streams s ON s.stream_id = sb.stream_id WHERE sb.blob_hash = ?),
+    (SELECT stream_id FROM streams WHERE sd_hash = ?)), ?, 1, ?)
+ON CONFLICT(blob_hash) DO UPDATE SET error = excluded.error, attempts = attempts + 1, last_attempt = excluded.last_attempt`)
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	defer stmt.Close()
+	now := time.Now().UTC()
+	for _, hash := range blobHashes {
+		_, err = stmt.Exec(hash, hash, hash, deletionErr.Error(), now)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+	}
+	return errors.Err(tx.Commit())
+}
+
+// LoadFailedDeletions returns the queued blobs, oldest attempt first. If maxAttempts is greater than 0 the blobs that already failed as many times are skipped
+func (s *Store) LoadFailedDeletions(ctx context.Context, maxAttempts int) ([]FailedDeletion, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT blob_hash, COALESCE(stream_id, 0), error, attempts, last_attempt FROM failed_deletions WHERE ? <= 0 OR attempts < ? ORDER BY last_attempt", maxAttempts, maxAttempts)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	failures := make([]FailedDeletion, 0)
+	for rows.Next() {
+		var f FailedDeletion
+		err = rows.Scan(&f.BlobHash, &f.StreamID, &f.Error, &f.Attempts, &f.LastAttempt)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		failures = append(failures, f)
+	}
+	return failures, errors.Err(rows.Err())
+}
+
+// CountFailedDeletions returns how many blobs are queued to be retried
+func (s *Store) CountFailedDeletions(ctx context.Context) (int64, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM failed_deletions").Scan(&count)
+	return count, errors.Err(err)
+}
+
+// DropFailedDeletions takes the blobs out of the queue without deleting them
+func (s *Store) DropFailedDeletions(ctx context.Context, blobHashes []string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	stmt, err := tx.Prepare("DELETE FROM failed_deletions WHERE blob_hash = ?")
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	defer stmt.Close()
+	for _, hash := range blobHashes {
+		_, err = stmt.Exec(hash)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+	}
+	return errors.Err(tx.Commit())
+}
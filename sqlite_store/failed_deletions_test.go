@@ -0,0 +1,43 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailedDeletions(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	err = store.RecordFailedDeletions(ctx, []string{"a", "b"}, errors.Err("SlowDown"))
+	assert.NoError(t, err)
+	err = store.RecordFailedDeletions(ctx, []string{"a"}, errors.Err("InternalError"))
+	assert.NoError(t, err)
+
+	failed, err := store.LoadFailedDeletions(ctx, 0)
+	assert.NoError(t, err)
+	assert.Len(t, failed, 2)
+	failed, err = store.LoadFailedDeletions(ctx, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 1) {
+		assert.Equal(t, "b", failed[0].BlobHash)
+		assert.Equal(t, 1, failed[0].Attempts)
+	}
+
+	// flagging a blob as deleted takes it out of the queue
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "a"))
+	count, err := store.CountFailedDeletions(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	// dropping a blob takes it out of the queue too
+	assert.NoError(t, store.DropFailedDeletions(ctx, []string{"b"}))
+	count, err = store.CountFailedDeletions(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+}
@@ -0,0 +1,101 @@
+package sqlite_store
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FlagWriter records the confirmed deletions of blobs in batched transactions, committed when a batch is full or when the interval elapses
+type FlagWriter struct {
+	store     *Store
+	flags     chan BlobFlag
+	batchSize int
+	interval  time.Duration
+	flagged   int64
+	failed    int64
+	wg        sync.WaitGroup
+}
+
+// NewFlagWriter starts a writer of the store committing up to batchSize flags at a time, and at least every interval
+func (s *Store) NewFlagWriter(batchSize int, interval time.Duration) *FlagWriter {
+	w := &FlagWriter{
+		store:     s,
+		flags:     make(chan BlobFlag, batchSize),
+		batchSize: batchSize,
+		interval:  interval,
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// Flag queues the flag of the blob, it blocks while the queue is full. It can't be called after Close
+func (w *FlagWriter) Flag(flag BlobFlag) {
+	w.flags <- flag
+}
+
+// Flagged returns how many blobs were flagged so far
+func (w *FlagWriter) Flagged() int64 {
+	return atomic.LoadInt64(&w.flagged)
+}
+
+// Failed returns how many blobs couldn't be flagged so far
+func (w *FlagWriter) Failed() int64 {
+	return atomic.LoadInt64(&w.failed)
+}
+
+// Close commits the queued flags and stops the writer
+func (w *FlagWriter) Close() {
+	close(w.flags)
+	w.wg.Wait()
+}
+
+func (w *FlagWriter) run() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	batch := make([]BlobFlag, 0, w.batchSize)
+	for {
+		select {
+		case flag, ok := <-w.flags:
+			if !ok {
+				w.commit(batch)
+				return
+			}
+			batch = append(batch, flag)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		w.commit(batch)
+		batch = batch[:0]
+	}
+}
+
+// commit flags the batch in a single transaction. If it fails the blobs are flagged one by one so a bad flag doesn't lose the others
+func (w *FlagWriter) commit(batch []BlobFlag) {
+	if len(batch) == 0 {
+		return
+	}
+	// confirmed deletions are always recorded, even after the context of the run is cancelled
+	err := w.store.FlagBlobs(context.Background(), batch)
+	if err == nil {
+		atomic.AddInt64(&w.flagged, int64(len(batch)))
+		return
+	}
+	logrus.Errorf("Failed to flag a batch of %d blobs, flagging them one by one: %s", len(batch), err.Error())
+	for _, flag := range batch {
+		err = w.store.FlagBlobs(context.Background(), []BlobFlag{flag})
+		if err != nil {
+			logrus.Errorf("Failed to flag blob %s: %s", flag.BlobHash, err.Error())
+			atomic.AddInt64(&w.failed, 1)
+			continue
+		}
+		atomic.AddInt64(&w.flagged, 1)
+	}
+}
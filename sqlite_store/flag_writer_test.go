@@ -0,0 +1,69 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlagWriter(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	streams := []shared.StreamData{{SdHash: "sd1", StreamID: 1, Resolved: true,
+		StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2}, "c": {BlobID: 3}, "d": {BlobID: 4}}}}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.RecordFailedDeletions(ctx, []string{"c"}, assert.AnError))
+
+	deleted := func() map[string]bool {
+		loaded := []shared.StreamData{{SdHash: "sd1", StreamID: 1}}
+		_, err := store.LoadBlobs(ctx, loaded)
+		assert.NoError(t, err)
+		flagged := make(map[string]bool)
+		for hash, blob := range loaded[0].StreamBlobs {
+			flagged[hash] = blob.Deleted
+		}
+		return flagged
+	}
+
+	// a full batch is committed right away
+	w := store.NewFlagWriter(2, time.Hour)
+	w.Flag(BlobFlag{Bucket: "bucket", BlobHash: "a"})
+	w.Flag(BlobFlag{Bucket: "bucket", BlobHash: "b", Location: &QuarantineLocation{Bucket: "quarantine", Key: "q/b"}})
+	assert.Eventually(t, func() bool { return w.Flagged() == 2 }, time.Second, 10*time.Millisecond)
+	// what's left is committed on close
+	w.Flag(BlobFlag{Bucket: "bucket", BlobHash: "c"})
+	w.Close()
+	assert.Equal(t, int64(3), w.Flagged())
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true, "d": false}, deleted())
+
+	// a partial batch is committed when the interval elapses
+	w = store.NewFlagWriter(100, 10*time.Millisecond)
+	w.Flag(BlobFlag{Bucket: "bucket", BlobHash: "d"})
+	assert.Eventually(t, func() bool { return w.Flagged() == 1 }, time.Second, 10*time.Millisecond)
+	w.Close()
+	assert.Zero(t, w.Failed())
+	assert.Equal(t, map[string]bool{"a": true, "b": true, "c": true, "d": true}, deleted())
+
+	failed, err := store.LoadFailedDeletions(ctx, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, failed)
+	quarantined, err := store.LoadQuarantinedBlobs(ctx, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Len(t, quarantined, 1)
+
+	audited := 0
+	assert.NoError(t, store.ExportAudit(ctx, AuditFilter{}, func(e AuditEntry) error {
+		audited++
+		assert.Equal(t, int64(1), *e.StreamID)
+		return nil
+	}))
+	assert.Equal(t, 4, audited)
+}
@@ -0,0 +1,211 @@
+package sqlite_store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Migration is a change to the schema of the store. Its version is its position in the list of migrations, starting at 1
+type Migration struct {
+	Version     int
+	Description string
+}
+
+type migration struct {
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// migrations are applied in order, each in its own transaction. Only ever append to the list: stores record the version they reached.
+// Stores created before the schema was versioned are at version 0 with any number of these already applied, so migrations must be
+// safe to apply on top of their own changes
+var migrations = []migration{
+	{"create the streams and blobs tables", createBaseTables},
+	{"create the pipeline_stages table", createPipelineStages},
+	{"create the plans tables", createPlans},
+	{"create the wipe_runs table", createWipeRuns},
+	{"create the failed_deletions table", createFailedDeletions},
+	{"add the size of the blobs", addColumns("blobs", column{"size_bytes", "bigint(20) DEFAULT NULL"})},
+	{"add the time the streams became invalid", addColumns("streams", column{"invalid_since", "datetime DEFAULT NULL"})},
+	{"add the publisher of the streams and the protections table", addPublishers},
+	{"add the quarantine location of the blobs", addQuarantine},
+	{"create the captured_rows table", createCapturedRows},
+	{"add the result of the double check of the streams", addColumns("streams",
+		column{"double_checked_at", "datetime DEFAULT NULL"},
+		column{"double_check_result", "varchar(16) DEFAULT NULL"},
+	)},
+	{"add the consensus of the streams and the source_votes table", addConsensus},
+	{"move the streams of the blobs to the stream_blobs table", createStreamBlobs},
+	{"add whether the sd blob of a planned stream is deleted", addColumns("plan_items", column{"delete_sd_blob", "tinyint(1) NOT NULL DEFAULT 0"})},
+	{"create the runs table and add the run that last changed the streams and blobs", createRuns},
+	{"add the bid state of the streams and the deletion_audit table", createDeletionAudit},
+}
+
+type column struct{ name, definition string }
+
+func addColumns(table string, columns ...column) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, c := range columns {
+			err := addColumnIfMissing(tx, table, c.name, c.definition)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func createBaseTables(tx *sql.Tx) error {
+	//stream_id is the primary key of the stream table in reflector, use this to quickly identify streams
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS streams (
+    sd_hash char(96) NOT NULL UNIQUE ,
+    stream_id bigint(20) NOT NULL PRIMARY KEY,
+    exists_in_blockchain tinyint(1) NOT NULL,
+    expired tinyint(1) NOT NULL,
+    spent tinyint(1) NOT NULL,
+    resolved tinyint(1) NOT NULL DEFAULT 0,
+    claim_id char(40) DEFAULT NULL
+    )`)
+	if err != nil {
+		return errors.Err(err)
+	}
+	// the blobs table started out with a single stream per blob, moved to the stream_blobs table by a later migration
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS blobs (
+    blob_hash char(96) NOT NULL PRIMARY KEY,
+    stream_id bigint(20) NOT NULL,
+    blob_id bigint(20) NOT NULL,
+    deleted tinyint(1) NOT NULL,
+    FOREIGN KEY (stream_id) REFERENCES streams(stream_id)
+	)`)
+	if err != nil {
+		return errors.Err(err)
+	}
+	legacy, err := hasColumn(tx, "blobs", "stream_id")
+	if err != nil || !legacy {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS blobs_stream_id_index on blobs (stream_id)`)
+	return errors.Err(err)
+}
+
+func addPublishers(tx *sql.Tx) error {
+	err := addColumnIfMissing(tx, "streams", "publisher_id", "char(40) DEFAULT NULL")
+	if err != nil {
+		return err
+	}
+	return createProtections(tx)
+}
+
+func addQuarantine(tx *sql.Tx) error {
+	err := addColumns("blobs",
+		column{"quarantine_bucket", "varchar(255) DEFAULT NULL"},
+		column{"quarantine_key", "varchar(255) DEFAULT NULL"},
+		column{"quarantined_at", "datetime DEFAULT NULL"},
+	)(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS blobs_quarantine_key_index on blobs (quarantine_key)`)
+	return errors.Err(err)
+}
+
+func addConsensus(tx *sql.Tx) error {
+	err := addColumns("streams",
+		column{"consensus", "varchar(16) DEFAULT NULL"},
+		column{"disputed", "tinyint(1) NOT NULL DEFAULT 0"},
+		column{"verified_at", "datetime DEFAULT NULL"},
+	)(tx)
+	if err != nil {
+		return err
+	}
+	return createSourceVotes(tx)
+}
+
+// SchemaVersion is the latest schema version this binary knows how to use
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func initSchemaVersion(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+    version integer NOT NULL PRIMARY KEY,
+    description text NOT NULL,
+    applied_at datetime NOT NULL
+    )`)
+	return errors.Err(err)
+}
+
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func schemaVersion(q querier) (int, error) {
+	var version int
+	err := q.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, errors.Err(err)
+}
+
+// Version returns the schema version the store reached
+func (s *Store) Version() (int, error) {
+	return schemaVersion(s.db)
+}
+
+// PendingMigrations returns the migrations that weren't applied to the store yet
+func (s *Store) PendingMigrations() ([]Migration, error) {
+	version, err := s.Version()
+	if err != nil {
+		return nil, err
+	}
+	pending := make([]Migration, 0)
+	for i := version; i < len(migrations); i++ {
+		pending = append(pending, Migration{Version: i + 1, Description: migrations[i].description})
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations in order and returns them
+func (s *Store) Migrate() ([]Migration, error) {
+	pending, err := s.PendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range pending {
+		logrus.Infof("applying schema migration %d: %s", m.Version, m.Description)
+		err = s.applyMigration(m)
+		if err != nil {
+			return nil, errors.Prefix(fmt.Sprintf("schema migration %d", m.Version), err)
+		}
+	}
+	return pending, nil
+}
+
+func (s *Store) applyMigration(m Migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Err(err)
+	}
+	// another process may have migrated the store in the meantime
+	version, err := schemaVersion(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if version >= m.Version {
+		return errors.Err(tx.Rollback())
+	}
+	err = migrations[m.Version-1].apply(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)", m.Version, m.Description, time.Now().UTC())
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	return errors.Err(tx.Commit())
+}
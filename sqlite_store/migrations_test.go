@@ -0,0 +1,83 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cleaner.sqlite")
+	store, err := Init(path)
+	assert.NoError(t, err)
+	version, err := store.Version()
+	assert.NoError(t, err)
+	assert.Equal(t, SchemaVersion(), version)
+	pending, err := store.PendingMigrations()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	for _, c := range []struct{ table, column string }{{"blobs", "quarantine_key"}, {"streams", "verified_at"}, {"plan_items", "delete_sd_blob"}} {
+		exists, err := hasColumn(store.db, c.table, c.column)
+		assert.NoError(t, err)
+		assert.True(t, exists, c.table+"."+c.column)
+	}
+
+	// opening it again doesn't apply anything
+	store, err = Init(path)
+	assert.NoError(t, err)
+	applied, err := store.Migrate()
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+}
+
+func TestMigrateUnversionedStore(t *testing.T) {
+	// a store created before the schema was versioned, with only some of the migrations applied
+	path := filepath.Join(t.TempDir(), "cleaner.sqlite")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE streams (
+    sd_hash char(96) NOT NULL UNIQUE ,
+    stream_id bigint(20) NOT NULL PRIMARY KEY,
+    exists_in_blockchain tinyint(1) NOT NULL,
+    expired tinyint(1) NOT NULL,
+    spent tinyint(1) NOT NULL,
+    resolved tinyint(1) NOT NULL DEFAULT 0,
+    claim_id char(40) DEFAULT NULL,
+    invalid_since datetime DEFAULT NULL
+    )`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO streams (sd_hash, stream_id, exists_in_blockchain, expired, spent, resolved) VALUES ('sd1', 1, 0, 0, 0, 1)`)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	store, err := Open(path)
+	assert.NoError(t, err)
+	pending, err := store.PendingMigrations()
+	assert.NoError(t, err)
+	if assert.Len(t, pending, SchemaVersion()) {
+		assert.Equal(t, Migration{Version: 1, Description: migrations[0].description}, pending[0])
+	}
+	applied, err := store.Migrate()
+	assert.NoError(t, err)
+	assert.Equal(t, pending, applied)
+
+	streams, err := store.LoadStreamData(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, streams, 1)
+}
+
+func TestRefuseNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cleaner.sqlite")
+	store, err := Init(path)
+	assert.NoError(t, err)
+	_, err = store.db.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'from the future', datetime('now'))", SchemaVersion()+1)
+	assert.NoError(t, err)
+
+	_, err = Open(path)
+	assert.Error(t, err)
+	_, err = Init(path)
+	assert.Error(t, err)
+}
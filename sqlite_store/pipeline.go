@@ -0,0 +1,116 @@
+package sqlite_store
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Stage identifies a step of the cleaning pipeline. Each stage reads its inputs from the store and writes its outputs back to it
+type Stage string
+
+const (
+	StageScan         Stage = "scan"
+	StageResolve      Stage = "resolve"
+	StageDoubleCheck  Stage = "double-check"
+	StageVerify       Stage = "verify"
+	StageResolveBlobs Stage = "resolve-blobs"
+	StageMeasureBlobs Stage = "measure-blobs"
+	StageWipe         Stage = "wipe"
+	StageCleanse      Stage = "cleanse"
+)
+
+// stagePrerequisites lists, for each stage, the stages whose outputs it consumes
+var stagePrerequisites = map[Stage][]Stage{
+	StageScan:         {},
+	StageResolve:      {StageScan},
+	StageDoubleCheck:  {StageResolve},
+	StageVerify:       {StageResolve},
+	StageResolveBlobs: {StageResolve},
+	StageMeasureBlobs: {StageResolveBlobs},
+	StageWipe:         {StageResolveBlobs},
+	StageCleanse:      {StageWipe},
+}
+
+type stageState struct {
+	sequence    int64
+	completedAt time.Time
+}
+
+func createPipelineStages(tx *sql.Tx) error {
+	// sequence is a monotonic counter used to order completions without relying on the wall clock
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS pipeline_stages (
+    stage varchar(32) NOT NULL PRIMARY KEY,
+    sequence bigint(20) NOT NULL,
+    completed_at datetime NOT NULL
+    )`)
+	return errors.Err(err)
+}
+
+func (s *Store) stageState(stage Stage) (*stageState, error) {
+	var state stageState
+	err := s.db.QueryRow("SELECT sequence, completed_at FROM pipeline_stages WHERE stage = ?", string(stage)).Scan(&state.sequence, &state.completedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return &state, nil
+}
+
+// CheckStage makes sure that all the stages the given stage depends on have completed and that none of their outputs is stale
+func (s *Store) CheckStage(stage Stage) error {
+	prerequisites, ok := stagePrerequisites[stage]
+	if !ok {
+		return errors.Err("unknown stage %s", stage)
+	}
+	for _, p := range prerequisites {
+		err := s.RequireStage(p)
+		if err != nil {
+			return errors.Prefix(fmt.Sprintf("cannot run stage %s", stage), err)
+		}
+	}
+	return nil
+}
+
+// RequireStage makes sure that the given stage completed and that its output is not stale,
+// meaning that no stage upstream of it was re-run after it completed
+func (s *Store) RequireStage(stage Stage) error {
+	state, err := s.stageState(stage)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return errors.Err("stage %s has not been completed yet", stage)
+	}
+	for _, upstream := range stagePrerequisites[stage] {
+		upstreamState, err := s.stageState(upstream)
+		if err != nil {
+			return err
+		}
+		if upstreamState == nil || upstreamState.sequence > state.sequence {
+			return errors.Err("output of stage %s is stale because stage %s was re-run after it: re-run %s first", stage, upstream, stage)
+		}
+	}
+	return s.CheckStage(stage)
+}
+
+// CompleteStage records that the given stage completed successfully
+func (s *Store) CompleteStage(stage Stage) error {
+	_, err := s.db.Exec(`INSERT INTO pipeline_stages (stage, sequence, completed_at)
+VALUES (?, (SELECT COALESCE(MAX(sequence), 0) + 1 FROM pipeline_stages), ?)
+ON CONFLICT(stage) DO UPDATE SET sequence = excluded.sequence, completed_at = excluded.completed_at`, string(stage), time.Now().UTC())
+	return errors.Err(err)
+}
+
+// StageCompletedAt returns when the given stage last completed or nil if it never did
+func (s *Store) StageCompletedAt(stage Stage) (*time.Time, error) {
+	state, err := s.stageState(stage)
+	if err != nil || state == nil {
+		return nil, err
+	}
+	return &state.completedAt, nil
+}
@@ -0,0 +1,163 @@
+package sqlite_store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// PlanKind is the destructive phase a plan was made for
+type PlanKind string
+
+const (
+	PlanKindWipe    PlanKind = "wipe"
+	PlanKindCleanse PlanKind = "cleanse"
+)
+
+// PlanItem describes what would be deleted for a single stream
+type PlanItem struct {
+	StreamID       int64    `json:"stream_id"`
+	SdHash         string   `json:"sd_hash"`
+	ClaimID        *string  `json:"claim_id"`
+	Reason         string   `json:"reason"`
+	BlobKeys       []string `json:"blob_keys"`
+	BlobIDs        []int64  `json:"blob_ids"`
+	EstimatedBytes int64    `json:"estimated_bytes"`
+	// DeleteSdBlob tells whether a wipe deletes the sd blob once the blobs of the stream are deleted
+	DeleteSdBlob bool `json:"delete_sd_blob"`
+}
+
+// Plan is a reviewable list of everything a wipe or a cleanse would delete. A cleanse removes rows rather than bytes,
+// so its estimated bytes are always 0
+type Plan struct {
+	ID             int64      `json:"id"`
+	Kind           PlanKind   `json:"kind"`
+	CreatedAt      time.Time  `json:"created_at"`
+	Streams        int64      `json:"streams"`
+	Blobs          int64      `json:"blobs"`
+	EstimatedBytes int64      `json:"estimated_bytes"`
+	Items          []PlanItem `json:"items"`
+}
+
+func createPlans(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS plans (
+    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+    kind varchar(16) NOT NULL,
+    created_at datetime NOT NULL,
+    streams bigint(20) NOT NULL,
+    blobs bigint(20) NOT NULL,
+    estimated_bytes bigint(20) NOT NULL
+    )`)
+	if err != nil {
+		return errors.Err(err)
+	}
+	// blob_keys and blob_ids are stored as JSON arrays
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS plan_items (
+    plan_id integer NOT NULL,
+    stream_id bigint(20) NOT NULL,
+    sd_hash char(96) NOT NULL,
+    claim_id char(40) DEFAULT NULL,
+    reason varchar(16) NOT NULL,
+    blob_keys text NOT NULL,
+    blob_ids text NOT NULL,
+    estimated_bytes bigint(20) NOT NULL,
+    PRIMARY KEY (plan_id, stream_id),
+    FOREIGN KEY (plan_id) REFERENCES plans(id)
+    )`)
+	return errors.Err(err)
+}
+
+// StorePlan saves the plan and its items and assigns it an ID
+func (s *Store) StorePlan(p *Plan) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Err(err)
+	}
+	res, err := tx.Exec("INSERT INTO plans (kind, created_at, streams, blobs, estimated_bytes) VALUES (?, ?, ?, ?, ?)", string(p.Kind), p.CreatedAt, p.Streams, p.Blobs, p.EstimatedBytes)
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	planID, err := res.LastInsertId()
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO plan_items (plan_id, stream_id, sd_hash, claim_id, reason, blob_keys, blob_ids, estimated_bytes, delete_sd_blob) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	defer stmt.Close()
+
+	for _, item := range p.Items {
+		blobKeys, err := json.Marshal(item.BlobKeys)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+		blobIDs, err := json.Marshal(item.BlobIDs)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+		_, err = stmt.Exec(planID, item.StreamID, item.SdHash, item.ClaimID, item.Reason, string(blobKeys), string(blobIDs), item.EstimatedBytes, item.DeleteSdBlob)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Err(err)
+	}
+	p.ID = planID
+	return nil
+}
+
+// LoadPlan returns the plan with the given ID
+func (s *Store) LoadPlan(planID int64) (*Plan, error) {
+	p := &Plan{ID: planID}
+	var kind string
+	err := s.db.QueryRow("SELECT kind, created_at, streams, blobs, estimated_bytes FROM plans WHERE id = ?", planID).Scan(&kind, &p.CreatedAt, &p.Streams, &p.Blobs, &p.EstimatedBytes)
+	if err == sql.ErrNoRows {
+		return nil, errors.Err("plan %d does not exist", planID)
+	}
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	p.Kind = PlanKind(kind)
+
+	rows, err := s.db.Query("SELECT stream_id, sd_hash, claim_id, reason, blob_keys, blob_ids, estimated_bytes, delete_sd_blob FROM plan_items WHERE plan_id = ?", planID)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+
+	p.Items = make([]PlanItem, 0, p.Streams)
+	for rows.Next() {
+		var item PlanItem
+		var blobKeys, blobIDs string
+		err = rows.Scan(&item.StreamID, &item.SdHash, &item.ClaimID, &item.Reason, &blobKeys, &blobIDs, &item.EstimatedBytes, &item.DeleteSdBlob)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		err = json.Unmarshal([]byte(blobKeys), &item.BlobKeys)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		err = json.Unmarshal([]byte(blobIDs), &item.BlobIDs)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		p.Items = append(p.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Err(err)
+	}
+	return p, nil
+}
@@ -0,0 +1,71 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/protection"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func createProtections(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS protections (
+    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+    kind varchar(16) NOT NULL,
+    value varchar(96) NOT NULL,
+    reason text NOT NULL,
+    owner varchar(255) NOT NULL,
+    created_at datetime NOT NULL,
+    expires_at datetime DEFAULT NULL,
+    UNIQUE (kind, value)
+    )`)
+	return errors.Err(err)
+}
+
+// AddProtection saves the protection and assigns it an ID. A protection of the same kind and value replaces the existing one
+func (s *Store) AddProtection(ctx context.Context, p *protection.Protection) error {
+	p.CreatedAt = time.Now().UTC()
+	err := s.db.QueryRowContext(ctx, `INSERT INTO protections (kind, value, reason, owner, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(kind, value) DO UPDATE SET reason = excluded.reason, owner = excluded.owner, created_at = excluded.created_at, expires_at = excluded.expires_at
+RETURNING id`, string(p.Kind), p.Value, p.Reason, p.Owner, p.CreatedAt, p.ExpiresAt).Scan(&p.ID)
+	return errors.Err(err)
+}
+
+// LoadProtections returns all the protections, expired ones included
+func (s *Store) LoadProtections(ctx context.Context) ([]protection.Protection, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id, kind, value, reason, owner, created_at, expires_at FROM protections ORDER BY id")
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	protections := make([]protection.Protection, 0)
+	for rows.Next() {
+		var p protection.Protection
+		var kind string
+		err = rows.Scan(&p.ID, &kind, &p.Value, &p.Reason, &p.Owner, &p.CreatedAt, &p.ExpiresAt)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		p.Kind = protection.Kind(kind)
+		protections = append(protections, p)
+	}
+	return protections, errors.Err(rows.Err())
+}
+
+// RemoveProtection deletes the protection with the given ID
+func (s *Store) RemoveProtection(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM protections WHERE id = ?", id)
+	if err != nil {
+		return errors.Err(err)
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return errors.Err(err)
+	}
+	if removed == 0 {
+		return errors.Err("protection %d does not exist", id)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// QuarantineLocation is where a deleted blob was copied to
+type QuarantineLocation struct {
+	Bucket string
+	Key    string
+}
+
+// QuarantinedBlob is a deleted blob that can still be recovered from the quarantine
+type QuarantinedBlob struct {
+	BlobHash      string
+	StreamID      int64
+	Location      QuarantineLocation
+	QuarantinedAt time.Time
+}
+
+// LoadQuarantinedBlobs returns the blobs still in quarantine that were quarantined before the given time
+func (s *Store) LoadQuarantinedBlobs(ctx context.Context, before time.Time) ([]QuarantinedBlob, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT b.blob_hash,
+    COALESCE((SELECT MIN(sb.stream_id) FROM stream_blobs sb INNER JOIN streams s ON s.stream_id = sb.stream_id WHERE sb.blob_hash = b.blob_hash),
+        (SELECT stream_id FROM streams WHERE sd_hash = b.blob_hash), 0),
+    b.quarantine_bucket, b.quarantine_key, b.quarantined_at FROM blobs b
+WHERE b.quarantine_key IS NOT NULL AND b.quarantined_at < ? ORDER BY b.quarantined_at`, before.UTC())
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	blobs := make([]QuarantinedBlob, 0)
+	for rows.Next() {
+		var b QuarantinedBlob
+		err = rows.Scan(&b.BlobHash, &b.StreamID, &b.Location.Bucket, &b.Location.Key, &b.QuarantinedAt)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, errors.Err(rows.Err())
+}
+
+// ExpireQuarantinedBlob records that the blob was permanently deleted from the quarantine, in the audit log too. quarantined_at is kept
+func (s *Store) ExpireQuarantinedBlob(ctx context.Context, location QuarantineLocation) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	var blobHash string
+	err = tx.QueryRow("SELECT blob_hash FROM blobs WHERE quarantine_bucket = ? AND quarantine_key = ?", location.Bucket, location.Key).Scan(&blobHash)
+	if err != nil && err != sql.ErrNoRows {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	err = s.auditBlobDeletion(tx, location.Bucket, location.Key, AuditActionQuarantineExpired, blobHash)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec("UPDATE blobs SET quarantine_bucket = NULL, quarantine_key = NULL WHERE quarantine_bucket = ? AND quarantine_key = ?", location.Bucket, location.Key)
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	return errors.Err(tx.Commit())
+}
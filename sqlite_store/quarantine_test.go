@@ -0,0 +1,40 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuarantine(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	streams := []shared.StreamData{{SdHash: "sd1", StreamID: 1, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2}}}}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	location := QuarantineLocation{Bucket: "quarantine", Key: "quarantine/a"}
+	assert.NoError(t, store.FlagQuarantinedBlob(ctx, "bucket", "a", location))
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "b"))
+
+	blobs, err := store.LoadQuarantinedBlobs(ctx, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, blobs)
+	blobs, err = store.LoadQuarantinedBlobs(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	if assert.Len(t, blobs, 1) {
+		assert.Equal(t, "a", blobs[0].BlobHash)
+		assert.Equal(t, location, blobs[0].Location)
+	}
+
+	assert.NoError(t, store.ExpireQuarantinedBlob(ctx, location))
+	blobs, err = store.LoadQuarantinedBlobs(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Empty(t, blobs)
+}
@@ -0,0 +1,144 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+func createCapturedRows(tx *sql.Tx) error {
+	// rows is the JSON encoding of the reflector rows of the stream, as they were right before cleanse deleted them
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS captured_rows (
+    stream_id bigint(20) NOT NULL PRIMARY KEY,
+    rows text NOT NULL,
+    captured_at datetime NOT NULL,
+    FOREIGN KEY (stream_id) REFERENCES streams(stream_id)
+    )`)
+	return errors.Err(err)
+}
+
+// StoreCapturedRows saves the reflector rows of the stream so that it can be restored after being cleansed. Rows captured earlier are replaced
+func (s *Store) StoreCapturedRows(ctx context.Context, streamID int64, rows []byte) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO captured_rows (stream_id, rows, captured_at) VALUES (?, ?, ?)
+ON CONFLICT(stream_id) DO UPDATE SET rows = excluded.rows, captured_at = excluded.captured_at`, streamID, string(rows), time.Now().UTC())
+	return errors.Err(err)
+}
+
+// LoadCapturedRows returns the reflector rows captured for the stream, nil if there are none
+func (s *Store) LoadCapturedRows(ctx context.Context, streamID int64) ([]byte, error) {
+	var rows string
+	err := s.db.QueryRowContext(ctx, "SELECT rows FROM captured_rows WHERE stream_id = ?", streamID).Scan(&rows)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return []byte(rows), nil
+}
+
+// DeletedBlob is a blob that was deleted from S3. Location is nil if it wasn't quarantined or the quarantine expired
+type DeletedBlob struct {
+	BlobHash string
+	Location *QuarantineLocation
+}
+
+// LoadDeletedBlobs returns the blobs of the stream that were deleted from S3, including its sd blob
+func (s *Store) LoadDeletedBlobs(ctx context.Context, streamID int64) ([]DeletedBlob, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT b.blob_hash, b.quarantine_bucket, b.quarantine_key FROM blobs b
+WHERE b.deleted = 1 AND (b.blob_hash IN (SELECT blob_hash FROM stream_blobs WHERE stream_id = ?) OR b.blob_hash = (SELECT sd_hash FROM streams WHERE stream_id = ?))
+ORDER BY b.blob_hash`, streamID, streamID)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	blobs := make([]DeletedBlob, 0)
+	for rows.Next() {
+		var b DeletedBlob
+		var bucket, key sql.NullString
+		err = rows.Scan(&b.BlobHash, &bucket, &key)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		if bucket.Valid && key.Valid {
+			b.Location = &QuarantineLocation{Bucket: bucket.String, Key: key.String}
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, errors.Err(rows.Err())
+}
+
+// LoadQuarantinedStreamIDs returns the streams that had blobs quarantined by the given run, as recorded in the runs table, and still in quarantine
+func (s *Store) LoadQuarantinedStreamIDs(ctx context.Context, runID int64) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT s.stream_id FROM blobs b
+INNER JOIN stream_blobs sb ON sb.blob_hash = b.blob_hash INNER JOIN streams s ON s.stream_id = sb.stream_id
+WHERE b.quarantine_key IS NOT NULL AND b.run_id = ?1
+UNION SELECT s.stream_id FROM blobs b INNER JOIN streams s ON s.sd_hash = b.blob_hash
+WHERE b.quarantine_key IS NOT NULL AND b.run_id = ?1
+ORDER BY 1`, runID)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	streamIDs := make([]int64, 0)
+	for rows.Next() {
+		var streamID int64
+		err = rows.Scan(&streamID)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		streamIDs = append(streamIDs, streamID)
+	}
+	return streamIDs, errors.Err(rows.Err())
+}
+
+// LoadRestorableStreamIDs returns the streams that have something to restore: blobs deleted from S3, including their sd blob, or captured reflector rows
+func (s *Store) LoadRestorableStreamIDs(ctx context.Context) ([]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT sb.stream_id FROM stream_blobs sb INNER JOIN blobs b ON b.blob_hash = sb.blob_hash WHERE b.deleted = 1
+UNION SELECT s.stream_id FROM streams s INNER JOIN blobs b ON b.blob_hash = s.sd_hash WHERE b.deleted = 1
+UNION SELECT stream_id FROM captured_rows
+ORDER BY 1`)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	streamIDs := make([]int64, 0)
+	for rows.Next() {
+		var streamID int64
+		err = rows.Scan(&streamID)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		streamIDs = append(streamIDs, streamID)
+	}
+	return streamIDs, errors.Err(rows.Err())
+}
+
+// RestoreStream marks the stream as valid like UnflagStream does, but keeps its blobs and marks them as no longer deleted.
+// The captured reflector rows are dropped as they were put back
+func (s *Store) RestoreStream(ctx context.Context, streamID int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	statements := []struct {
+		query string
+		args  []interface{}
+	}{
+		{"UPDATE streams SET spent = 0, expired = 0, exists_in_blockchain = 1, resolved = 1, invalid_since = NULL, run_id = ? WHERE stream_id = ?", []interface{}{s.run(), streamID}},
+		{"UPDATE blobs SET deleted = 0, quarantine_bucket = NULL, quarantine_key = NULL, quarantined_at = NULL, run_id = ? WHERE blob_hash IN (SELECT blob_hash FROM stream_blobs WHERE stream_id = ?)", []interface{}{s.run(), streamID}},
+		{"UPDATE blobs SET deleted = 0, quarantine_bucket = NULL, quarantine_key = NULL, quarantined_at = NULL, run_id = ? WHERE blob_hash = (SELECT sd_hash FROM streams WHERE stream_id = ?)", []interface{}{s.run(), streamID}},
+		{"DELETE FROM failed_deletions WHERE stream_id = ?1 OR blob_hash IN (SELECT blob_hash FROM stream_blobs WHERE stream_id = ?1)", []interface{}{streamID}},
+		{"DELETE FROM captured_rows WHERE stream_id = ?", []interface{}{streamID}},
+	}
+	for _, statement := range statements {
+		_, err = tx.ExecContext(ctx, statement.query, statement.args...)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+	}
+	return errors.Err(tx.Commit())
+}
@@ -0,0 +1,60 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestoreStream(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	streams := []shared.StreamData{{SdHash: "sd1", StreamID: 1, Resolved: true, Spent: true, Exists: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2}}}}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	run := &Run{Command: "wipe"}
+	assert.NoError(t, store.StartRun(run))
+	location := QuarantineLocation{Bucket: "quarantine", Key: "quarantine/a"}
+	assert.NoError(t, store.FlagQuarantinedBlob(ctx, "bucket", "a", location))
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "b"))
+	assert.NoError(t, store.StoreCapturedRows(ctx, 1, []byte(`{"stream":{"id":"1"}}`)))
+
+	deleted, err := store.LoadDeletedBlobs(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeletedBlob{{BlobHash: "a", Location: &location}, {BlobHash: "b"}}, deleted)
+	streamIDs, err := store.LoadQuarantinedStreamIDs(ctx, run.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1}, streamIDs)
+	streamIDs, err = store.LoadQuarantinedStreamIDs(ctx, run.ID+1)
+	assert.NoError(t, err)
+	assert.Empty(t, streamIDs)
+	rows, err := store.LoadCapturedRows(ctx, 1)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"stream":{"id":"1"}}`, string(rows))
+	streamIDs, err = store.LoadRestorableStreamIDs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1}, streamIDs)
+
+	assert.NoError(t, store.RestoreStream(ctx, 1))
+	deleted, err = store.LoadDeletedBlobs(ctx, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, deleted)
+	rows, err = store.LoadCapturedRows(ctx, 1)
+	assert.NoError(t, err)
+	assert.Nil(t, rows)
+	streamIDs, err = store.LoadRestorableStreamIDs(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, streamIDs)
+	streamData, err := store.LoadStreamData(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, streamData, 1) {
+		assert.False(t, streamData[0].Spent)
+		assert.True(t, streamData[0].Exists)
+	}
+}
@@ -0,0 +1,192 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// Run is an invocation of the cleaner that opened the store. Streams and blobs reference the run that last changed their state
+type Run struct {
+	ID                int64
+	Command           string
+	Flags             map[string]string
+	ConfigFingerprint string
+	Version           string
+	StartedAt         time.Time
+	FinishedAt        *time.Time
+	// Counters are the totals of the run as JSON, empty until it finishes
+	Counters json.RawMessage
+	Error    string
+}
+
+func createRuns(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS runs (
+    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+    command varchar(255) NOT NULL,
+    flags text NOT NULL,
+    config_fingerprint char(64) NOT NULL,
+    version varchar(255) NOT NULL,
+    started_at datetime NOT NULL,
+    finished_at datetime DEFAULT NULL,
+    counters text DEFAULT NULL,
+    error text DEFAULT NULL
+    )`)
+	if err != nil {
+		return errors.Err(err)
+	}
+	for _, table := range []string{"streams", "blobs"} {
+		err = addColumnIfMissing(tx, table, "run_id", "integer DEFAULT NULL")
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS " + table + "_run_id_index on " + table + " (run_id)")
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	return nil
+}
+
+// StartRun records the start of the run. The streams and blobs changed through the store from then on reference it
+func (s *Store) StartRun(run *Run) error {
+	flags, err := json.Marshal(run.Flags)
+	if err != nil {
+		return errors.Err(err)
+	}
+	run.StartedAt = time.Now().UTC()
+	res, err := s.db.Exec("INSERT INTO runs (command, flags, config_fingerprint, version, started_at) VALUES (?, ?, ?, ?, ?)",
+		run.Command, string(flags), run.ConfigFingerprint, run.Version, run.StartedAt)
+	if err != nil {
+		return errors.Err(err)
+	}
+	run.ID, err = res.LastInsertId()
+	if err != nil {
+		return errors.Err(err)
+	}
+	s.runID = run.ID
+	return nil
+}
+
+// FinishRun records the end of the run started by StartRun along with its totals and its error, if any
+func (s *Store) FinishRun(counters interface{}, runErr error) error {
+	if s.runID == 0 {
+		return nil
+	}
+	content, err := json.Marshal(counters)
+	if err != nil {
+		return errors.Err(err)
+	}
+	var message sql.NullString
+	if runErr != nil {
+		message = sql.NullString{String: runErr.Error(), Valid: true}
+	}
+	_, err = s.db.Exec("UPDATE runs SET finished_at = ?, counters = ?, error = ? WHERE id = ?", time.Now().UTC(), string(content), message, s.runID)
+	return errors.Err(err)
+}
+
+// run is the value of the run_id column of the rows changed by the store, NULL if no run was started
+func (s *Store) run() sql.NullInt64 {
+	return sql.NullInt64{Int64: s.runID, Valid: s.runID != 0}
+}
+
+// LoadRuns returns the latest runs, most recent first
+func (s *Store) LoadRuns(limit int) ([]Run, error) {
+	rows, err := s.db.Query(`SELECT id, command, flags, config_fingerprint, version, started_at, finished_at, counters, error FROM runs
+ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	runs := make([]Run, 0)
+	for rows.Next() {
+		run, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, *run)
+	}
+	return runs, errors.Err(rows.Err())
+}
+
+// LoadRun returns the run with the given ID
+func (s *Store) LoadRun(runID int64) (*Run, error) {
+	run, err := scanRun(s.db.QueryRow(`SELECT id, command, flags, config_fingerprint, version, started_at, finished_at, counters, error FROM runs
+WHERE id = ?`, runID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Err("run %d does not exist", runID)
+	}
+	return run, err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRun(row scanner) (*Run, error) {
+	run := &Run{}
+	var flags string
+	var counters, message sql.NullString
+	err := row.Scan(&run.ID, &run.Command, &flags, &run.ConfigFingerprint, &run.Version, &run.StartedAt, &run.FinishedAt, &counters, &message)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	err = json.Unmarshal([]byte(flags), &run.Flags)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	if counters.Valid {
+		run.Counters = json.RawMessage(counters.String)
+	}
+	run.Error = message.String
+	return run, nil
+}
+
+// BlobProvenance is what the store knows about how a blob came to be in its current state
+type BlobProvenance struct {
+	BlobHash string
+	Deleted  bool
+	// RunID is the run that last changed the blob, the one that deleted it if it's deleted. 0 if unknown
+	RunID int64
+	// Streams are the stored streams using the blob, or whose sd blob it is
+	Streams []StreamProvenance
+}
+
+// StreamProvenance is a stream along with the run that last changed its state
+type StreamProvenance struct {
+	Stream shared.StreamData
+	RunID  int64
+}
+
+// LoadBlobProvenance returns the run that last changed the blob and the streams using it, to tell which run deleted it and why
+func (s *Store) LoadBlobProvenance(ctx context.Context, blobHash string) (*BlobProvenance, error) {
+	provenance := &BlobProvenance{BlobHash: blobHash, Streams: make([]StreamProvenance, 0)}
+	err := s.db.QueryRowContext(ctx, "SELECT deleted, COALESCE(run_id, 0) FROM blobs WHERE blob_hash = ?", blobHash).Scan(&provenance.Deleted, &provenance.RunID)
+	if err == sql.ErrNoRows {
+		return nil, errors.Err("blob %s is not in the store", blobHash)
+	}
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT sd_hash, stream_id, exists_in_blockchain, expired, spent, resolved, claim_id, invalid_since, publisher_id, COALESCE(run_id, 0)
+FROM streams WHERE stream_id IN (SELECT stream_id FROM stream_blobs WHERE blob_hash = ?1) OR sd_hash = ?1 ORDER BY stream_id`, blobHash)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p StreamProvenance
+		sd := &p.Stream
+		err = rows.Scan(&sd.SdHash, &sd.StreamID, &sd.Exists, &sd.Expired, &sd.Spent, &sd.Resolved, &sd.ClaimID, &sd.InvalidSince, &sd.PublisherID, &p.RunID)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		provenance.Streams = append(provenance.Streams, p)
+	}
+	return provenance, errors.Err(rows.Err())
+}
@@ -0,0 +1,64 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRuns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cleaner.sqlite")
+	store, err := Init(path)
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	scan := &Run{Command: "scan", Flags: map[string]string{"limit": "10"}, ConfigFingerprint: "abc", Version: "unknown"}
+	assert.NoError(t, store.StartRun(scan))
+	streams := []shared.StreamData{{SdHash: "sd1", StreamID: 1, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2}}}}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.FinishRun(map[string]int{"streams": 1}, nil))
+
+	// the wipe is recorded by another invocation
+	store, err = Init(path)
+	assert.NoError(t, err)
+	wipe := &Run{Command: "wipe", Flags: map[string]string{"plan": "1"}, ConfigFingerprint: "abc", Version: "unknown"}
+	assert.NoError(t, store.StartRun(wipe))
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "a"))
+	assert.NoError(t, store.FinishRun(map[string]int{"blobs_deleted": 1}, errors.Err("interrupted")))
+
+	runs, err := store.LoadRuns(10)
+	assert.NoError(t, err)
+	if assert.Len(t, runs, 2) {
+		assert.Equal(t, wipe.ID, runs[0].ID)
+		assert.Equal(t, map[string]string{"plan": "1"}, runs[0].Flags)
+		assert.JSONEq(t, `{"blobs_deleted": 1}`, string(runs[0].Counters))
+		assert.Equal(t, "interrupted", runs[0].Error)
+		assert.NotNil(t, runs[0].FinishedAt)
+		assert.Equal(t, scan.ID, runs[1].ID)
+		assert.Empty(t, runs[1].Error)
+	}
+
+	provenance, err := store.LoadBlobProvenance(ctx, "a")
+	assert.NoError(t, err)
+	assert.True(t, provenance.Deleted)
+	assert.Equal(t, wipe.ID, provenance.RunID)
+	if assert.Len(t, provenance.Streams, 1) {
+		assert.Equal(t, scan.ID, provenance.Streams[0].RunID)
+		assert.Equal(t, shared.ReasonNotOnChain, provenance.Streams[0].Stream.InvalidReason())
+	}
+	provenance, err = store.LoadBlobProvenance(ctx, "b")
+	assert.NoError(t, err)
+	assert.False(t, provenance.Deleted)
+	assert.Equal(t, scan.ID, provenance.RunID)
+
+	_, err = store.LoadBlobProvenance(ctx, "c")
+	assert.Error(t, err)
+	_, err = store.LoadRun(42)
+	assert.Error(t, err)
+}
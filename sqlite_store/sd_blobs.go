@@ -0,0 +1,32 @@
+package sqlite_store
+
+import (
+	"context"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// TrackSdBlobs adds the sd blobs of the streams to the blobs table so that their deletion from S3 is recorded like the one of any other blob.
+// Their blob_id is 0 as the blob_ row of an sd blob is removed by hash
+func (s *Store) TrackSdBlobs(ctx context.Context, streamData []shared.StreamData) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO blobs (blob_hash, blob_id, deleted, run_id) VALUES (?, 0, 0, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	defer stmt.Close()
+	for _, sd := range streamData {
+		_, err = stmt.Exec(sd.SdHash, s.run())
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+	}
+	return errors.Err(tx.Commit())
+}
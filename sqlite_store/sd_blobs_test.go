@@ -0,0 +1,60 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSdBlobs(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	streams := []shared.StreamData{{SdHash: "sd1", StreamID: 1, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}}}}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.TrackSdBlobs(ctx, streams))
+	// tracking them again doesn't reset their state
+	run := &Run{Command: "wipe"}
+	assert.NoError(t, store.StartRun(run))
+	location := QuarantineLocation{Bucket: "quarantine", Key: "quarantine/sd1"}
+	assert.NoError(t, store.FlagQuarantinedBlob(ctx, "bucket", "sd1", location))
+	assert.NoError(t, store.TrackSdBlobs(ctx, streams))
+
+	loaded, err := store.LoadStreamData(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, loaded, 1) {
+		assert.True(t, loaded[0].SdBlobDeleted)
+	}
+	count, err := store.LoadBlobs(ctx, loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+
+	deleted, err := store.LoadDeletedBlobs(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeletedBlob{{BlobHash: "sd1", Location: &location}}, deleted)
+	streamIDs, err := store.LoadQuarantinedStreamIDs(ctx, run.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1}, streamIDs)
+	streamIDs, err = store.LoadQuarantinedStreamIDs(ctx, run.ID+1)
+	assert.NoError(t, err)
+	assert.Empty(t, streamIDs)
+	quarantined, err := store.LoadQuarantinedBlobs(ctx, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	if assert.Len(t, quarantined, 1) {
+		assert.Equal(t, int64(1), quarantined[0].StreamID)
+	}
+
+	assert.NoError(t, store.RestoreStream(ctx, 1))
+	loaded, err = store.LoadStreamData(ctx)
+	assert.NoError(t, err)
+	if assert.Len(t, loaded, 1) {
+		assert.False(t, loaded[0].SdBlobDeleted)
+	}
+}
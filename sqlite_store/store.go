@@ -1,8 +1,12 @@
 package sqlite_store
 
 import (
+	"context"
 	"database/sql"
+	"sort"
+	"time"
 
+	"github.com/nikooo777/reflector-s3-cleaner/metrics"
 	"github.com/nikooo777/reflector-s3-cleaner/shared"
 
 	"github.com/lbryio/lbry.go/v2/extras/errors"
@@ -12,57 +16,87 @@ import (
 
 type Store struct {
 	db *sql.DB
+	// runID is the run started on the store, 0 if none
+	runID int64
 }
 
-func Init() (*Store, error) {
-	db, err := sql.Open("sqlite3", "./cleaner.sqlite?cache=shared&_journal_mode=WAL&_synchronous=NORMAL")
+// Init opens the store at the given path and brings its schema up to date
+func Init(path string) (*Store, error) {
+	newStore, err := Open(path)
 	if err != nil {
-		return nil, errors.Err(err)
+		return nil, err
 	}
-	//stream_id is the primary key of the stream table in reflector, use this to quickly identify streams
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS streams (
-    sd_hash char(96) NOT NULL UNIQUE ,
-    stream_id bigint(20) NOT NULL PRIMARY KEY,
-    exists_in_blockchain tinyint(1) NOT NULL,
-    expired tinyint(1) NOT NULL,
-    spent tinyint(1) NOT NULL,
-    resolved tinyint(1) NOT NULL DEFAULT 0,
-    claim_id char(40) DEFAULT NULL
-    )`)
+	_, err = newStore.Migrate()
 	if err != nil {
-		return nil, errors.Err(err)
+		return nil, err
 	}
-	// create blobs table that references the stream table
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS blobs (
-    blob_hash char(96) NOT NULL PRIMARY KEY,
-    stream_id bigint(20) NOT NULL,
-    blob_id bigint(20) NOT NULL,
-    deleted tinyint(1) NOT NULL,
-    FOREIGN KEY (stream_id) REFERENCES streams(stream_id)
-	)`)
+	return newStore, nil
+}
+
+// Open opens the store at the given path without migrating it. Stores with a schema newer than this binary are refused
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path+"?cache=shared&_journal_mode=WAL&_synchronous=NORMAL")
 	if err != nil {
 		return nil, errors.Err(err)
 	}
-	// create index for blobs table
-	_, err = db.Exec(`CREATE INDEX IF NOT EXISTS blobs_stream_id_index on blobs (stream_id)`)
+	err = initSchemaVersion(db)
 	if err != nil {
-		return nil, errors.Err(err)
+		return nil, err
 	}
-	newStore := &Store{
-		db: db,
+	version, err := schemaVersion(db)
+	if err != nil {
+		return nil, err
 	}
-	return newStore, nil
+	if version > SchemaVersion() {
+		_ = db.Close()
+		return nil, errors.Err("%s has schema version %d but this binary only knows up to version %d, upgrade it", path, version, SchemaVersion())
+	}
+	return &Store{db: db}, nil
 }
 
-func (s *Store) StoreStreams(streamData []shared.StreamData) error {
+// schema is satisfied by both the database and its transactions
+type schema interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func addColumnIfMissing(db schema, table, column, definition string) error {
+	exists, err := hasColumn(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return errors.Err(err)
+}
+
+func hasColumn(db schema, table, column string) (bool, error) {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return false, errors.Err(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return false, errors.Err(err)
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, errors.Err(rows.Err())
+}
+
+func (s *Store) StoreStreams(ctx context.Context, streamData []shared.StreamData) error {
 	// begin a transaction
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
 	// prepare the statement
-	stmt, err := tx.Prepare("INSERT OR IGNORE INTO streams (sd_hash, stream_id, exists_in_blockchain, expired, spent, resolved, claim_id) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO streams (sd_hash, stream_id, exists_in_blockchain, expired, spent, resolved, claim_id, run_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
@@ -74,7 +108,7 @@ func (s *Store) StoreStreams(streamData []shared.StreamData) error {
 		if sd.IsValid() {
 			sd.ClaimID = nil
 		}
-		_, err = stmt.Exec(sd.SdHash, sd.StreamID, sd.Exists, sd.Expired, sd.Spent, sd.Resolved, sd.ClaimID)
+		_, err = stmt.Exec(sd.SdHash, sd.StreamID, sd.Exists, sd.Expired, sd.Spent, sd.Resolved, sd.ClaimID, s.run())
 		if err != nil {
 			return err
 		}
@@ -89,51 +123,94 @@ func (s *Store) StoreStreams(streamData []shared.StreamData) error {
 	return nil
 }
 
-// UnflagStream sets the stream to spent=0, expired=0, exists_in_blockchain=1, resolved=1 and removes any blobs in the blobs table related to the stream_id of the stream.
-func (s *Store) UnflagStream(streamData *shared.StreamData) error {
-	// Begin a transaction
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
+// chainStateChanged is true when the chain state bound to ?1, ?2 and ?3 differs from the one stored for the stream
+const chainStateChanged = "(exists_in_blockchain IS NOT ?1 OR expired IS NOT ?2 OR spent IS NOT ?3)"
 
-	// Prepare statement to update streams table
-	updateStmt, err := tx.Prepare("UPDATE streams SET spent = 0, expired = 0, exists_in_blockchain = 1, resolved = 1 WHERE stream_id = ?")
+// UpdateStreams persists the chain state of streams that were already stored. The double-check results are reset, as are the consensus
+// results of the streams whose chain state changed as they were for the previous state
+func (s *Store) UpdateStreams(ctx context.Context, streamData []shared.StreamData) error {
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	// Execute update statement
-	_, err = updateStmt.Exec(streamData.StreamID)
+	stmt, err := tx.Prepare(`UPDATE streams SET exists_in_blockchain = ?1, expired = ?2, spent = ?3, resolved = ?4, claim_id = ?5, invalid_since = ?6, publisher_id = ?7, bid_state = ?8,
+    double_checked_at = NULL, double_check_result = NULL,
+    consensus = CASE WHEN ` + chainStateChanged + ` THEN NULL ELSE consensus END,
+    disputed = CASE WHEN ` + chainStateChanged + ` THEN 0 ELSE disputed END,
+    verified_at = CASE WHEN ` + chainStateChanged + ` THEN NULL ELSE verified_at END,
+    run_id = ?9 WHERE stream_id = ?10`)
 	if err != nil {
+		_ = tx.Rollback()
 		return err
 	}
+	defer stmt.Close()
 
-	// Prepare statement to delete from blobs table
-	deleteStmt, err := tx.Prepare("DELETE FROM blobs WHERE stream_id = ?")
-	if err != nil {
-		return err
+	for _, sd := range streamData {
+		//we don't need to know the claim_id of streams that will not be later deleted. this saves some space.
+		if sd.IsValid() {
+			sd.ClaimID = nil
+			sd.PublisherID = nil
+			sd.BidState = nil
+		}
+		_, err = stmt.Exec(sd.Exists, sd.Expired, sd.Spent, sd.Resolved, sd.ClaimID, sd.InvalidSince, sd.PublisherID, sd.BidState, s.run(), sd.StreamID)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
 	}
 
-	// Execute delete statement
-	_, err = deleteStmt.Exec(streamData.StreamID)
-	if err != nil {
-		return err
-	}
+	return tx.Commit()
+}
 
-	// Commit the transaction
-	err = tx.Commit()
-	if err != nil {
-		return err
+// UnflagStream sets the stream to spent=0, expired=0, exists_in_blockchain=1, resolved=1 and clears invalid_since.
+// Its blobs are kept in the store: as the stream is now valid they're no longer selected, and they're retained if other streams share them
+func (s *Store) UnflagStream(ctx context.Context, streamData *shared.StreamData) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE streams SET spent = 0, expired = 0, exists_in_blockchain = 1, resolved = 1, invalid_since = NULL, run_id = ? WHERE stream_id = ?", s.run(), streamData.StreamID)
+	return err
+}
+
+// StreamState selects the streams loaded by LoadStreams
+type StreamState int
+
+const (
+	// StreamsAll selects every stream of the store
+	StreamsAll StreamState = iota
+	// StreamsInvalid selects the streams that aren't on chain, expired or spent
+	StreamsInvalid
+	// StreamsNotDeleted selects the invalid streams whose sd blob, the last one deleted from S3, is still there
+	StreamsNotDeleted
+	// StreamsNotCleansed selects the invalid streams whose stream row wasn't deleted from the reflector database, according to the audit log
+	StreamsNotCleansed
+)
+
+// invalidStreams matches the streams that IsValid returns false for
+const invalidStreams = "(s.exists_in_blockchain = 0 OR s.expired = 1 OR s.spent = 1)"
+
+func (state StreamState) condition() string {
+	switch state {
+	case StreamsInvalid:
+		return invalidStreams
+	case StreamsNotDeleted:
+		return invalidStreams + " AND COALESCE(b.deleted, 0) = 0"
+	case StreamsNotCleansed:
+		return invalidStreams + " AND NOT EXISTS (SELECT 1 FROM deletion_audit a WHERE a.system = '" + AuditSystemReflector +
+			"' AND a.location = 'stream' AND a.stream_id = s.stream_id)"
 	}
+	return "1 = 1"
+}
 
-	return nil
+// LoadStreamData loads every stream of the store, ordered by stream ID
+func (s *Store) LoadStreamData(ctx context.Context) ([]shared.StreamData, error) {
+	return s.LoadStreams(ctx, StreamsAll)
 }
 
-func (s *Store) LoadStreamData() ([]shared.StreamData, error) {
+// LoadStreams loads the streams in the given state, ordered by stream ID
+func (s *Store) LoadStreams(ctx context.Context, state StreamState) ([]shared.StreamData, error) {
 	logrus.Debugln("loading stream data from database")
 	// Query the database
-	rows, err := s.db.Query("SELECT sd_hash, stream_id, exists_in_blockchain, expired, spent, resolved, claim_id FROM streams")
+	rows, err := s.db.QueryContext(ctx, `SELECT s.sd_hash, s.stream_id, s.exists_in_blockchain, s.expired, s.spent, s.resolved, s.claim_id, s.invalid_since, s.publisher_id, s.bid_state,
+    COALESCE(b.deleted, 0) FROM streams s LEFT JOIN blobs b ON b.blob_hash = s.sd_hash WHERE `+state.condition()+` ORDER BY s.stream_id`)
 	if err != nil {
 		return nil, err
 	}
@@ -145,7 +222,7 @@ func (s *Store) LoadStreamData() ([]shared.StreamData, error) {
 	for rows.Next() {
 		var sd shared.StreamData
 		// Scan the retrieved row into the StreamData struct
-		if err := rows.Scan(&sd.SdHash, &sd.StreamID, &sd.Exists, &sd.Expired, &sd.Spent, &sd.Resolved, &sd.ClaimID); err != nil {
+		if err := rows.Scan(&sd.SdHash, &sd.StreamID, &sd.Exists, &sd.Expired, &sd.Spent, &sd.Resolved, &sd.ClaimID, &sd.InvalidSince, &sd.PublisherID, &sd.BidState, &sd.SdBlobDeleted); err != nil {
 			return nil, err
 		}
 		streamData = append(streamData, sd)
@@ -160,18 +237,23 @@ func (s *Store) LoadStreamData() ([]shared.StreamData, error) {
 	return streamData, nil
 }
 
-func (s *Store) StoreBlobs(streamData []shared.StreamData) error {
+func (s *Store) StoreBlobs(ctx context.Context, streamData []shared.StreamData) error {
 	logrus.Debugln("storing blobs in database")
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
 
-	stmt, err := tx.Prepare("INSERT OR IGNORE INTO blobs (stream_id, blob_hash, deleted, blob_id) VALUES (?, ?, ?, ?)")
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO blobs (blob_hash, deleted, blob_id, run_id) VALUES (?, ?, ?, ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
+	referenceStmt, err := tx.Prepare("INSERT OR IGNORE INTO stream_blobs (stream_id, blob_hash) VALUES (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer referenceStmt.Close()
 
 	for i, sd := range streamData {
 		if i%100000 == 0 {
@@ -181,10 +263,17 @@ func (s *Store) StoreBlobs(streamData []shared.StreamData) error {
 			continue
 		}
 		for blobHash, blobInfo := range sd.StreamBlobs {
-			_, err = stmt.Exec(sd.StreamID, blobHash, false, blobInfo.BlobID)
+			_, err = stmt.Exec(blobHash, false, blobInfo.BlobID, s.run())
 			if err != nil {
 				return err
 			}
+			// the other streams using the blob are recorded even if they're not in the store
+			for _, streamID := range append([]int64{sd.StreamID}, blobInfo.ReferencedBy...) {
+				_, err = referenceStmt.Exec(streamID, blobHash)
+				if err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -196,74 +285,137 @@ func (s *Store) StoreBlobs(streamData []shared.StreamData) error {
 	return nil
 }
 
-func (s *Store) LoadBlobs(streamData []shared.StreamData) (int64, error) {
+// LoadBlobs attaches their blobs to the invalid streams. The blobs of all the invalid streams of the store are read with a single query
+// ordered by stream ID and merged with the streams in one pass
+func (s *Store) LoadBlobs(ctx context.Context, streamData []shared.StreamData) (int64, error) {
 	logrus.Debugln("loading blobs from database")
-	totalBlobsCount := int64(0)
-	for i, sd := range streamData {
-		if i%10000 == 0 {
-			logrus.Debugf("loaded %d blobs for %d/%d streams", totalBlobsCount, i, len(streamData))
+	invalid := make([]int, 0)
+	for i := range streamData {
+		if !streamData[i].IsValid() {
+			invalid = append(invalid, i)
 		}
-		if sd.IsValid() {
-			continue
-		}
-		cnt, err := s.loadBlobsForStream(&streamData[i])
-		if err != nil {
-			return totalBlobsCount, err
-		}
-		totalBlobsCount += cnt
 	}
-	return totalBlobsCount, nil
-}
+	// LoadStreams returns the streams in order, others are sorted here
+	byStreamID := func(a, b int) bool { return streamData[invalid[a]].StreamID < streamData[invalid[b]].StreamID }
+	if !sort.SliceIsSorted(invalid, byStreamID) {
+		sort.Slice(invalid, byStreamID)
+	}
 
-func (s *Store) loadBlobsForStream(streamData *shared.StreamData) (int64, error) {
-	blobsCount := int64(0)
-	rows, err := s.db.Query("SELECT blob_hash, blob_id, deleted FROM blobs WHERE stream_id = ?", streamData.StreamID)
+	rows, err := s.db.QueryContext(ctx, `SELECT sb.stream_id, b.blob_hash, b.blob_id, b.deleted, b.size_bytes FROM streams s
+INNER JOIN stream_blobs sb ON sb.stream_id = s.stream_id INNER JOIN blobs b ON b.blob_hash = sb.blob_hash
+WHERE `+invalidStreams+` ORDER BY sb.stream_id`)
 	if err != nil {
-		return blobsCount, err
+		return 0, err
 	}
 	defer rows.Close()
+	totalBlobsCount := int64(0)
+	next := 0
 	for rows.Next() {
+		var streamID, blobId int64
 		var blobHash string
-		var blobId int64
 		var deleted bool
-		if err := rows.Scan(&blobHash, &blobId, &deleted); err != nil {
-			return blobsCount, err
+		var sizeBytes sql.NullInt64
+		if err := rows.Scan(&streamID, &blobHash, &blobId, &deleted, &sizeBytes); err != nil {
+			return totalBlobsCount, err
+		}
+		// the blobs of the streams that weren't passed are skipped
+		for next < len(invalid) && streamData[invalid[next]].StreamID < streamID {
+			next++
 		}
-		if streamData.StreamBlobs == nil {
-			streamData.StreamBlobs = make(map[string]shared.BlobInfo)
+		if next == len(invalid) {
+			break
 		}
-		blobsCount++
-		streamData.StreamBlobs[blobHash] = shared.BlobInfo{
+		sd := &streamData[invalid[next]]
+		if sd.StreamID != streamID {
+			continue
+		}
+		if sd.StreamBlobs == nil {
+			sd.StreamBlobs = make(map[string]shared.BlobInfo)
+		}
+		totalBlobsCount++
+		if totalBlobsCount%1000000 == 0 {
+			logrus.Debugf("loaded %d blobs for %d/%d streams", totalBlobsCount, next, len(invalid))
+		}
+		blobInfo := shared.BlobInfo{
 			BlobID:  blobId,
 			Deleted: deleted,
 		}
+		if sizeBytes.Valid {
+			blobInfo.SizeBytes = &sizeBytes.Int64
+		}
+		sd.StreamBlobs[blobHash] = blobInfo
 	}
 	if err := rows.Err(); err != nil {
-		return blobsCount, err
+		return totalBlobsCount, err
 	}
-	return blobsCount, nil
+	return totalBlobsCount, nil
 }
 
-func (s *Store) FlagBlob(deletedBlobHash string) error {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return err
-	}
+// BlobFlag is a deletion of a blob from a bucket confirmed by S3. Location is where the blob was copied before being deleted, if it was
+type BlobFlag struct {
+	Bucket   string
+	BlobHash string
+	Location *QuarantineLocation
+}
+
+// FlagBlob flags the blob as deleted from the bucket and records its deletion in the audit log
+func (s *Store) FlagBlob(ctx context.Context, bucket, deletedBlobHash string) error {
+	return s.FlagBlobs(ctx, []BlobFlag{{Bucket: bucket, BlobHash: deletedBlobHash}})
+}
 
-	stmt, err := tx.Prepare("UPDATE blobs SET deleted = 1 WHERE blob_hash = ?")
+// FlagQuarantinedBlob flags the blob as deleted and records where it was copied before being deleted
+func (s *Store) FlagQuarantinedBlob(ctx context.Context, bucket, deletedBlobHash string, location QuarantineLocation) error {
+	return s.FlagBlobs(ctx, []BlobFlag{{Bucket: bucket, BlobHash: deletedBlobHash, Location: &location}})
+}
+
+// FlagBlobs flags the blobs as deleted and records their deletion in the audit log, all in a single transaction
+func (s *Store) FlagBlobs(ctx context.Context, flags []BlobFlag) error {
+	start := time.Now()
+	defer func() { metrics.SQLiteFlagDuration.Observe(time.Since(start).Seconds()) }()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return errors.Err(err)
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(deletedBlobHash)
-	if err != nil {
-		return err
+	queries := []string{
+		"UPDATE blobs SET deleted = 1, run_id = ? WHERE blob_hash = ?",
+		"UPDATE blobs SET deleted = 1, quarantine_bucket = ?, quarantine_key = ?, quarantined_at = ?, run_id = ? WHERE blob_hash = ?",
+		// a blob whose deletion was retried is no longer queued
+		"DELETE FROM failed_deletions WHERE blob_hash = ?",
+		auditQuery(blobAuditCondition),
 	}
+	stmts := make([]*sql.Stmt, 0, len(queries))
+	defer func() {
+		for _, stmt := range stmts {
+			_ = stmt.Close()
+		}
+	}()
+	for _, query := range queries {
+		stmt, err := tx.Prepare(query)
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
+		stmts = append(stmts, stmt)
+	}
+	flagStmt, flagQuarantinedStmt, unqueueStmt, auditStmt := stmts[0], stmts[1], stmts[2], stmts[3]
 
-	err = tx.Commit()
-	if err != nil {
-		return err
+	for _, f := range flags {
+		if f.Location == nil {
+			_, err = flagStmt.Exec(s.run(), f.BlobHash)
+		} else {
+			_, err = flagQuarantinedStmt.Exec(f.Location.Bucket, f.Location.Key, time.Now().UTC(), s.run(), f.BlobHash)
+		}
+		if err == nil {
+			_, err = unqueueStmt.Exec(f.BlobHash)
+		}
+		if err == nil {
+			_, err = auditStmt.Exec(s.auditArgs(AuditSystemS3, f.Bucket, f.BlobHash, AuditActionDeleted, f.BlobHash)...)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return errors.Err(err)
+		}
 	}
-	return nil
+	return errors.Err(tx.Commit())
 }
@@ -0,0 +1,55 @@
+package sqlite_store
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadStreams(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// stream 1 is valid, 2 is wiped, 3 is cleansed and 4 is untouched
+	streams := []shared.StreamData{
+		{SdHash: "sd4", StreamID: 4, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"d": {BlobID: 4}, "shared": {BlobID: 5}}},
+		{SdHash: "sd1", StreamID: 1, Resolved: true, Exists: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}}},
+		{SdHash: "sd2", StreamID: 2, Resolved: true, Exists: true, Spent: true, StreamBlobs: map[string]shared.BlobInfo{"b": {BlobID: 2}}},
+		{SdHash: "sd3", StreamID: 3, Resolved: true, Exists: true, Expired: true, StreamBlobs: map[string]shared.BlobInfo{"c": {BlobID: 3}, "shared": {BlobID: 5}}},
+	}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.UpdateStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.TrackSdBlobs(ctx, streams))
+	assert.NoError(t, store.FlagBlobs(ctx, []BlobFlag{{Bucket: "bucket", BlobHash: "b"}, {Bucket: "bucket", BlobHash: "sd2"}}))
+	assert.NoError(t, store.RecordRowDeletions(ctx, 3, []shared.RemovedRow{{Table: "stream", Row: "id=3"}}))
+
+	ids := func(state StreamState) []int64 {
+		loaded, err := store.LoadStreams(ctx, state)
+		assert.NoError(t, err)
+		streamIDs := make([]int64, 0, len(loaded))
+		for _, sd := range loaded {
+			streamIDs = append(streamIDs, sd.StreamID)
+		}
+		return streamIDs
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4}, ids(StreamsAll))
+	assert.Equal(t, []int64{2, 3, 4}, ids(StreamsInvalid))
+	assert.Equal(t, []int64{3, 4}, ids(StreamsNotDeleted))
+	assert.Equal(t, []int64{2, 4}, ids(StreamsNotCleansed))
+
+	// the blobs are attached to the invalid streams passed, whatever their order
+	loaded := []shared.StreamData{{SdHash: "sd4", StreamID: 4}, {SdHash: "sd1", StreamID: 1, Exists: true}, {SdHash: "sd2", StreamID: 2}}
+	count, err := store.LoadBlobs(ctx, loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	assert.Len(t, loaded[0].StreamBlobs, 2)
+	assert.Contains(t, loaded[0].StreamBlobs, "shared")
+	assert.Empty(t, loaded[1].StreamBlobs)
+	assert.True(t, loaded[2].StreamBlobs["b"].Deleted)
+}
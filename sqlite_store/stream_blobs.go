@@ -0,0 +1,101 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// blobsColumns is the layout of the blobs table since the streams using every blob moved to the stream_blobs table
+const blobsColumns = `(
+    blob_hash char(96) NOT NULL PRIMARY KEY,
+    blob_id bigint(20) NOT NULL,
+    deleted tinyint(1) NOT NULL,
+    size_bytes bigint(20) DEFAULT NULL,
+    quarantine_bucket varchar(255) DEFAULT NULL,
+    quarantine_key varchar(255) DEFAULT NULL,
+    quarantined_at datetime DEFAULT NULL
+	)`
+
+// createStreamBlobs creates the table of the streams using every blob and moves the streams of the blobs table to it. The streams are
+// the ones of the stream_blob table of reflector, so they aren't necessarily in the streams table
+func createStreamBlobs(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS stream_blobs (
+    stream_id bigint(20) NOT NULL,
+    blob_hash char(96) NOT NULL,
+    PRIMARY KEY (stream_id, blob_hash)
+    )`)
+	if err != nil {
+		return errors.Err(err)
+	}
+	_, err = tx.Exec(`CREATE INDEX IF NOT EXISTS stream_blobs_blob_hash_index on stream_blobs (blob_hash)`)
+	if err != nil {
+		return errors.Err(err)
+	}
+	legacy, err := hasColumn(tx, "blobs", "stream_id")
+	if err != nil || !legacy {
+		return err
+	}
+	// the blobs table held a single stream per blob, the column can only be dropped by rebuilding the table
+	columns := "blob_hash, blob_id, deleted, size_bytes, quarantine_bucket, quarantine_key, quarantined_at"
+	statements := []string{
+		"INSERT OR IGNORE INTO stream_blobs (stream_id, blob_hash) SELECT stream_id, blob_hash FROM blobs",
+		"CREATE TABLE blobs_migrated " + blobsColumns,
+		"INSERT INTO blobs_migrated (" + columns + ") SELECT " + columns + " FROM blobs",
+		"DROP TABLE blobs",
+		"ALTER TABLE blobs_migrated RENAME TO blobs",
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return errors.Err(err)
+		}
+	}
+	return nil
+}
+
+// StoreBlobReferences records the streams using the blobs, on top of the ones already known
+func (s *Store) StoreBlobReferences(ctx context.Context, references map[string][]int64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Err(err)
+	}
+	stmt, err := tx.Prepare("INSERT OR IGNORE INTO stream_blobs (stream_id, blob_hash) VALUES (?, ?)")
+	if err != nil {
+		_ = tx.Rollback()
+		return errors.Err(err)
+	}
+	defer stmt.Close()
+	for blobHash, streamIDs := range references {
+		for _, streamID := range streamIDs {
+			_, err = stmt.Exec(streamID, blobHash)
+			if err != nil {
+				_ = tx.Rollback()
+				return errors.Err(err)
+			}
+		}
+	}
+	return errors.Err(tx.Commit())
+}
+
+// LoadSharedBlobs returns the streams using each of the blobs used by more than one stream
+func (s *Store) LoadSharedBlobs(ctx context.Context) (map[string][]int64, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT blob_hash, stream_id FROM stream_blobs
+WHERE blob_hash IN (SELECT blob_hash FROM stream_blobs GROUP BY blob_hash HAVING COUNT(*) > 1) ORDER BY blob_hash, stream_id`)
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	defer rows.Close()
+	shared := make(map[string][]int64)
+	for rows.Next() {
+		var blobHash string
+		var streamID int64
+		err = rows.Scan(&blobHash, &streamID)
+		if err != nil {
+			return nil, errors.Err(err)
+		}
+		shared[blobHash] = append(shared[blobHash], streamID)
+	}
+	return shared, errors.Err(rows.Err())
+}
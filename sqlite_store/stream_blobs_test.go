@@ -0,0 +1,86 @@
+package sqlite_store
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/nikooo777/reflector-s3-cleaner/shared"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedBlobs(t *testing.T) {
+	store, err := Init(filepath.Join(t.TempDir(), "cleaner.sqlite"))
+	assert.NoError(t, err)
+	ctx := context.Background()
+
+	// "b" is used by both stored streams and by stream 3, which was never scanned
+	streams := []shared.StreamData{
+		{SdHash: "sd1", StreamID: 1, Resolved: true, StreamBlobs: map[string]shared.BlobInfo{"a": {BlobID: 1}, "b": {BlobID: 2, ReferencedBy: []int64{2, 3}}}},
+		{SdHash: "sd2", StreamID: 2, Resolved: true, Exists: true, Spent: true, StreamBlobs: map[string]shared.BlobInfo{"b": {BlobID: 2, ReferencedBy: []int64{1, 3}}}},
+	}
+	assert.NoError(t, store.StoreStreams(ctx, streams))
+	assert.NoError(t, store.StoreBlobs(ctx, streams))
+	assert.NoError(t, store.StoreBlobReferences(ctx, map[string][]int64{"a": {1, 4}}))
+
+	sharedBlobs, err := store.LoadSharedBlobs(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int64{"a": {1, 4}, "b": {1, 2, 3}}, sharedBlobs)
+
+	loaded, err := store.LoadStreamData(ctx)
+	assert.NoError(t, err)
+	count, err := store.LoadBlobs(ctx, loaded)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), count)
+	for _, sd := range loaded {
+		assert.Contains(t, sd.StreamBlobs, "b")
+	}
+
+	// flagging the shared blob as deleted applies to every stream using it
+	assert.NoError(t, store.FlagBlob(ctx, "bucket", "b"))
+	deleted, err := store.LoadDeletedBlobs(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeletedBlob{{BlobHash: "b"}}, deleted)
+
+	// the shared blob is only counted once
+	bytes, err := store.LoadBlobBytes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, BlobBytes{Unmeasured: 1}, bytes[shared.ReasonNotOnChain])
+	assert.NotContains(t, bytes, shared.ReasonSpent)
+}
+
+func TestMigrateBlobStreams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cleaner.sqlite")
+	db, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE TABLE blobs (
+    blob_hash char(96) NOT NULL PRIMARY KEY,
+    stream_id bigint(20) NOT NULL,
+    blob_id bigint(20) NOT NULL,
+    deleted tinyint(1) NOT NULL
+	)`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`CREATE INDEX blobs_stream_id_index on blobs (stream_id)`)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO blobs (blob_hash, stream_id, blob_id, deleted) VALUES ('a', 1, 10, 1), ('b', 1, 11, 0)`)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	store, err := Init(path)
+	assert.NoError(t, err)
+	legacy, err := hasColumn(store.db, "blobs", "stream_id")
+	assert.NoError(t, err)
+	assert.False(t, legacy)
+
+	ctx := context.Background()
+	assert.NoError(t, store.StoreStreams(ctx, []shared.StreamData{{SdHash: "sd1", StreamID: 1, Resolved: true}}))
+	loaded, err := store.LoadStreamData(ctx)
+	assert.NoError(t, err)
+	_, err = store.LoadBlobs(ctx, loaded)
+	assert.NoError(t, err)
+	if assert.Len(t, loaded, 1) {
+		assert.Equal(t, map[string]shared.BlobInfo{"a": {BlobID: 10, Deleted: true}, "b": {BlobID: 11}}, loaded[0].StreamBlobs)
+	}
+}
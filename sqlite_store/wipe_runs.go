@@ -0,0 +1,115 @@
+package sqlite_store
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+)
+
+// WipeRun is the checkpoint of a wipe. A run that was interrupted is left unfinished and resumed by the next wipe
+type WipeRun struct {
+	ID             int64
+	StartedAt      time.Time
+	UpdatedAt      time.Time
+	FinishedAt     *time.Time
+	PlanID         int64
+	BlobsTotal     int64
+	BlobsRemaining int64
+	BlobsDeleted   int64
+	BlobsFailed    int64
+}
+
+func createWipeRuns(tx *sql.Tx) error {
+	// blobs_remaining is the amount of blobs that were left to delete when the run was (last) started
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS wipe_runs (
+    id integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+    started_at datetime NOT NULL,
+    updated_at datetime NOT NULL,
+    finished_at datetime DEFAULT NULL,
+    plan_id integer NOT NULL DEFAULT 0,
+    blobs_total bigint(20) NOT NULL,
+    blobs_remaining bigint(20) NOT NULL,
+    blobs_deleted bigint(20) NOT NULL DEFAULT 0,
+    blobs_failed bigint(20) NOT NULL DEFAULT 0
+    )`)
+	return errors.Err(err)
+}
+
+// StartWipeRun resumes the last unfinished wipe run if there is one for the same plan, otherwise it starts a new one.
+// resumed is true if an interrupted run was picked up
+func (s *Store) StartWipeRun(planID, blobsTotal, blobsRemaining int64) (run *WipeRun, resumed bool, err error) {
+	now := time.Now().UTC()
+	run = &WipeRun{}
+	err = s.db.QueryRow("SELECT id, started_at, plan_id, blobs_deleted, blobs_failed FROM wipe_runs WHERE finished_at IS NULL ORDER BY id DESC LIMIT 1").
+		Scan(&run.ID, &run.StartedAt, &run.PlanID, &run.BlobsDeleted, &run.BlobsFailed)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, errors.Err(err)
+	}
+	if err == nil && run.PlanID == planID {
+		run.UpdatedAt = now
+		run.BlobsTotal = blobsTotal
+		run.BlobsRemaining = blobsRemaining
+		// failures of the interrupted run are retried, so they no longer count
+		run.BlobsFailed = 0
+		return run, true, s.CheckpointWipeRun(run)
+	}
+	if err == nil {
+		// an unfinished run for a different plan can't be resumed by this one
+		_, err = s.db.Exec("UPDATE wipe_runs SET finished_at = ? WHERE id = ?", now, run.ID)
+		if err != nil {
+			return nil, false, errors.Err(err)
+		}
+	}
+
+	run = &WipeRun{
+		StartedAt:      now,
+		UpdatedAt:      now,
+		PlanID:         planID,
+		BlobsTotal:     blobsTotal,
+		BlobsRemaining: blobsRemaining,
+	}
+	res, err := s.db.Exec("INSERT INTO wipe_runs (started_at, updated_at, plan_id, blobs_total, blobs_remaining) VALUES (?, ?, ?, ?, ?)", run.StartedAt, run.UpdatedAt, run.PlanID, run.BlobsTotal, run.BlobsRemaining)
+	if err != nil {
+		return nil, false, errors.Err(err)
+	}
+	run.ID, err = res.LastInsertId()
+	if err != nil {
+		return nil, false, errors.Err(err)
+	}
+	return run, false, nil
+}
+
+// CheckpointWipeRun persists the progress of the run
+func (s *Store) CheckpointWipeRun(run *WipeRun) error {
+	run.UpdatedAt = time.Now().UTC()
+	_, err := s.db.Exec("UPDATE wipe_runs SET updated_at = ?, blobs_total = ?, blobs_remaining = ?, blobs_deleted = ?, blobs_failed = ? WHERE id = ?",
+		run.UpdatedAt, run.BlobsTotal, run.BlobsRemaining, run.BlobsDeleted, run.BlobsFailed, run.ID)
+	return errors.Err(err)
+}
+
+// FinishWipeRun persists the final progress of the run and marks it as finished so that it won't be resumed
+func (s *Store) FinishWipeRun(run *WipeRun) error {
+	now := time.Now().UTC()
+	run.FinishedAt = &now
+	err := s.CheckpointWipeRun(run)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("UPDATE wipe_runs SET finished_at = ? WHERE id = ?", run.FinishedAt, run.ID)
+	return errors.Err(err)
+}
+
+// LoadWipeRun returns the wipe run with the given ID
+func (s *Store) LoadWipeRun(runID int64) (*WipeRun, error) {
+	run := &WipeRun{ID: runID}
+	err := s.db.QueryRow("SELECT started_at, updated_at, finished_at, plan_id, blobs_total, blobs_remaining, blobs_deleted, blobs_failed FROM wipe_runs WHERE id = ?", runID).
+		Scan(&run.StartedAt, &run.UpdatedAt, &run.FinishedAt, &run.PlanID, &run.BlobsTotal, &run.BlobsRemaining, &run.BlobsDeleted, &run.BlobsFailed)
+	if err == sql.ErrNoRows {
+		return nil, errors.Err("wipe run %d does not exist", runID)
+	}
+	if err != nil {
+		return nil, errors.Err(err)
+	}
+	return run, nil
+}
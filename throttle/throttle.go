@@ -0,0 +1,129 @@
+package throttle
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/lbryio/lbry.go/v2/extras/errors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	initialBackoff = time.Second
+	// the rate is never lowered below this fraction of the configured one
+	minRateFraction = 1.0 / 16
+	// fraction of the configured rate regained on every success after being throttled
+	recoveryStep = 0.05
+)
+
+// Limiter is a token bucket shared by all the workers sending the same kind of request.
+// When the remote end throttles a request every worker backs off exponentially and the rate is lowered,
+// then it slowly recovers towards the configured rate as requests succeed again
+type Limiter struct {
+	limiter    *rate.Limiter
+	configured rate.Limit
+	maxBackoff time.Duration
+
+	mu          sync.Mutex
+	backoff     time.Duration
+	pausedUntil time.Time
+}
+
+// New returns a Limiter allowing perSecond events per second. A rate of 0 or less means unlimited, in which case only the backoff applies
+func New(perSecond float64, maxBackoff time.Duration) *Limiter {
+	l := &Limiter{
+		maxBackoff: maxBackoff,
+	}
+	if perSecond > 0 {
+		l.configured = rate.Limit(perSecond)
+		l.limiter = rate.NewLimiter(l.configured, int(math.Ceil(perSecond)))
+	}
+	return l
+}
+
+// Wait blocks until n events are allowed, waiting out any backoff first
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	for {
+		l.mu.Lock()
+		pause := time.Until(l.pausedUntil)
+		l.mu.Unlock()
+		if pause <= 0 {
+			break
+		}
+		timer := time.NewTimer(pause)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return errors.Err(ctx.Err())
+		}
+	}
+	if l.limiter == nil {
+		return nil
+	}
+	// the burst is the configured rate so bigger requests are split into several waits
+	burst := l.limiter.Burst()
+	for n > 0 {
+		k := n
+		if k > burst {
+			k = burst
+		}
+		err := l.limiter.WaitN(ctx, k)
+		if err != nil {
+			return errors.Err(err)
+		}
+		n -= k
+	}
+	return nil
+}
+
+// Throttled records that the remote end throttled a request. It doubles the backoff shared by all the workers,
+// halves the rate and returns how long the workers will pause for
+func (l *Limiter) Throttled() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.backoff == 0 {
+		l.backoff = initialBackoff
+	} else {
+		l.backoff *= 2
+	}
+	if l.maxBackoff > 0 && l.backoff > l.maxBackoff {
+		l.backoff = l.maxBackoff
+	}
+	until := time.Now().Add(l.backoff)
+	if until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+	if l.limiter != nil {
+		lowered := l.limiter.Limit() / 2
+		if lowered < l.configured*minRateFraction {
+			lowered = l.configured * minRateFraction
+		}
+		l.limiter.SetLimit(lowered)
+	}
+	return l.backoff
+}
+
+// Succeeded records that a request went through, resetting the backoff and raising the rate back towards the configured one
+func (l *Limiter) Succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.backoff = 0
+	if l.limiter != nil && l.limiter.Limit() < l.configured {
+		raised := l.limiter.Limit() + l.configured*recoveryStep
+		if raised > l.configured {
+			raised = l.configured
+		}
+		l.limiter.SetLimit(raised)
+	}
+}
+
+// Limit returns the rate currently enforced, 0 if unlimited
+func (l *Limiter) Limit() float64 {
+	if l.limiter == nil {
+		return 0
+	}
+	return float64(l.limiter.Limit())
+}
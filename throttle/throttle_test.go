@@ -0,0 +1,42 @@
+package throttle
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitSplitsBiggerRequests(t *testing.T) {
+	l := New(1000, time.Second)
+	start := time.Now()
+	// the first 1000 keys are served by the initial burst, the other 500 take half a second
+	assert.NoError(t, l.Wait(context.Background(), 1500))
+	assert.InDelta(t, 500*time.Millisecond, time.Since(start), float64(200*time.Millisecond))
+}
+
+func TestThrottledBacksOff(t *testing.T) {
+	l := New(100, 4*time.Second)
+	assert.Equal(t, time.Second, l.Throttled())
+	assert.Equal(t, 2*time.Second, l.Throttled())
+	assert.Equal(t, 4*time.Second, l.Throttled())
+	assert.Equal(t, 4*time.Second, l.Throttled())
+	assert.Equal(t, 100*minRateFraction, l.Limit())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Error(t, l.Wait(ctx, 1))
+
+	l.Succeeded()
+	assert.Equal(t, time.Second, l.Throttled())
+	l.Succeeded()
+	assert.Greater(t, l.Limit(), 100*minRateFraction)
+}
+
+func TestUnlimited(t *testing.T) {
+	l := New(0, time.Second)
+	assert.NoError(t, l.Wait(context.Background(), 1000000))
+	l.Throttled()
+	assert.Equal(t, 0.0, l.Limit())
+}